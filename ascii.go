@@ -27,6 +27,6 @@ func outputInfo(s *Server) {
 	tb.SetColumnColor(tablewriter.Colors{tablewriter.Bold, tablewriter.FgHiBlackColor},
 		tablewriter.Colors{tablewriter.Bold, tablewriter.FgHiBlackColor},
 		tablewriter.Colors{tablewriter.Bold, tablewriter.FgBlackColor})
-	tb.Append([]string{strconv.Itoa(os.Getpid()), strconv.Itoa(s.concurrency), s.taskPeekInterval.String()})
+	tb.Append([]string{strconv.Itoa(os.Getpid()), strconv.Itoa(s.pool.Size()), s.taskPeekInterval.String()})
 	tb.Render()
 }
@@ -0,0 +1,98 @@
+package acornq
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// BlobStore keeps payloads too large for redis, see Client.SetBlobStore.
+// A blob is keyed by the task key of its task, so it is deleted by Cleaner together with the task.
+type BlobStore interface {
+	Put(ctx context.Context, key string, data []byte) error
+	// Get returns ErrBlobNotFound if key is not stored.
+	Get(ctx context.Context, key string) ([]byte, error)
+	// Delete of a missing key is not an error.
+	Delete(ctx context.Context, key string) error
+}
+
+var ErrBlobNotFound = errors.New("blob not found")
+
+// FileBlobStore stores blobs as files in a directory shared by clients and servers, for local use.
+type FileBlobStore struct {
+	dir string
+}
+
+// NewFileBlobStore returns a FileBlobStore in dir, dir is created if it does not exist.
+func NewFileBlobStore(dir string) (s *FileBlobStore, err error) {
+	err = os.MkdirAll(dir, 0o755)
+	if err != nil {
+		return
+	}
+	return &FileBlobStore{dir: dir}, nil
+}
+
+// path maps key to a file name, task keys contain characters not allowed in file names of some systems.
+func (s *FileBlobStore) path(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(s.dir, hex.EncodeToString(sum[:]))
+}
+
+// Put writes to a temporary file renamed to the blob file, readers never see a partial blob.
+func (s *FileBlobStore) Put(_ context.Context, key string, data []byte) (err error) {
+	f, err := os.CreateTemp(s.dir, ".tmp-*")
+	if err != nil {
+		return
+	}
+	_, err = f.Write(data)
+	if err1 := f.Close(); err == nil {
+		err = err1
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), s.path(key))
+	}
+	if err != nil {
+		_ = os.Remove(f.Name())
+	}
+	return
+}
+
+func (s *FileBlobStore) Get(_ context.Context, key string) (data []byte, err error) {
+	data, err = os.ReadFile(s.path(key))
+	if errors.Is(err, fs.ErrNotExist) {
+		err = ErrBlobNotFound
+	}
+	return
+}
+
+func (s *FileBlobStore) Delete(_ context.Context, key string) (err error) {
+	err = os.Remove(s.path(key))
+	if errors.Is(err, fs.ErrNotExist) {
+		err = nil
+	}
+	return
+}
+
+// fetchPayload replaces payload of t offloaded to store by the blob before handling.
+func fetchPayload(ctx context.Context, store BlobStore, t *TaskInfo) (err error) {
+	if len(t.PayloadRef) == 0 {
+		return
+	}
+	if store == nil {
+		return fmt.Errorf("payload of task %q is in blob store but server has none: %w", b2s(t.ID), SkipRetry)
+	}
+	payload, err := store.Get(ctx, b2s(t.PayloadRef))
+	if errors.Is(err, ErrBlobNotFound) {
+		return fmt.Errorf("payload blob %q: %w: %w", b2s(t.PayloadRef), err, SkipRetry)
+	}
+	if err != nil {
+		return
+	}
+	t.Payload = payload
+	return
+}
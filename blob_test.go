@@ -0,0 +1,175 @@
+package acornq
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFileBlobStore(t *testing.T) {
+	ctx := context.Background()
+	store, err := NewFileBlobStore(t.TempDir())
+	require.Nil(t, err)
+	key := NewKeyInfo("q").TaskKey("1")
+	assert.Nil(t, store.Put(ctx, key, []byte("blob")))
+	data, err := store.Get(ctx, key)
+	assert.Nil(t, err)
+	assert.Equal(t, "blob", string(data))
+	assert.Nil(t, store.Delete(ctx, key))
+	assert.Nil(t, store.Delete(ctx, key))
+	_, err = store.Get(ctx, key)
+	assert.ErrorIs(t, err, ErrBlobNotFound)
+}
+
+func TestServer_BlobStore(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	store, err := NewFileBlobStore(dir)
+	require.Nil(t, err)
+	broker := NewMemoryBroker()
+	handled := make(chan string, 2)
+	s, err := NewServer(&Config{
+		Handler: TaskHandlerFunc(func(task *TaskInfo) error {
+			handled <- string(task.Payload)
+			return nil
+		}),
+		Broker:           broker,
+		BlobStore:        store,
+		TaskPeekInterval: 10 * time.Millisecond,
+		ErrHandler:       func(err error) { t.Error(err) },
+	})
+	require.Nil(t, err)
+	go s.Start()
+	defer func() {
+		ctx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+		defer cancel()
+		s.ShutDown(ctx)
+	}()
+
+	cli := NewClientWithBroker(broker)
+	cli.SetBlobStore(store, 16)
+	large := strings.Repeat("x", 1024)
+	require.Nil(t, cli.EnqueueContext(ctx, NewTask("task", []byte(large))))
+	require.Nil(t, cli.EnqueueContext(ctx, NewTask("task", []byte("small"))))
+	got := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		select {
+		case payload := <-handled:
+			got[payload] = true
+		case <-time.After(5 * time.Second):
+			t.Fatal("task not handled")
+		}
+	}
+	assert.Equal(t, map[string]bool{large: true, "small": true}, got)
+	// blob is deleted with the task
+	assert.Eventually(t, func() bool {
+		entries, err := os.ReadDir(dir)
+		return err == nil && len(entries) == 0
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestServer_DeadLetterBlobs(t *testing.T) {
+	defer func(n int) { deadLetterMaxLen = n }(deadLetterMaxLen)
+	deadLetterMaxLen = 1
+	t.Run("memory", func(t *testing.T) {
+		testDeadLetterBlobs(t, NewMemoryBroker(), defaultQueueName)
+	})
+	t.Run("redis", func(t *testing.T) {
+		redisCli := client(t)
+		for _, layout := range testLayouts(t, redisCli) {
+			t.Run(layout.String(), func(t *testing.T) {
+				testDeadLetterBlobs(t, NewRedisBrokerWithLayout(redisCli, layout), testQueue(t))
+			})
+		}
+	})
+}
+
+// testDeadLetterBlobs checks blobs of dead letter tasks are kept until their entries are trimmed.
+func testDeadLetterBlobs(t *testing.T, broker Broker, queue string) {
+	ctx := context.Background()
+	store, err := NewFileBlobStore(t.TempDir())
+	require.Nil(t, err)
+	s, err := NewServer(&Config{
+		Handler: TaskHandlerFunc(func(task *TaskInfo) error {
+			return errors.New("tmp error")
+		}),
+		QueueConfigs:     map[string]QueueConfig{queue: {Priority: 1, DeadLetter: true}},
+		Broker:           broker,
+		BlobStore:        store,
+		TaskPeekInterval: 10 * time.Millisecond,
+		ErrHandler:       func(err error) { t.Error(err) },
+	})
+	require.Nil(t, err)
+	go s.Start()
+	defer func() {
+		ctx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+		defer cancel()
+		s.ShutDown(ctx)
+	}()
+
+	cli := NewClientWithBroker(broker)
+	cli.SetBlobStore(store, 16)
+	large := []byte(strings.Repeat("x", 1024))
+	deadLetters := func(ids ...string) func() bool {
+		return func() bool {
+			ts, err := broker.DeadLetterTasks(ctx, queue, 10)
+			if err != nil || len(ts) != len(ids) {
+				return false
+			}
+			for i, dt := range ts {
+				if string(dt.Task.ID) != ids[i] {
+					return false
+				}
+			}
+			return true
+		}
+	}
+	require.Nil(t, cli.EnqueueContext(ctx, NewTask("task", large), Queue(queue), TaskID("1"), MaxRetry(0)))
+	require.Eventually(t, deadLetters("1"), 5*time.Second, 10*time.Millisecond)
+	keyInfo := NewKeyInfo(queue)
+	_, err = store.Get(ctx, keyInfo.TaskKey("1"))
+	assert.Nil(t, err)
+
+	// entry of task 1 is trimmed by task 2
+	require.Nil(t, cli.EnqueueContext(ctx, NewTask("task", large), Queue(queue), TaskID("2"), MaxRetry(0)))
+	require.Eventually(t, deadLetters("2"), 5*time.Second, 10*time.Millisecond)
+	_, err = store.Get(ctx, keyInfo.TaskKey("1"))
+	assert.ErrorIs(t, err, ErrBlobNotFound)
+	_, err = store.Get(ctx, keyInfo.TaskKey("2"))
+	assert.Nil(t, err)
+}
+
+func TestRedisBroker_CleanUpArchiveBlobs(t *testing.T) {
+	redisCli := client(t)
+	for _, layout := range testLayouts(t, redisCli) {
+		t.Run(layout.String(), func(t *testing.T) {
+			ctx := context.Background()
+			queue := testQueue(t)
+			broker := NewRedisBrokerWithLayout(redisCli, layout)
+			store, err := NewFileBlobStore(t.TempDir())
+			require.Nil(t, err)
+			cli := NewClientWithBroker(broker)
+			cli.SetBlobStore(store, 16)
+			require.Nil(t, cli.EnqueueContext(ctx, NewTask("task", []byte(strings.Repeat("x", 1024))), Queue(queue), TaskID("a"), Retention(time.Second)))
+			require.Nil(t, cli.EnqueueContext(ctx, NewTask("task", []byte("small")), Queue(queue), TaskID("b"), Retention(time.Second)))
+			ts, err := broker.PickTasks(ctx, []string{queue}, 2, nil)
+			require.Nil(t, err)
+			require.Len(t, ts, 2)
+			require.Nil(t, broker.Active2Archive(ctx, ts, true))
+
+			// only the recorded ref is returned, the task without blob is removed silently
+			time.Sleep(1100 * time.Millisecond)
+			payloadRefs, err := broker.CleanUpArchive(ctx, 100)
+			require.Nil(t, err)
+			assert.Equal(t, []string{NewKeyInfo(queue).TaskKey("a")}, payloadRefs)
+			n, err := redisCli.Do(ctx, redisCli.B().Exists().Key(NewKeyInfo(queue).BlobsKey()).Build()).AsInt64()
+			require.Nil(t, err)
+			assert.Zero(t, n)
+		})
+	}
+}
@@ -2,14 +2,76 @@ package acornq
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
 	"github.com/redis/rueidis"
+	"slices"
 	"strconv"
+	"sync"
 	"time"
 )
 
-type Broker struct {
+// Broker stores tasks and moves them between states, it is shared by Client, Server and Inspector.
+// RedisBroker is used in production, StreamBroker is its variant delivering tasks by redis streams,
+// MemoryBroker keeps everything in process for tests and local development.
+type Broker interface {
+	// AddQueue registers queue, tasks of unregistered queues are not picked or recovered.
+	AddQueue(queue string)
+	// EnqueueTasks adds tasks to pending list or scheduled sorted set.
+	EnqueueTasks(ctx context.Context, ts []*TaskInfo) error
+	// PickTasks moves at most count tasks of queues into active list and returns them.
+	PickTasks(ctx context.Context, queues []string, count int, limits map[string]int) ([]*TaskInfo, error)
+	// Backlog returns pending list length of queues.
+	Backlog(ctx context.Context, queues []string) (map[string]int64, error)
+	// SubscribeNotify blocks until ctx is done, fn is called when tasks enter pending list.
+	SubscribeNotify(ctx context.Context, queues []string, fn func(queue string, n int)) error
+	RetryTasks(ctx context.Context, ts []*TaskInfo) error
+	Active2Pending(ctx context.Context, ts []*TaskInfo) error
+	Active2Archive(ctx context.Context, ts []*TaskInfo, successful bool) error
+	// Active2DeadLetter returns entries trimmed from dead letter queues to keep them bounded.
+	Active2DeadLetter(ctx context.Context, ts []*TaskInfo) ([]*DeadLetterTask, error)
+	DeleteActiveTasks(ctx context.Context, ts []*TaskInfo) error
+	SetErrorMsg(ctx context.Context, t *TaskInfo) error
+	RecoveryTasks(queues []string, idleTimeout time.Duration) (int, error)
+	LiveTasksChange(ctx context.Context, items []*liveItem, update bool) error
+	DeleteLiveTasks(ctx context.Context, items []*liveItem) error
+	// CleanUpArchive removes archived tasks whose retention expired and returns payload refs of those had one.
+	CleanUpArchive(ctx context.Context, batchLen int) ([]string, error)
+	SetMaxActive(ctx context.Context, queue string, n int) error
+	MaxActive(ctx context.Context, queue string) (int, error)
+	SetRateLimit(ctx context.Context, queue string, taskType string, limit RateLimit) error
+	DeadLetterTasks(ctx context.Context, queue string, count int) ([]*DeadLetterTask, error)
+	ReplayDeadLetter(ctx context.Context, queue string, ids []string) (int, error)
+	WriteServerState(ctx context.Context, info *ServerInfo, workers []*WorkerInfo, ttl time.Duration) error
+	ListServers(ctx context.Context) ([]*ServerInfo, error)
+}
+
+// RedisBroker stores tasks in redis, see StorageLayout.
+type RedisBroker struct {
+	mu       sync.RWMutex
 	keyInfos []*KeyInfo
 	redisCli rueidis.Client
+	layout   StorageLayout
+	scripts  *taskScripts
+}
+
+// NewRedisBroker returns a RedisBroker in LayoutJSON, which requires RedisJSON module.
+func NewRedisBroker(redisCli rueidis.Client) *RedisBroker {
+	return NewRedisBrokerWithLayout(redisCli, LayoutJSON)
+}
+
+// NewRedisBrokerWithLayout returns a RedisBroker stores tasks in layout,
+// all clients and servers of a queue must use the same layout, see MigrateLayout.
+func NewRedisBrokerWithLayout(redisCli rueidis.Client, layout StorageLayout) *RedisBroker {
+	return &RedisBroker{redisCli: redisCli, layout: layout, scripts: layout.scripts()}
+}
+
+func (b *RedisBroker) AddQueue(queue string) {
+	b.mu.Lock()
+	if slices.IndexFunc(b.keyInfos, func(keyInfo *KeyInfo) bool { return keyInfo.queue == queue }) == -1 {
+		b.keyInfos = append(b.keyInfos, NewKeyInfo(queue))
+	}
+	b.mu.Unlock()
 }
 
 // PickTasks from pending set.
@@ -17,10 +79,20 @@ type Broker struct {
 // 2. move task from scheduled list to pending list.
 // 3. move task from retry list to pending list.
 // 4. move task from pending list to active list and return them.
-func (b *Broker) PickTasks(ctx context.Context, queues []string, count int) (ts []*TaskInfo, err error) {
+//
+// limits maps queue name to max count picked from it, saturated queue(0) is skipped,
+// queue not in limits is not limited.
+func (b *RedisBroker) PickTasks(ctx context.Context, queues []string, count int, limits map[string]int) (ts []*TaskInfo, err error) {
 	var ts1 []*TaskInfo
 	for _, queue := range queues {
-		ts1, err = b.pickTasks(ctx, b.keyInfo(queue), count)
+		n := count
+		if limit, ok := limits[queue]; ok {
+			if limit <= 0 {
+				continue
+			}
+			n = min(n, limit)
+		}
+		ts1, err = b.pickTasks(ctx, b.keyInfo(queue), n)
 		// network error, break loop and return error
 		if err != nil {
 			return
@@ -37,10 +109,36 @@ func (b *Broker) PickTasks(ctx context.Context, queues []string, count int) (ts
 	return
 }
 
+// Backlog returns pending list length of queues in one round-trip.
+func (b *RedisBroker) Backlog(ctx context.Context, queues []string) (m map[string]int64, err error) {
+	cmds := make(rueidis.Commands, 0, len(queues))
+	names := make([]string, 0, len(queues))
+	for _, queue := range queues {
+		keyInfo := b.keyInfo(queue)
+		if keyInfo == nil {
+			continue
+		}
+		names = append(names, queue)
+		cmds = append(cmds, b.redisCli.B().Llen().Key(keyInfo.PendingKey()).Build())
+	}
+	if len(cmds) == 0 {
+		return
+	}
+	m = make(map[string]int64, len(names))
+	for i, resp := range b.redisCli.DoMulti(ctx, cmds...) {
+		v, err1 := resp.AsInt64()
+		if err1 != nil {
+			return nil, err1
+		}
+		m[names[i]] = v
+	}
+	return
+}
+
 // only return network error, other err convert to nil.
-func (b *Broker) pickTasks(ctx context.Context, keyInfo *KeyInfo, count int) (ts []*TaskInfo, err error) {
-	keys := []string{keyInfo.PendingKey(), keyInfo.ActiveKey(), keyInfo.ScheduledKey(), keyInfo.RetryKey()}
-	resp := pickTasksLs.Exec(ctx, b.redisCli, keys, []string{strconv.Itoa(count), strconv.Itoa(int(Pending)), strconv.Itoa(int(Active))})
+func (b *RedisBroker) pickTasks(ctx context.Context, keyInfo *KeyInfo, count int) (ts []*TaskInfo, err error) {
+	keys := []string{keyInfo.PendingKey(), keyInfo.ActiveKey(), keyInfo.ScheduledKey(), keyInfo.RetryKey(), keyInfo.MaxActiveKey(), keyInfo.RateLimitKey()}
+	resp := b.scripts.pickTasks.Exec(ctx, b.redisCli, keys, []string{strconv.Itoa(count), strconv.Itoa(int(Pending)), strconv.Itoa(int(Active)), keyInfo.NotifyChannel(), strconv.Itoa(int(Scheduled))})
 	arr, err := resp.ToArray()
 	if len(arr) == 0 {
 		return
@@ -48,11 +146,7 @@ func (b *Broker) pickTasks(ctx context.Context, keyInfo *KeyInfo, count int) (ts
 	err = nil
 	ts = make([]*TaskInfo, 0, len(arr))
 	for _, v := range arr {
-		str, err1 := v.ToString()
-		if err1 != nil {
-			continue
-		}
-		t, err1 := unmarshalTask(s2b(str))
+		t, err1 := b.layout.decodeTask(v)
 		if err1 != nil {
 			continue
 		}
@@ -64,27 +158,37 @@ func (b *Broker) pickTasks(ctx context.Context, keyInfo *KeyInfo, count int) (ts
 // RecoveryTasks move zombies tasks from active list to pending list.
 // clear zombie tasks from live list.
 //
-// 1. idle 30 seconds
+// 1. idle idleTimeout seconds
 //
-// 2. task in active list not int live sorted set for 30 seconds.
-// 3. task in live sorted set and in active list max time compare now for 30 seconds.
+// 2. task in active list not int live sorted set for idleTimeout.
+// 3. task in live sorted set and in active list max time compare now for idleTimeout.
 // 4. move 2 and 3 tasks to pending list.
 //
 // 5. delete tasks only in live sorted set but not in active list.
-func (b *Broker) RecoveryTasks(queues []string, idleTimeout time.Duration) (err error) {
+//
+// n is the count of tasks moved back to pending list, semaphore leases held by them are released.
+func (b *RedisBroker) RecoveryTasks(queues []string, idleTimeout time.Duration) (n int, err error) {
 	idleTimeoutStr := strconv.Itoa(int(idleTimeout.Seconds()))
+	var taskKeys []string
 	for _, queue := range queues {
 		keyInfo := b.keyInfo(queue)
-		err = b.recoveryTasks(context.Background(), keyInfo, idleTimeoutStr)
+		taskKeys, err = b.recoveryTasks(context.Background(), keyInfo, idleTimeoutStr)
+		n += len(taskKeys)
 		if err != nil {
 			return
 		}
+		if len(taskKeys) > 0 {
+			err = b.ReleaseLeases(context.Background(), taskKeys)
+			if err != nil {
+				return
+			}
+		}
 	}
 	return
 }
 
-func (b *Broker) recoveryTasks(ctx context.Context, keyInfo *KeyInfo, idleTimeout string) (err error) {
-	err = recoveryLs.Exec(ctx, b.redisCli, []string{keyInfo.ActiveKey(), keyInfo.LiveKey(), keyInfo.PendingKey()}, []string{idleTimeout, strconv.Itoa(int(Pending))}).Error()
+func (b *RedisBroker) recoveryTasks(ctx context.Context, keyInfo *KeyInfo, idleTimeout string) (taskKeys []string, err error) {
+	taskKeys, err = b.scripts.recovery.Exec(ctx, b.redisCli, []string{keyInfo.ActiveKey(), keyInfo.LiveKey(), keyInfo.PendingKey()}, []string{idleTimeout, strconv.Itoa(int(Pending)), keyInfo.NotifyChannel()}).AsStrSlice()
 	//goland:noinspection GoDirectComparisonOfErrors
 	if err == rueidis.Nil {
 		err = nil
@@ -93,7 +197,7 @@ func (b *Broker) recoveryTasks(ctx context.Context, keyInfo *KeyInfo, idleTimeou
 }
 
 // LiveTasksChange add or update scores in live sorted set.
-func (b *Broker) LiveTasksChange(ctx context.Context, items []*liveItem, update bool) (err error) {
+func (b *RedisBroker) LiveTasksChange(ctx context.Context, items []*liveItem, update bool) (err error) {
 	if len(items) > 1 {
 		m := map[string][]*liveItem{}
 		for _, item := range items {
@@ -122,20 +226,16 @@ func (b *Broker) LiveTasksChange(ctx context.Context, items []*liveItem, update
 	return
 }
 
-func (b *Broker) liveTasksChange(ctx context.Context, keyInfo *KeyInfo, items []*liveItem, update bool) (err error) {
+func (b *RedisBroker) liveTasksChange(ctx context.Context, keyInfo *KeyInfo, items []*liveItem, update bool) (err error) {
 	nowStr := strconv.FormatInt(time.Now().Unix(), 10)
 	args := make([]string, 0, len(items)*2+1)
 	if update {
-		args[0] = "XX"
+		args = append(args, "XX")
 	} else {
-		args[0] = "NX"
+		args = append(args, "NX")
 	}
-	args1 := args[1 : len(items)+1]
-	j := 0
 	for _, item := range items {
-		args1[j] = nowStr
-		args1[j+1] = keyInfo.TaskKey(item.taskID)
-		j += 2
+		args = append(args, nowStr, keyInfo.TaskKey(item.taskID))
 	}
 	err = b.redisCli.Do(ctx, b.redisCli.B().Arbitrary("ZADD").Keys(keyInfo.LiveKey()).Args(args...).Build()).Error()
 	if //goland:noinspection GoDirectComparisonOfErrors
@@ -146,7 +246,7 @@ func (b *Broker) liveTasksChange(ctx context.Context, keyInfo *KeyInfo, items []
 }
 
 // DeleteLiveTasks delete tasks from live sorted set.
-func (b *Broker) DeleteLiveTasks(ctx context.Context, items []*liveItem) (err error) {
+func (b *RedisBroker) DeleteLiveTasks(ctx context.Context, items []*liveItem) (err error) {
 	if len(items) > 1 {
 		m := map[string][]*liveItem{}
 		for _, item := range items {
@@ -171,7 +271,7 @@ func (b *Broker) DeleteLiveTasks(ctx context.Context, items []*liveItem) (err er
 	return
 }
 
-func (b *Broker) deleteLiveTasks(ctx context.Context, keyInfo *KeyInfo, items []*liveItem) (err error) {
+func (b *RedisBroker) deleteLiveTasks(ctx context.Context, keyInfo *KeyInfo, items []*liveItem) (err error) {
 	members := make([]string, len(items))
 	for i, item := range items {
 		members[i] = keyInfo.TaskKey(item.taskID)
@@ -185,7 +285,7 @@ func (b *Broker) deleteLiveTasks(ctx context.Context, keyInfo *KeyInfo, items []
 }
 
 // EnqueueTasks add tasks to pending list or scheduled sorted set.
-func (b *Broker) EnqueueTasks(ctx context.Context, ts []*TaskInfo) (err error) {
+func (b *RedisBroker) EnqueueTasks(ctx context.Context, ts []*TaskInfo) (err error) {
 	now := time.Now().Unix()
 	if len(ts) > 1 {
 		pending := map[string][]*TaskInfo{}
@@ -209,47 +309,76 @@ func (b *Broker) EnqueueTasks(ctx context.Context, ts []*TaskInfo) (err error) {
 		return
 	}
 	t := ts[0]
-	b1, err := MarshalTask(t)
-	if err != nil {
-		return
-	}
 	keyInfo := b.keyInfo(b2s(t.Queue))
 	if t.Scheduled(now) {
-		return enqueueScheduledLs.Exec(ctx, b.redisCli, []string{keyInfo.ScheduledKey(), keyInfo.TaskKey(b2s(t.ID))}, []string{b2s(b1)}).Error()
+		args, err := b.layout.taskArgs(nil, t)
+		if err != nil {
+			return err
+		}
+		return b.scripts.enqueueScheduled.Exec(ctx, b.redisCli, []string{keyInfo.ScheduledKey(), keyInfo.TaskKey(b2s(t.ID))}, args).Error()
+	}
+	args, err := b.layout.taskArgs([]string{keyInfo.NotifyChannel()}, t)
+	if err != nil {
+		return
 	}
-	return enqueuePendingLs.Exec(ctx, b.redisCli, []string{keyInfo.PendingKey(), keyInfo.TaskKey(b2s(t.ID))}, []string{b2s(b1)}).Error()
+	return b.scripts.enqueuePending.Exec(ctx, b.redisCli, []string{keyInfo.PendingKey(), keyInfo.TaskKey(b2s(t.ID))}, args).Error()
 }
 
-func (b *Broker) enqueueTasks(ctx context.Context, queue2ts map[string][]*TaskInfo, scheduled bool) (err error) {
-	ls := enqueuePendingLs
+func (b *RedisBroker) enqueueTasks(ctx context.Context, queue2ts map[string][]*TaskInfo, scheduled bool) (err error) {
+	ls := b.scripts.enqueuePending
 	if scheduled {
-		ls = enqueueScheduledLs
+		ls = b.scripts.enqueueScheduled
 	}
 	for queue, tasks := range queue2ts {
 		keyInfo := b.keyInfo(queue)
-		keys, argv := make([]string, len(tasks)+1), make([]string, len(tasks))
+		keys, argv := make([]string, len(tasks)+1), make([]string, 0, len(tasks)+1)
 		if scheduled {
 			keys[0] = b.keyInfo(queue).ScheduledKey()
 		} else {
 			keys[0] = b.keyInfo(queue).PendingKey()
+			argv = append(argv, keyInfo.NotifyChannel())
 		}
 		keys2 := keys[1:]
 		for i, t := range tasks {
 			keys2[i] = keyInfo.TaskKey(b2s(t.ID))
-			b1, err1 := MarshalTask(t)
-			if err1 != nil {
-				err = err1
+			argv, err = b.layout.taskArgs(argv, t)
+			if err != nil {
 				return
 			}
-			argv[i] = b2s(b1)
 		}
 		err = ls.Exec(ctx, b.redisCli, keys, argv).Error()
+		if err != nil {
+			return
+		}
 	}
 	return
 }
 
+// SubscribeNotify blocks until ctx is done or the connection is broken,
+// fn is called with queue name and count of tasks entered pending list.
+func (b *RedisBroker) SubscribeNotify(ctx context.Context, queues []string, fn func(queue string, n int)) (err error) {
+	channels := make([]string, 0, len(queues))
+	channel2queue := make(map[string]string, len(queues))
+	for _, queue := range queues {
+		keyInfo := b.keyInfo(queue)
+		if keyInfo == nil {
+			continue
+		}
+		channels = append(channels, keyInfo.NotifyChannel())
+		channel2queue[keyInfo.NotifyChannel()] = queue
+	}
+	if len(channels) == 0 {
+		<-ctx.Done()
+		return
+	}
+	return b.redisCli.Receive(ctx, b.redisCli.B().Subscribe().Channel(channels...).Build(), func(msg rueidis.PubSubMessage) {
+		n, _ := strconv.Atoi(msg.Message)
+		fn(channel2queue[msg.Channel], n)
+	})
+}
+
 // RetryTasks remove ts from active list and add tasks to retry sorted set conditional.
-func (b *Broker) RetryTasks(ctx context.Context, ts []*TaskInfo) (err error) {
+func (b *RedisBroker) RetryTasks(ctx context.Context, ts []*TaskInfo) (err error) {
 	if len(ts) > 1 {
 		m := map[string][]*TaskInfo{}
 		for _, t := range ts {
@@ -270,7 +399,7 @@ func (b *Broker) RetryTasks(ctx context.Context, ts []*TaskInfo) (err error) {
 }
 
 /*
-	func (b *Broker) retryTasks(ctx context.Context, keyInfo *KeyInfo, ts []*TaskInfo, isFailure bool) (err error) {
+	func (b *RedisBroker) retryTasks(ctx context.Context, keyInfo *KeyInfo, ts []*TaskInfo, isFailure bool) (err error) {
 		keys := make([]string, len(ts)+2)
 		args := make([]string, len(ts)+2)
 		keys[0] = keyInfo.RetryKey()
@@ -290,22 +419,24 @@ func (b *Broker) RetryTasks(ctx context.Context, ts []*TaskInfo) (err error) {
 		return
 	}
 */
-func (b *Broker) retryTasks(ctx context.Context, keyInfo *KeyInfo, ts []*TaskInfo) (err error) {
+func (b *RedisBroker) retryTasks(ctx context.Context, keyInfo *KeyInfo, ts []*TaskInfo) (err error) {
 	keys := make([]string, len(ts)+2)
-	args := make([]string, len(ts)*2+1)
+	args := make([]string, len(ts)*3+2)
 	keys[0] = keyInfo.RetryKey()
 	keys[1] = keyInfo.ActiveKey()
 	args[0] = strconv.Itoa(int(Retried))
+	args[1] = strconv.Itoa(maxTaskAttempts)
 	keys2 := keys[2:]
-	args2 := args[1:]
+	args2 := args[2:]
 	j := 0
 	for i, t := range ts {
 		keys2[i] = keyInfo.TaskKey(b2s(t.ID))
 		args2[j] = strconv.FormatUint(uint64(t.PendingAt), 10)
 		args2[j+1] = strconv.Itoa(t.Retried)
-		j += 2
+		args2[j+2] = t.attemptArg()
+		j += 3
 	}
-	err = retryTasksLs.Exec(ctx, b.redisCli, keys, args).Error()
+	err = b.scripts.retryTasks.Exec(ctx, b.redisCli, keys, args).Error()
 	if //goland:noinspection GoDirectComparisonOfErrors
 	err == rueidis.Nil {
 		err = nil
@@ -313,7 +444,9 @@ func (b *Broker) retryTasks(ctx context.Context, keyInfo *KeyInfo, ts []*TaskInf
 	return
 }
 
-func (b *Broker) keyInfo(queue string) (keyInfo *KeyInfo) {
+func (b *RedisBroker) keyInfo(queue string) (keyInfo *KeyInfo) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
 	for i := 0; i < len(b.keyInfos); i++ {
 		if b.keyInfos[i].queue == queue {
 			return b.keyInfos[i]
@@ -322,7 +455,48 @@ func (b *Broker) keyInfo(queue string) (keyInfo *KeyInfo) {
 	return
 }
 
-func (b *Broker) Active2Pending(ctx context.Context, ts []*TaskInfo) (err error) {
+// queueKeyInfo is like keyInfo, but creates KeyInfo for queue not belong to broker.
+func (b *RedisBroker) queueKeyInfo(queue string) (keyInfo *KeyInfo) {
+	keyInfo = b.keyInfo(queue)
+	if keyInfo == nil {
+		keyInfo = NewKeyInfo(queue)
+	}
+	return
+}
+
+// SetMaxActive limits active tasks of queue across all servers, n <= 0 removes the limit.
+func (b *RedisBroker) SetMaxActive(ctx context.Context, queue string, n int) (err error) {
+	keyInfo := b.queueKeyInfo(queue)
+	if n <= 0 {
+		return b.redisCli.Do(ctx, b.redisCli.B().Del().Key(keyInfo.MaxActiveKey()).Build()).Error()
+	}
+	return b.redisCli.Do(ctx, b.redisCli.B().Set().Key(keyInfo.MaxActiveKey()).Value(strconv.Itoa(n)).Build()).Error()
+}
+
+// SetRateLimit sets token bucket of queue, or of taskType in queue if taskType is not empty.
+// Zero rate removes the limit.
+func (b *RedisBroker) SetRateLimit(ctx context.Context, queue string, taskType string, limit RateLimit) (err error) {
+	keyInfo := b.queueKeyInfo(queue)
+	prefix := rateLimitPrefix(taskType)
+	if limit.Rate <= 0 {
+		return b.redisCli.Do(ctx, b.redisCli.B().Hdel().Key(keyInfo.RateLimitKey()).
+			Field(prefix+"rate", prefix+"burst", prefix+"tokens", prefix+"ts").Build()).Error()
+	}
+	return b.redisCli.Do(ctx, b.redisCli.B().Arbitrary("HSET").Keys(keyInfo.RateLimitKey()).Args(limit.fields(prefix)...).Build()).Error()
+}
+
+// MaxActive returns active tasks limit of queue across all servers, 0 means no limit.
+func (b *RedisBroker) MaxActive(ctx context.Context, queue string) (n int, err error) {
+	v, err := b.redisCli.Do(ctx, b.redisCli.B().Get().Key(b.queueKeyInfo(queue).MaxActiveKey()).Build()).AsInt64()
+	//goland:noinspection GoDirectComparisonOfErrors
+	if err == rueidis.Nil {
+		err = nil
+	}
+	n = int(v)
+	return
+}
+
+func (b *RedisBroker) Active2Pending(ctx context.Context, ts []*TaskInfo) (err error) {
 	if len(ts) > 1 {
 		m := map[string][]*TaskInfo{}
 		for _, t := range ts {
@@ -341,7 +515,7 @@ func (b *Broker) Active2Pending(ctx context.Context, ts []*TaskInfo) (err error)
 	return b.active2pending(ctx, keyInfo, []*TaskInfo{t})
 }
 
-func (b *Broker) active2pending(ctx context.Context, keyInfo *KeyInfo, ts []*TaskInfo) (err error) {
+func (b *RedisBroker) active2pending(ctx context.Context, keyInfo *KeyInfo, ts []*TaskInfo) (err error) {
 	keys := make([]string, len(ts)+2)
 	keys[0] = keyInfo.PendingKey()
 	keys[1] = keyInfo.ActiveKey()
@@ -349,7 +523,7 @@ func (b *Broker) active2pending(ctx context.Context, keyInfo *KeyInfo, ts []*Tas
 	for i, t := range ts {
 		keys2[i] = keyInfo.TaskKey(b2s(t.ID))
 	}
-	err = active2pendingLs.Exec(ctx, b.redisCli, keys, nil).Error()
+	err = b.scripts.active2pending.Exec(ctx, b.redisCli, keys, []string{keyInfo.NotifyChannel()}).Error()
 	if //goland:noinspection GoDirectComparisonOfErrors
 	err == rueidis.Nil {
 		err = nil
@@ -357,7 +531,7 @@ func (b *Broker) active2pending(ctx context.Context, keyInfo *KeyInfo, ts []*Tas
 	return
 }
 
-func (b *Broker) Active2Archive(ctx context.Context, ts []*TaskInfo, successful bool) (err error) {
+func (b *RedisBroker) Active2Archive(ctx context.Context, ts []*TaskInfo, successful bool) (err error) {
 	if len(ts) > 1 {
 		m := map[string][]*TaskInfo{}
 		for _, t := range ts {
@@ -376,9 +550,9 @@ func (b *Broker) Active2Archive(ctx context.Context, ts []*TaskInfo, successful
 	return b.active2Archive(ctx, keyInfo, []*TaskInfo{t}, successful)
 }
 
-func (b *Broker) active2Archive(ctx context.Context, keyInfo *KeyInfo, ts []*TaskInfo, successful bool) (err error) {
-	keys := make([]string, len(ts)+3)
-	args := make([]string, len(ts)+1)
+func (b *RedisBroker) active2Archive(ctx context.Context, keyInfo *KeyInfo, ts []*TaskInfo, successful bool) (err error) {
+	keys := make([]string, len(ts)+4)
+	args := make([]string, len(ts)*2+3)
 	if successful {
 		keys[0] = keyInfo.SuccessfulKey()
 	} else {
@@ -386,6 +560,7 @@ func (b *Broker) active2Archive(ctx context.Context, keyInfo *KeyInfo, ts []*Tas
 	}
 	keys[1] = keyInfo.ActiveKey()
 	keys[2] = keyInfo.ToDeleteKey()
+	keys[3] = keyInfo.BlobsKey()
 	state := Archived
 	if successful {
 		state |= Successful
@@ -393,13 +568,19 @@ func (b *Broker) active2Archive(ctx context.Context, keyInfo *KeyInfo, ts []*Tas
 		state |= Failed
 	}
 	args[0] = strconv.Itoa(int(state))
-	keys2 := keys[3:]
-	args2 := args[1:]
+	args[1] = strconv.Itoa(maxTaskAttempts)
+	args[2] = "0"
+	if !successful {
+		args[2] = "1"
+	}
+	keys2 := keys[4:]
+	args2 := args[3:]
 	for i, t := range ts {
 		keys2[i] = keyInfo.TaskKey(b2s(t.ID))
-		args2[i] = strconv.Itoa(t.Retention)
+		args2[i*2] = strconv.Itoa(t.Retention)
+		args2[i*2+1] = t.attemptArg()
 	}
-	err = active2ArchiveLs.Exec(ctx, b.redisCli, keys, args).Error()
+	err = b.scripts.active2Archive.Exec(ctx, b.redisCli, keys, args).Error()
 	if //goland:noinspection GoDirectComparisonOfErrors
 	err == rueidis.Nil {
 		err = nil
@@ -407,37 +588,296 @@ func (b *Broker) active2Archive(ctx context.Context, keyInfo *KeyInfo, ts []*Tas
 	return
 }
 
-func (b *Broker) SetErrorMsg(ctx context.Context, t *TaskInfo) (err error) {
+// deadLetterMaxLen bounds the dead letter stream of a queue, oldest entries are trimmed.
+var deadLetterMaxLen = 100000
+
+// Active2DeadLetter moves exhausted ts from active list into the dead letter stream of their queue,
+// the task and its queue are recorded in the stream entry. trimmed are entries over deadLetterMaxLen.
+func (b *RedisBroker) Active2DeadLetter(ctx context.Context, ts []*TaskInfo) (trimmed []*DeadLetterTask, err error) {
+	m := map[string][]*TaskInfo{}
+	for _, t := range ts {
+		m[b2s(t.Queue)] = append(m[b2s(t.Queue)], t)
+	}
+	for queue, tasks := range m {
+		keyInfo := b.keyInfo(queue)
+		keys := make([]string, len(tasks)+2)
+		keys[0] = keyInfo.DeadLetterKey()
+		keys[1] = keyInfo.ActiveKey()
+		for i, t := range tasks {
+			keys[i+2] = keyInfo.TaskKey(b2s(t.ID))
+		}
+		args := make([]string, 4, len(tasks)+4)
+		args[0] = queue
+		args[1] = strconv.Itoa(int(Archived | Failed))
+		args[2] = strconv.Itoa(deadLetterMaxLen)
+		args[3] = strconv.Itoa(maxTaskAttempts)
+		for _, t := range tasks {
+			args = append(args, t.attemptArg())
+		}
+		var entries []rueidis.XRangeEntry
+		entries, err = b.scripts.active2DeadLetter.Exec(ctx, b.redisCli, keys, args).AsXRange()
+		if err != nil {
+			return
+		}
+		for _, e := range entries {
+			t, er := b.layout.decodeDeadLetter(e)
+			if er != nil {
+				continue
+			}
+			trimmed = append(trimmed, t)
+		}
+	}
+	return
+}
+
+// DeadLetterTask is an entry of the dead letter stream of a queue.
+type DeadLetterTask struct {
+	// ID of the stream entry
+	ID string
+	// Queue the task is dead lettered from
+	Queue string
+	Task  *TaskInfo
+}
+
+// DeadLetterTasks returns at most count oldest entries of the dead letter stream of queue.
+func (b *RedisBroker) DeadLetterTasks(ctx context.Context, queue string, count int) (ts []*DeadLetterTask, err error) {
+	keyInfo := b.queueKeyInfo(queue)
+	entries, err := b.redisCli.Do(ctx, b.redisCli.B().Xrange().Key(keyInfo.DeadLetterKey()).Start("-").End("+").Count(int64(count)).Build()).AsXRange()
+	if err != nil {
+		return
+	}
+	ts = make([]*DeadLetterTask, 0, len(entries))
+	for _, e := range entries {
+		t, er := b.layout.decodeDeadLetter(e)
+		if er != nil {
+			continue
+		}
+		ts = append(ts, t)
+	}
+	return
+}
+
+// ReplayDeadLetter moves entries ids of the dead letter stream of queue back into its pending list,
+// retried count of the tasks is reset. Unknown ids are ignored.
+func (b *RedisBroker) ReplayDeadLetter(ctx context.Context, queue string, ids []string) (n int, err error) {
+	keyInfo := b.queueKeyInfo(queue)
+	cmds := make(rueidis.Commands, len(ids))
+	for i, id := range ids {
+		cmds[i] = b.redisCli.B().Xrange().Key(keyInfo.DeadLetterKey()).Start(id).End(id).Build()
+	}
+	keys := make([]string, 2, len(ids)+2)
+	keys[0] = keyInfo.DeadLetterKey()
+	keys[1] = keyInfo.PendingKey()
+	args := make([]string, 2, len(ids)+2)
+	args[0] = keyInfo.NotifyChannel()
+	args[1] = strconv.Itoa(int(Pending))
+	for i, resp := range b.redisCli.DoMulti(ctx, cmds...) {
+		entries, er := resp.AsXRange()
+		if er != nil {
+			err = er
+			return
+		}
+		if len(entries) == 0 {
+			continue
+		}
+		t, er := b.layout.decodeDeadLetter(entries[0])
+		if er != nil {
+			continue
+		}
+		keys = append(keys, keyInfo.TaskKey(b2s(t.Task.ID)))
+		args = append(args, ids[i])
+	}
+	if len(keys) == 2 {
+		return
+	}
+	n64, err := b.scripts.replayDeadLetter.Exec(ctx, b.redisCli, keys, args).AsInt64()
+	n = int(n64)
+	return
+}
+
+// DeleteActiveTasks removes ts from active list and deletes them.
+func (b *RedisBroker) DeleteActiveTasks(ctx context.Context, ts []*TaskInfo) (err error) {
+	m := map[string][]*TaskInfo{}
+	for _, t := range ts {
+		m[b2s(t.Queue)] = append(m[b2s(t.Queue)], t)
+	}
+	for queue, tasks := range m {
+		keyInfo := b.keyInfo(queue)
+		keys := make([]string, len(tasks)+1)
+		keys[0] = keyInfo.ActiveKey()
+		for i, t := range tasks {
+			keys[i+1] = keyInfo.TaskKey(b2s(t.ID))
+		}
+		err = deleteActiveLs.Exec(ctx, b.redisCli, keys, nil).Error()
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+func (b *RedisBroker) SetErrorMsg(ctx context.Context, t *TaskInfo) (err error) {
 	keyInfo := b.keyInfo(b2s(t.Queue))
-	err = b.redisCli.Do(ctx, b.redisCli.B().JsonSet().Key(keyInfo.TaskKey(b2s(t.ID))).Path("$.error_msg").Value(`"`+b2s(t.ErrorMsg)+`"`).Build()).Error()
+	if b.layout == LayoutHash {
+		return b.redisCli.Do(ctx, b.redisCli.B().Hset().Key(keyInfo.TaskKey(b2s(t.ID))).FieldValue().FieldValue("error_msg", b2s(t.ErrorMsg)).Build()).Error()
+	}
+	msg, _ := t.ErrorMsg.MarshalJSON()
+	err = b.redisCli.Do(ctx, b.redisCli.B().JsonSet().Key(keyInfo.TaskKey(b2s(t.ID))).Path("$.error_msg").Value(b2s(msg)).Build()).Error()
 	return
 }
 
-func (b *Broker) CleanUpArchive(ctx context.Context, batchLen int) (err error) {
-	// clean zombie keys in archive list(successful and failed)
-	keys := make([]string, len(b.keyInfos)*3)
-	for i := 0; i < len(b.keyInfos); i++ {
-		j := i * 3
-		keys[j] = b.keyInfos[i].ToDeleteKey()
-		keys[j+1] = b.keyInfos[i].SuccessfulKey()
-		keys[j+2] = b.keyInfos[i].FailedKey()
+// CleanUpArchive removes expired tasks from archive lists(successful and failed) of all queues,
+// queues are cleaned one by one because their keys are in different cluster slots.
+// payloadRefs are recorded when tasks were archived, see BlobStore.
+func (b *RedisBroker) CleanUpArchive(ctx context.Context, batchLen int) (payloadRefs []string, err error) {
+	b.mu.RLock()
+	keyInfos := slices.Clone(b.keyInfos)
+	b.mu.RUnlock()
+	for _, keyInfo := range keyInfos {
+		payloadRefs, err = b.cleanUpArchive(ctx, keyInfo, batchLen, payloadRefs)
+		if err != nil {
+			return
+		}
 	}
+	return
+}
+
+func (b *RedisBroker) cleanUpArchive(ctx context.Context, keyInfo *KeyInfo, batchLen int, payloadRefs []string) ([]string, error) {
+	keys := []string{keyInfo.ToDeleteKey(), keyInfo.SuccessfulKey(), keyInfo.FailedKey(), keyInfo.BlobsKey()}
 	var nextStartPos int
 	for {
-		resp := cleanerLs.Exec(ctx, b.redisCli, keys, []string{
+		arr, err := cleanerLs.Exec(ctx, b.redisCli, keys, []string{
 			strconv.Itoa(nextStartPos), strconv.Itoa(nextStartPos + batchLen - 1),
-		})
-		if resp.Error() != nil {
-			return resp.Error()
+		}).ToArray()
+		if err != nil {
+			return payloadRefs, err
 		}
-		v, er := resp.ToInt64()
-		if er != nil {
-			err = er
-			return
+		if len(arr) != 2 {
+			return payloadRefs, fmt.Errorf("acornq: unexpected cleaner reply of %d elements", len(arr))
+		}
+		v, err := arr[0].ToInt64()
+		if err != nil {
+			return payloadRefs, err
 		}
+		refs, err := arr[1].AsStrSlice()
+		if err != nil {
+			return payloadRefs, err
+		}
+		payloadRefs = append(payloadRefs, refs...)
 		if v == 0 {
-			return
+			return payloadRefs, nil
 		}
 		nextStartPos = int(v)
 	}
 }
+
+// WriteServerState replaces server info and its workers in redis, keys expire after ttl.
+func (b *RedisBroker) WriteServerState(ctx context.Context, info *ServerInfo, workers []*WorkerInfo, ttl time.Duration) (err error) {
+	queues, err := json.Marshal(info.Queues)
+	if err != nil {
+		return
+	}
+	infoKey, workersKey := ServerInfoKey(info.ID), WorkersKey(info.ID)
+	expireAt := time.Now().Add(ttl).Unix()
+	cmds := make(rueidis.Commands, 0, 7)
+	cmds = append(cmds,
+		b.redisCli.B().Zadd().Key(serversKey).ScoreMember().ScoreMember(float64(expireAt), info.ID).Build(),
+		b.redisCli.B().Hset().Key(infoKey).FieldValue().
+			FieldValue("host", info.Host).
+			FieldValue("pid", strconv.Itoa(info.PID)).
+			FieldValue("queues", b2s(queues)).
+			FieldValue("concurrency", strconv.Itoa(info.Concurrency)).
+			FieldValue("started_at", strconv.FormatInt(info.StartedAt.Unix(), 10)).
+			FieldValue("status", string(info.Status)).Build(),
+		b.redisCli.B().Expire().Key(infoKey).Seconds(int64(ttl.Seconds())).Build(),
+		b.redisCli.B().Del().Key(workersKey).Build(),
+	)
+	if len(workers) > 0 {
+		hset := b.redisCli.B().Hset().Key(workersKey).FieldValue()
+		for _, w := range workers {
+			b1, err1 := json.Marshal(w)
+			if err1 != nil {
+				err = err1
+				return
+			}
+			hset = hset.FieldValue(w.TaskID, b2s(b1))
+		}
+		cmds = append(cmds, hset.Build(), b.redisCli.B().Expire().Key(workersKey).Seconds(int64(ttl.Seconds())).Build())
+	}
+	for _, resp := range b.redisCli.DoMulti(ctx, cmds...) {
+		if err = resp.Error(); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// ListServers returns servers whose state is not expired.
+func (b *RedisBroker) ListServers(ctx context.Context) (servers []*ServerInfo, err error) {
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	// drop expired servers from index
+	err = b.redisCli.Do(ctx, b.redisCli.B().Zremrangebyscore().Key(serversKey).Min("-inf").Max("("+now).Build()).Error()
+	if err != nil {
+		return
+	}
+	ids, err := b.redisCli.Do(ctx, b.redisCli.B().Zrangebyscore().Key(serversKey).Min(now).Max("+inf").Build()).AsStrSlice()
+	if err != nil || len(ids) == 0 {
+		return
+	}
+	cmds := make(rueidis.Commands, 0, len(ids)*2)
+	for _, id := range ids {
+		cmds = append(cmds,
+			b.redisCli.B().Hgetall().Key(ServerInfoKey(id)).Build(),
+			b.redisCli.B().Hgetall().Key(WorkersKey(id)).Build())
+	}
+	resps := b.redisCli.DoMulti(ctx, cmds...)
+	servers = make([]*ServerInfo, 0, len(ids))
+	for i, id := range ids {
+		m, err1 := resps[i*2].AsStrMap()
+		if err1 != nil {
+			err = err1
+			return
+		}
+		if len(m) == 0 {
+			// expired between two commands
+			continue
+		}
+		info := &ServerInfo{ID: id, Host: m["host"], Status: ServerStatus(m["status"])}
+		info.PID, _ = strconv.Atoi(m["pid"])
+		info.Concurrency, _ = strconv.Atoi(m["concurrency"])
+		startedAt, _ := strconv.ParseInt(m["started_at"], 10, 64)
+		info.StartedAt = time.Unix(startedAt, 0)
+		_ = json.Unmarshal(s2b(m["queues"]), &info.Queues)
+		ws, err1 := resps[i*2+1].AsStrMap()
+		if err1 != nil {
+			err = err1
+			return
+		}
+		for _, v := range ws {
+			w := &WorkerInfo{}
+			if json.Unmarshal(s2b(v), w) == nil {
+				info.ActiveWorkers = append(info.ActiveWorkers, w)
+			}
+		}
+		servers = append(servers, info)
+	}
+	return
+}
+
+// ReleaseLeases releases semaphore leases held by taskKeys.
+func (b *RedisBroker) ReleaseLeases(ctx context.Context, taskKeys []string) (err error) {
+	names, err := b.redisCli.Do(ctx, b.redisCli.B().Smembers().Key(semaphoresKey).Build()).AsStrSlice()
+	if err != nil || len(names) == 0 {
+		return
+	}
+	cmds := make(rueidis.Commands, len(names))
+	for i, name := range names {
+		cmds[i] = b.redisCli.B().Zrem().Key(SemaphoreKey(name)).Member(taskKeys...).Build()
+	}
+	for _, resp := range b.redisCli.DoMulti(ctx, cmds...) {
+		if err = resp.Error(); err != nil {
+			return
+		}
+	}
+	return
+}
@@ -6,13 +6,15 @@ import (
 )
 
 type Cleaner struct {
-	broker     *Broker
+	broker     Broker
 	interval   time.Duration
 	stopCh     chan struct{}
 	errHandler ErrHandler
+	// blobs of removed tasks are deleted from it
+	blobStore BlobStore
 }
 
-func NewCleaner(b *Broker, interval time.Duration, errHandler ErrHandler) *Cleaner {
+func NewCleaner(b Broker, interval time.Duration, errHandler ErrHandler) *Cleaner {
 	return &Cleaner{
 		broker:     b,
 		interval:   interval,
@@ -21,16 +23,31 @@ func NewCleaner(b *Broker, interval time.Duration, errHandler ErrHandler) *Clean
 }
 
 func (c *Cleaner) Start() {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
 	for {
 		select {
 		case <-c.stopCh:
 			return
-		default:
-			err := c.broker.CleanUpArchive(context.Background(), 500)
+		case <-timer.C:
+			payloadRefs, err := c.broker.CleanUpArchive(context.Background(), 500)
 			if err != nil {
 				c.errHandler(err)
 			}
-			time.Sleep(c.interval)
+			c.deleteBlobs(payloadRefs)
+			timer.Reset(c.interval)
+		}
+	}
+}
+
+// deleteBlobs deletes payload blobs of removed tasks.
+func (c *Cleaner) deleteBlobs(payloadRefs []string) {
+	if c.blobStore == nil {
+		return
+	}
+	for _, ref := range payloadRefs {
+		if err := c.blobStore.Delete(context.Background(), ref); err != nil {
+			c.errHandler(err)
 		}
 	}
 }
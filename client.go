@@ -2,27 +2,50 @@ package acornq
 
 import (
 	"context"
+	"encoding/hex"
 	"errors"
 	"github.com/redis/rueidis"
 	"github.com/zeebo/xxh3"
-	"slices"
+	"maps"
 	"strconv"
 	"strings"
-	"sync"
 	"time"
 )
 
 type Client struct {
-	broker *Broker
-	mu     sync.Mutex
+	broker Broker
+	// payloads larger than blobThreshold are offloaded to blobStore
+	blobStore     BlobStore
+	blobThreshold int
+	encryptor     Encryptor
 }
 
 func NewClient(redisCli rueidis.Client) *Client {
+	return NewClientWithBroker(NewRedisBroker(redisCli))
+}
+
+func NewClientWithBroker(b Broker) *Client {
 	return &Client{
-		broker: &Broker{redisCli: redisCli},
+		broker: b,
 	}
 }
 
+// SetBlobStore offloads payloads larger than threshold bytes(after compression) to store,
+// servers must be configured with the same store by Config.BlobStore.
+// It is not safe to call while enqueueing.
+func (c *Client) SetBlobStore(store BlobStore, threshold int) {
+	c.blobStore = store
+	c.blobThreshold = threshold
+}
+
+// SetEncryptor encrypts payloads by e before they are stored, servers must be
+// configured with an Encryptor knowing its keys by Config.Encryptor.
+// Payloads are compressed before encryption, unique keys are hashed from plaintext by e.MAC.
+// It is not safe to call while enqueueing.
+func (c *Client) SetEncryptor(e Encryptor) {
+	c.encryptor = e
+}
+
 const (
 	// Default max Retry count used if nothing is specified.
 	defaultMaxRetry = 25
@@ -63,25 +86,39 @@ func (c *Client) EnqueueContext(ctx context.Context, task Tasker, opts ...Option
 	}
 	var uniqueKey string
 	if o.uniqueTTL > 0 {
-		uniqueKey = createUniqueKey(task.TypeIdentifier(), task.Payload())
+		uniqueKey = createUniqueKey(c.encryptor, task.TypeIdentifier(), task.Payload())
 	}
 	if len(o.taskID) == 0 {
 		u := uuidBytes()
 		o.taskID = b2s(u[:])
 	}
+	payload, compression, err := compressPayload(o.compressor, o.compressThreshold, task.Payload())
+	if err != nil {
+		return
+	}
 	taskInfo := TaskInfo{
-		ID:        StringBytes(o.taskID),
-		Type:      StringBytes(task.TypeIdentifier()),
-		Payload:   StringBytes(task.Payload()),
-		Queue:     StringBytes(o.queue),
-		UniqueKey: StringBytes(uniqueKey),
-		Timeout:   int(o.timeout.Seconds()),
-		StartAt:   o.processAt.Unix(),
-		Retention: int(o.retention.Seconds()),
-		Retry:     o.retry,
+		ID:          StringBytes(o.taskID),
+		Type:        StringBytes(task.TypeIdentifier()),
+		Payload:     payload,
+		Compression: StringBytes(compression),
+		Queue:       StringBytes(o.queue),
+		UniqueKey:   StringBytes(uniqueKey),
+		Timeout:     int(o.timeout.Seconds()),
+		StartAt:     o.processAt.Unix(),
+		Retention:   int(o.retention.Seconds()),
+		Retry:       o.retry,
+	}
+	if h, ok := task.(interface{ Headers() map[string]string }); ok && len(h.Headers())+len(o.headers) > 0 {
+		taskInfo.Headers = make(map[string]string, len(h.Headers())+len(o.headers))
+		maps.Copy(taskInfo.Headers, h.Headers())
+		maps.Copy(taskInfo.Headers, o.headers)
+	} else if len(o.headers) > 0 {
+		taskInfo.Headers = o.headers
 	}
 	if o.deadline == noDeadline {
 		taskInfo.Deadline = 0
+	} else {
+		taskInfo.Deadline = o.deadline.Unix()
 	}
 	if o.processAt.After(now) {
 		taskInfo.State = Scheduled
@@ -90,7 +127,26 @@ func (c *Client) EnqueueContext(ctx context.Context, task Tasker, opts ...Option
 		taskInfo.State = Pending
 	}
 	c.AddQueue(b2s(taskInfo.Queue))
+	if c.encryptor != nil {
+		var keyID string
+		taskInfo.Payload, keyID, err = c.encryptor.Encrypt(taskInfo.Payload, taskInfo.ID)
+		if err != nil {
+			return
+		}
+		taskInfo.EncryptionKey = StringBytes(keyID)
+	}
+	if c.blobStore != nil && len(taskInfo.Payload) > c.blobThreshold {
+		taskInfo.PayloadRef = StringBytes(NewKeyInfo(o.queue).TaskKey(o.taskID))
+		err = c.blobStore.Put(ctx, b2s(taskInfo.PayloadRef), taskInfo.Payload)
+		if err != nil {
+			return
+		}
+		taskInfo.Payload = nil
+	}
 	err = c.enqueueTask(ctx, &taskInfo)
+	if err != nil && len(taskInfo.PayloadRef) > 0 {
+		_ = c.blobStore.Delete(ctx, b2s(taskInfo.PayloadRef))
+	}
 	return
 }
 
@@ -103,6 +159,10 @@ type option struct {
 	uniqueTTL time.Duration
 	processAt time.Time
 	retention time.Duration
+	// compress payloads of at least compressThreshold bytes
+	compressor        Compressor
+	compressThreshold int
+	headers           map[string]string
 }
 
 // ValidateQueueName validates a given qname to be used as a queue name.
@@ -126,7 +186,14 @@ func validUniqueTTL(d time.Duration) (err error) {
 	return
 }
 
-func createUniqueKey(tasktype string, payload []byte) string {
+// createUniqueKey hashes payload by e if it is not nil, a plain hash of an encrypted
+// payload is a dictionary oracle of it.
+func createUniqueKey(e Encryptor, tasktype string, payload []byte) string {
+	if e != nil {
+		data := make([]byte, 0, len(tasktype)+1+len(payload))
+		data = append(append(append(data, tasktype...), 0), payload...)
+		return hex.EncodeToString(e.MAC(data))
+	}
 	h := xxh3.New()
 	_, _ = h.WriteString(tasktype)
 	_, _ = h.Write(payload)
@@ -139,10 +206,5 @@ func (c *Client) enqueueTask(ctx context.Context, task *TaskInfo) (err error) {
 }
 
 func (c *Client) AddQueue(queue string) {
-	c.mu.Lock()
-	idx := slices.IndexFunc(c.broker.keyInfos, func(keyInfo *KeyInfo) bool { return keyInfo.queue == queue })
-	if idx == -1 {
-		c.broker.keyInfos = append(c.broker.keyInfos, NewKeyInfo(queue))
-	}
-	c.mu.Unlock()
+	c.broker.AddQueue(queue)
 }
@@ -0,0 +1,254 @@
+//go:build integration
+
+// Integration tests against a locally started redis cluster, redis-server(7.0+) must be in PATH:
+//
+//	go test -tags integration -run Cluster .
+//
+// Nodes listen on ports from ACORNQ_CLUSTER_PORT(7100 by default). LayoutJSON is only tested
+// when ACORNQ_REDISJSON_MODULE is the path of RedisJSON module loaded into every node.
+package acornq
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/redis/rueidis"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const clusterNodes = 3
+
+// startCluster starts clusterNodes masters covering all slots and returns a cluster client.
+func startCluster(t *testing.T) rueidis.Client {
+	bin, err := exec.LookPath("redis-server")
+	if err != nil {
+		t.Skip("redis-server not found in PATH")
+	}
+	basePort := 7100
+	if v := os.Getenv("ACORNQ_CLUSTER_PORT"); v != "" {
+		basePort, err = strconv.Atoi(v)
+		require.Nil(t, err)
+	}
+	addrs := make([]string, clusterNodes)
+	nodes := make([]rueidis.Client, clusterNodes)
+	for i := range addrs {
+		port := strconv.Itoa(basePort + i)
+		args := []string{"--port", port, "--cluster-enabled", "yes", "--cluster-config-file", "nodes.conf",
+			"--dir", t.TempDir(), "--save", "", "--appendonly", "no"}
+		if module := os.Getenv("ACORNQ_REDISJSON_MODULE"); module != "" {
+			args = append(args, "--loadmodule", module)
+		}
+		cmd := exec.Command(bin, args...)
+		require.Nil(t, cmd.Start())
+		t.Cleanup(func() {
+			_ = cmd.Process.Kill()
+			_ = cmd.Wait()
+		})
+		addrs[i] = "127.0.0.1:" + port
+		assert.Eventually(t, func() bool {
+			nodes[i], err = rueidis.NewClient(rueidis.ClientOption{InitAddress: []string{addrs[i]}, ForceSingleClient: true, DisableCache: true})
+			return err == nil
+		}, 5*time.Second, 50*time.Millisecond)
+		t.Cleanup(nodes[i].Close)
+	}
+	ctx := context.Background()
+	for i, node := range nodes {
+		from, to := i*16384/clusterNodes, (i+1)*16384/clusterNodes-1
+		require.Nil(t, node.Do(ctx, node.B().ClusterAddslotsrange().StartSlotEndSlot().StartSlotEndSlot(int64(from), int64(to)).Build()).Error())
+		if i > 0 {
+			require.Nil(t, nodes[0].Do(ctx, nodes[0].B().ClusterMeet().Ip("127.0.0.1").Port(int64(basePort+i)).Build()).Error())
+		}
+	}
+	require.Eventually(t, func() bool {
+		for _, node := range nodes {
+			info, err := node.Do(ctx, node.B().ClusterInfo().Build()).ToString()
+			if err != nil || !strings.Contains(info, "cluster_state:ok") {
+				return false
+			}
+		}
+		return true
+	}, 20*time.Second, 100*time.Millisecond)
+	cli, err := rueidis.NewClient(rueidis.ClientOption{InitAddress: addrs, DisableCache: true})
+	require.Nil(t, err)
+	t.Cleanup(cli.Close)
+	return cli
+}
+
+// clusterQueues returns queue names whose keys are spread over all nodes.
+func clusterQueues(t *testing.T, cli rueidis.Client) []string {
+	ctx := context.Background()
+	var queues []string
+	covered := map[int64]bool{}
+	for i := 0; len(covered) < clusterNodes && i < 100; i++ {
+		queue := "q" + strconv.Itoa(i)
+		slot, err := cli.Do(ctx, cli.B().ClusterKeyslot().Key(NewKeyInfo(queue).PendingKey()).Build()).AsInt64()
+		require.Nil(t, err)
+		node := slot * clusterNodes / 16384
+		if !covered[node] {
+			covered[node] = true
+			queues = append(queues, queue)
+		}
+	}
+	require.Len(t, queues, clusterNodes)
+	return queues
+}
+
+func clusterLayouts() []StorageLayout {
+	if os.Getenv("ACORNQ_REDISJSON_MODULE") != "" {
+		return []StorageLayout{LayoutHash, LayoutJSON}
+	}
+	return []StorageLayout{LayoutHash}
+}
+
+func TestCluster_Server(t *testing.T) {
+	cli := startCluster(t)
+	queues := clusterQueues(t, cli)
+	for _, layout := range clusterLayouts() {
+		t.Run(layout.String(), func(t *testing.T) {
+			testClusterServer(t, queues, func() Broker { return NewRedisBrokerWithLayout(cli, layout) })
+		})
+	}
+}
+
+func TestCluster_StreamServer(t *testing.T) {
+	cli := startCluster(t)
+	queues := clusterQueues(t, cli)
+	for _, layout := range clusterLayouts() {
+		t.Run(layout.String(), func(t *testing.T) {
+			testClusterServer(t, queues, func() Broker { return NewStreamBroker(cli, layout) })
+		})
+	}
+}
+
+func testClusterServer(t *testing.T, queues []string, newBroker func() Broker) {
+	ctx := context.Background()
+	broker := newBroker()
+	var mu sync.Mutex
+	handled := map[string]int{}
+	queueConfigs := map[string]QueueConfig{}
+	for _, queue := range queues {
+		queueConfigs[queue] = QueueConfig{Priority: 1, DeadLetter: true, MaxInFlight: 2}
+	}
+	store, err := NewFileBlobStore(t.TempDir())
+	require.Nil(t, err)
+	s, err := NewServer(&Config{
+		Handler: TaskHandlerFunc(func(task *TaskInfo) error {
+			mu.Lock()
+			handled[string(task.Queue)]++
+			mu.Unlock()
+			if string(task.Type) == "fail" {
+				return errors.New("fail")
+			}
+			return nil
+		}),
+		Concurrency:      4,
+		QueueConfigs:     queueConfigs,
+		Broker:           broker,
+		BlobStore:        store,
+		TaskPeekInterval: 50 * time.Millisecond,
+		RetryDelayFunc:   func(int, error, *TaskInfo) time.Duration { return 0 },
+		ErrHandler:       func(err error) { t.Error(err) },
+	})
+	require.Nil(t, err)
+	go s.Start()
+	defer func() {
+		ctx, cancel := context.WithTimeout(ctx, 200*time.Millisecond)
+		defer cancel()
+		s.ShutDown(ctx)
+	}()
+
+	client := NewClientWithBroker(newBroker())
+	// payloads of archived tasks are kept in blobs until cleaned up
+	client.SetBlobStore(store, 1)
+	for _, queue := range queues {
+		for i := 0; i < 3; i++ {
+			require.Nil(t, client.EnqueueContext(ctx, NewTask("ok", []byte("payload")), Queue(queue), Retention(time.Second)))
+		}
+		require.Nil(t, client.EnqueueContext(ctx, NewTask("fail", nil), Queue(queue), MaxRetry(1)))
+	}
+	// 3 successful tasks and a failed task handled twice in every queue
+	assert.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		for _, queue := range queues {
+			if handled[queue] != 5 {
+				return false
+			}
+		}
+		return true
+	}, 20*time.Second, 50*time.Millisecond)
+
+	m, err := broker.Backlog(ctx, queues)
+	require.Nil(t, err)
+	for _, queue := range queues {
+		assert.Zero(t, m[queue], queue)
+	}
+	_, err = broker.RecoveryTasks(queues, time.Minute)
+	assert.Nil(t, err)
+	time.Sleep(1100 * time.Millisecond)
+	payloadRefs, err := broker.CleanUpArchive(ctx, 100)
+	assert.Nil(t, err)
+	assert.Len(t, payloadRefs, 3*len(queues))
+
+	inspector := NewInspectorWithBroker(broker)
+	servers, err := inspector.Servers(ctx)
+	require.Nil(t, err)
+	assert.NotEmpty(t, servers)
+	for _, queue := range queues {
+		dead, err := inspector.DeadLetterTasks(ctx, queue, 10)
+		require.Nil(t, err)
+		require.Len(t, dead, 1, queue)
+		assert.Equal(t, "fail", string(dead[0].Task.Type))
+		assert.Len(t, dead[0].Task.Attempts, 2)
+		n, err := inspector.ReplayDeadLetter(ctx, queue, dead[0].ID)
+		require.Nil(t, err)
+		assert.Equal(t, 1, n)
+	}
+	assert.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		for _, queue := range queues {
+			if handled[queue] != 7 {
+				return false
+			}
+		}
+		return true
+	}, 20*time.Second, 50*time.Millisecond)
+}
+
+func TestCluster_MigrateLayout(t *testing.T) {
+	if os.Getenv("ACORNQ_REDISJSON_MODULE") == "" {
+		t.Skip("ACORNQ_REDISJSON_MODULE is not set")
+	}
+	cli := startCluster(t)
+	queues := clusterQueues(t, cli)
+	ctx := context.Background()
+	client := NewClientWithBroker(NewRedisBrokerWithLayout(cli, LayoutJSON))
+	for _, queue := range queues {
+		for i := 0; i < 5; i++ {
+			require.Nil(t, client.EnqueueContext(ctx, NewTask("task", []byte(fmt.Sprint(i))), Queue(queue)))
+		}
+	}
+	n, err := MigrateLayout(ctx, cli, queues, LayoutJSON, LayoutHash)
+	require.Nil(t, err)
+	assert.Equal(t, 5*len(queues), n)
+	n, err = MigrateLayout(ctx, cli, queues, LayoutJSON, LayoutHash)
+	require.Nil(t, err)
+	assert.Zero(t, n)
+
+	broker := NewRedisBrokerWithLayout(cli, LayoutHash)
+	for _, queue := range queues {
+		broker.AddQueue(queue)
+	}
+	ts, err := broker.PickTasks(ctx, queues, 5*len(queues), nil)
+	require.Nil(t, err)
+	assert.Len(t, ts, 5*len(queues))
+}
@@ -0,0 +1,54 @@
+// Command acornq-migrate converts tasks of queues between storage layouts of RedisBroker.
+//
+//	acornq-migrate -addr localhost:6379 -queues default,critical -from json -to hash
+//
+// Stop all servers and clients of the queues before migrating.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"github.com/newacorn/acornq"
+	"github.com/redis/rueidis"
+	"log"
+	"strings"
+)
+
+func parseLayout(s string) (acornq.StorageLayout, error) {
+	switch s {
+	case "json":
+		return acornq.LayoutJSON, nil
+	case "hash":
+		return acornq.LayoutHash, nil
+	}
+	return 0, fmt.Errorf("%w: %q", acornq.ErrUnknownLayout, s)
+}
+
+func main() {
+	addr := flag.String("addr", "localhost:6379", "redis address")
+	password := flag.String("password", "", "redis password")
+	queues := flag.String("queues", "default", "comma separated queue names")
+	from := flag.String("from", "json", "source layout, json or hash")
+	to := flag.String("to", "hash", "target layout, json or hash")
+	flag.Parse()
+
+	fromLayout, err := parseLayout(*from)
+	if err != nil {
+		log.Fatal(err)
+	}
+	toLayout, err := parseLayout(*to)
+	if err != nil {
+		log.Fatal(err)
+	}
+	cli, err := rueidis.NewClient(rueidis.ClientOption{InitAddress: []string{*addr}, Password: *password, DisableCache: true})
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer cli.Close()
+	n, err := acornq.MigrateLayout(context.Background(), cli, strings.Split(*queues, ","), fromLayout, toLayout)
+	if err != nil {
+		log.Fatalf("migrated %d tasks: %v", n, err)
+	}
+	log.Printf("migrated %d tasks from %s to %s", n, fromLayout, toLayout)
+}
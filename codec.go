@@ -0,0 +1,68 @@
+package acornq
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+)
+
+// Codec encodes typed values into task payloads and decodes them back,
+// see NewTypedTask and HandleTyped.
+type Codec interface {
+	Marshal(v any) ([]byte, error)
+	Unmarshal(data []byte, v any) error
+}
+
+// Codecs for msgpack and protobuf are the modules
+// github.com/newacorn/acornq/codec/msgpack and github.com/newacorn/acornq/codec/proto.
+var (
+	JSONCodec Codec = jsonCodec{}
+	// DefaultCodec is used by NewTypedTask and HandleTyped,
+	// producers and handlers of a task type must use the same codec.
+	DefaultCodec = JSONCodec
+)
+
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(v any) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(data []byte, v any) error {
+	return json.Unmarshal(data, v)
+}
+
+// NewTypedTask returns a task whose payload is v encoded by DefaultCodec.
+func NewTypedTask[T any](typeName string, v T, opts ...Optioner) (Task, error) {
+	return NewTypedTaskWith(DefaultCodec, typeName, v, opts...)
+}
+
+// NewTypedTaskWith returns a task whose payload is v encoded by codec.
+func NewTypedTaskWith[T any](codec Codec, typeName string, v T, opts ...Optioner) (task Task, err error) {
+	payload, err := codec.Marshal(v)
+	if err != nil {
+		return
+	}
+	return NewTask(typeName, payload, opts...), nil
+}
+
+// HandleTyped registers fn for pattern on mux, payloads are decoded by DefaultCodec before fn is called.
+// mux is served by Server through ToTaskHandler.
+func HandleTyped[T any](mux *ServeMux, pattern string, fn func(ctx context.Context, v T) error) {
+	HandleTypedWith(mux, DefaultCodec, pattern, fn)
+}
+
+// HandleTypedWith registers fn for pattern on mux, payloads are decoded by codec before fn is called.
+// A payload failed to decode is archived without retry.
+func HandleTypedWith[T any](mux *ServeMux, codec Codec, pattern string, fn func(ctx context.Context, v T) error) {
+	if fn == nil {
+		panic("asynq: nil handler")
+	}
+	mux.Handle(pattern, HandlerFunc(func(ctx context.Context, task *TaskInfo) error {
+		var v T
+		if err := codec.Unmarshal(task.Payload, &v); err != nil {
+			return fmt.Errorf("decode payload of task %q: %w: %w", b2s(task.Type), err, SkipRetry)
+		}
+		return fn(ctx, v)
+	}))
+}
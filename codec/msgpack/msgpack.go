@@ -0,0 +1,25 @@
+// Package msgpack provides an acornq.Codec encoding values by MessagePack,
+// it is a module of its own so acornq does not depend on msgpack.
+//
+// It requires a published version of acornq, develop it against a local checkout by a workspace in the acornq root:
+//
+//	go work init . ./codec/msgpack ./codec/proto
+package msgpack
+
+import (
+	"github.com/newacorn/acornq"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// Codec encodes values by github.com/vmihailenco/msgpack/v5, struct fields are named by msgpack tags.
+var Codec acornq.Codec = codec{}
+
+type codec struct{}
+
+func (codec) Marshal(v any) ([]byte, error) {
+	return msgpack.Marshal(v)
+}
+
+func (codec) Unmarshal(data []byte, v any) error {
+	return msgpack.Unmarshal(data, v)
+}
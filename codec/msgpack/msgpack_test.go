@@ -0,0 +1,27 @@
+package msgpack
+
+import (
+	"context"
+	"github.com/newacorn/acornq"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+type payload struct {
+	Name  string `msgpack:"name"`
+	Count int    `msgpack:"count"`
+}
+
+func TestCodec(t *testing.T) {
+	ctx := context.Background()
+	mux := acornq.NewServeMux()
+	var got []payload
+	acornq.HandleTypedWith(mux, Codec, "msgpack", func(_ context.Context, v *payload) error {
+		got = append(got, *v)
+		return nil
+	})
+	task, err := acornq.NewTypedTaskWith(Codec, "msgpack", &payload{Name: "b", Count: 2})
+	assert.Nil(t, err)
+	assert.Nil(t, mux.ProcessTask(ctx, &acornq.TaskInfo{Type: acornq.StringBytes(task.TypeIdentifier()), Payload: task.Payload()}))
+	assert.Equal(t, []payload{{"b", 2}}, got)
+}
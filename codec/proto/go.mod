@@ -0,0 +1,26 @@
+module github.com/newacorn/acornq/codec/proto
+
+go 1.23.0
+
+require (
+	github.com/newacorn/acornq v0.0.0-20261019005046-f8b1f256bebd
+	github.com/stretchr/testify v1.9.0
+	google.golang.org/protobuf v1.36.9
+)
+
+require (
+	github.com/davecgh/go-spew v1.1.1 // indirect
+	github.com/golang/snappy v1.0.0 // indirect
+	github.com/google/uuid v1.6.0 // indirect
+	github.com/klauspost/compress v1.18.0 // indirect
+	github.com/klauspost/cpuid/v2 v2.0.9 // indirect
+	github.com/mattn/go-runewidth v0.0.9 // indirect
+	github.com/newacorn/goutils v0.0.0-20241013115147-7dd3b56752bb // indirect
+	github.com/newacorn/simple-bytes-pool v0.0.0-20241013115238-875dc0294a71 // indirect
+	github.com/olekukonko/tablewriter v0.0.5 // indirect
+	github.com/pmezard/go-difflib v1.0.0 // indirect
+	github.com/redis/rueidis v1.0.47 // indirect
+	github.com/zeebo/xxh3 v1.0.2 // indirect
+	golang.org/x/sys v0.26.0 // indirect
+	gopkg.in/yaml.v3 v3.0.1 // indirect
+)
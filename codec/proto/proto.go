@@ -0,0 +1,49 @@
+// Package proto provides an acornq.Codec encoding protocol buffer messages,
+// it is a module of its own so acornq does not depend on protobuf.
+//
+// It requires a published version of acornq, develop it against a local checkout by a workspace in the acornq root:
+//
+//	go work init . ./codec/msgpack ./codec/proto
+package proto
+
+import (
+	"errors"
+	"github.com/newacorn/acornq"
+	"google.golang.org/protobuf/proto"
+	"reflect"
+)
+
+// Codec encodes values implementing proto.Message, such as *pb.Request.
+var Codec acornq.Codec = codec{}
+
+var ErrNotProtoMessage = errors.New("value is not a proto.Message")
+
+type codec struct{}
+
+func (codec) Marshal(v any) ([]byte, error) {
+	m, ok := v.(proto.Message)
+	if !ok {
+		return nil, ErrNotProtoMessage
+	}
+	return proto.Marshal(m)
+}
+
+// Unmarshal accepts a proto.Message or a pointer to a nil message pointer,
+// the latter is what acornq.HandleTypedWith passes for T such as *pb.Request.
+func (codec) Unmarshal(data []byte, v any) error {
+	if m, ok := v.(proto.Message); ok {
+		return proto.Unmarshal(data, m)
+	}
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Pointer || rv.Elem().Kind() != reflect.Pointer {
+		return ErrNotProtoMessage
+	}
+	if rv.Elem().IsNil() {
+		rv.Elem().Set(reflect.New(rv.Elem().Type().Elem()))
+	}
+	m, ok := rv.Elem().Interface().(proto.Message)
+	if !ok {
+		return ErrNotProtoMessage
+	}
+	return proto.Unmarshal(data, m)
+}
@@ -0,0 +1,28 @@
+package proto
+
+import (
+	"context"
+	"github.com/newacorn/acornq"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+	"testing"
+)
+
+func TestCodec(t *testing.T) {
+	ctx := context.Background()
+	mux := acornq.NewServeMux()
+	var value string
+	acornq.HandleTypedWith(mux, Codec, "proto", func(_ context.Context, v *wrapperspb.StringValue) error {
+		value = v.GetValue()
+		return nil
+	})
+	task, err := acornq.NewTypedTaskWith(Codec, "proto", wrapperspb.String("c"))
+	assert.Nil(t, err)
+	assert.Nil(t, mux.ProcessTask(ctx, &acornq.TaskInfo{Type: acornq.StringBytes(task.TypeIdentifier()), Payload: task.Payload()}))
+	assert.Equal(t, "c", value)
+
+	_, err = acornq.NewTypedTaskWith(Codec, "proto", "c")
+	assert.ErrorIs(t, err, ErrNotProtoMessage)
+	err = mux.ProcessTask(ctx, &acornq.TaskInfo{Type: acornq.StringBytes("proto"), Payload: acornq.StringBytes{0xff}})
+	assert.True(t, acornq.IsSkipRetry(err))
+}
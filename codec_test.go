@@ -0,0 +1,67 @@
+package acornq
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+type codecPayload struct {
+	Name  string `json:"name"`
+	Count int    `json:"count"`
+}
+
+func TestHandleTyped(t *testing.T) {
+	ctx := context.Background()
+	mux := NewServeMux()
+	var got []codecPayload
+	HandleTyped(mux, "json", func(_ context.Context, v codecPayload) error {
+		got = append(got, v)
+		return nil
+	})
+	task, err := NewTypedTask("json", codecPayload{Name: "a", Count: 1})
+	assert.Nil(t, err)
+	assert.Nil(t, mux.ProcessTask(ctx, &TaskInfo{Type: StringBytes(task.TypeIdentifier()), Payload: task.Payload()}))
+	assert.Equal(t, []codecPayload{{"a", 1}}, got)
+
+	err = mux.ProcessTask(ctx, &TaskInfo{Type: StringBytes("json"), Payload: StringBytes("{")})
+	assert.True(t, IsSkipRetry(err))
+}
+
+func TestHandleTyped_Server(t *testing.T) {
+	ctx := context.Background()
+	broker := NewMemoryBroker()
+	mux := NewServeMux()
+	got := make(chan codecPayload, 1)
+	HandleTyped(mux, "json", func(ctx context.Context, v codecPayload) error {
+		// ctx is the context of the task
+		_, ok := ctx.Deadline()
+		assert.True(t, ok)
+		got <- v
+		return nil
+	})
+	s, err := NewServer(&Config{
+		Handler:          ToTaskHandler(mux),
+		Broker:           broker,
+		TaskPeekInterval: 10 * time.Millisecond,
+		ErrHandler:       func(err error) { t.Error(err) },
+	})
+	require.Nil(t, err)
+	go s.Start()
+	defer func() {
+		ctx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+		defer cancel()
+		s.ShutDown(ctx)
+	}()
+	task, err := NewTypedTask("json", codecPayload{Name: "a", Count: 1})
+	require.Nil(t, err)
+	require.Nil(t, NewClientWithBroker(broker).EnqueueContext(ctx, task))
+	select {
+	case v := <-got:
+		assert.Equal(t, codecPayload{"a", 1}, v)
+	case <-time.After(5 * time.Second):
+		t.Fatal("task not handled")
+	}
+}
@@ -0,0 +1,153 @@
+package acornq
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+	"io"
+	"sync"
+)
+
+// Compressor compresses task payloads, see Compress option.
+type Compressor interface {
+	// Name is stored in TaskInfo.Compression to find the compressor decompressing the payload.
+	Name() string
+	Compress(src []byte) ([]byte, error)
+	Decompress(src []byte) ([]byte, error)
+}
+
+var (
+	GzipCompressor   Compressor = gzipCompressor{}
+	ZstdCompressor   Compressor = &zstdCompressor{}
+	SnappyCompressor Compressor = snappyCompressor{}
+)
+
+var (
+	compressorsMu sync.RWMutex
+	compressors   = map[string]Compressor{
+		GzipCompressor.Name():   GzipCompressor,
+		ZstdCompressor.Name():   ZstdCompressor,
+		SnappyCompressor.Name(): SnappyCompressor,
+	}
+)
+
+// RegisterCompressor makes c available to workers decompressing payloads compressed by c,
+// built-in compressors are registered already.
+func RegisterCompressor(c Compressor) {
+	compressorsMu.Lock()
+	compressors[c.Name()] = c
+	compressorsMu.Unlock()
+}
+
+func compressorByName(name string) (c Compressor, ok bool) {
+	compressorsMu.RLock()
+	c, ok = compressors[name]
+	compressorsMu.RUnlock()
+	return
+}
+
+type gzipCompressor struct{}
+
+func (gzipCompressor) Name() string { return "gzip" }
+
+func (gzipCompressor) Compress(src []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(src); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gzipCompressor) Decompress(src []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(src))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+// zstdCompressor shares an encoder and a decoder, both are safe for concurrent EncodeAll and DecodeAll.
+type zstdCompressor struct {
+	once    sync.Once
+	encoder *zstd.Encoder
+	decoder *zstd.Decoder
+	err     error
+}
+
+func (*zstdCompressor) Name() string { return "zstd" }
+
+func (c *zstdCompressor) init() error {
+	c.once.Do(func() {
+		c.encoder, c.err = zstd.NewWriter(nil)
+		if c.err != nil {
+			return
+		}
+		c.decoder, c.err = zstd.NewReader(nil)
+	})
+	return c.err
+}
+
+func (c *zstdCompressor) Compress(src []byte) ([]byte, error) {
+	if err := c.init(); err != nil {
+		return nil, err
+	}
+	return c.encoder.EncodeAll(src, nil), nil
+}
+
+func (c *zstdCompressor) Decompress(src []byte) ([]byte, error) {
+	if err := c.init(); err != nil {
+		return nil, err
+	}
+	return c.decoder.DecodeAll(src, nil)
+}
+
+type snappyCompressor struct{}
+
+func (snappyCompressor) Name() string { return "snappy" }
+
+func (snappyCompressor) Compress(src []byte) ([]byte, error) {
+	return snappy.Encode(nil, src), nil
+}
+
+func (snappyCompressor) Decompress(src []byte) ([]byte, error) {
+	return snappy.Decode(nil, src)
+}
+
+// compressPayload compresses payload by c if it is at least threshold bytes,
+// name is empty if payload is kept as is.
+func compressPayload(c Compressor, threshold int, payload []byte) (out []byte, name string, err error) {
+	if c == nil || len(payload) < threshold {
+		return payload, "", nil
+	}
+	out, err = c.Compress(payload)
+	if err != nil {
+		return
+	}
+	return out, c.Name(), nil
+}
+
+// decompressPayload replaces compressed payload of t by its plain bytes before handling,
+// the stored task keeps the compressed payload.
+func decompressPayload(t *TaskInfo) (err error) {
+	if len(t.Compression) == 0 {
+		return
+	}
+	c, ok := compressorByName(b2s(t.Compression))
+	if !ok {
+		return fmt.Errorf("unknown compression %q: %w", b2s(t.Compression), SkipRetry)
+	}
+	payload, err := c.Decompress(t.Payload)
+	if err != nil {
+		return fmt.Errorf("decompress payload: %w: %w", err, SkipRetry)
+	}
+	t.Payload = payload
+	t.Compression = nil
+	return
+}
@@ -0,0 +1,36 @@
+package acornq
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+)
+
+func TestCompress(t *testing.T) {
+	ctx := context.Background()
+	payload := []byte(strings.Repeat(`{"name":"acornq"}`, 100))
+	for _, c := range []Compressor{GzipCompressor, ZstdCompressor, SnappyCompressor} {
+		broker := NewMemoryBroker()
+		cli := NewClientWithBroker(broker)
+		assert.Nil(t, cli.EnqueueContext(ctx, NewTask("task", payload), Compress(c, 1024)))
+		assert.Nil(t, cli.EnqueueContext(ctx, NewTask("task", []byte("small")), Compress(c, 1024)))
+		ts, err := broker.PickTasks(ctx, []string{defaultQueueName}, 2, nil)
+		assert.Nil(t, err)
+		assert.Len(t, ts, 2)
+		assert.Equal(t, c.Name(), string(ts[0].Compression))
+		assert.Less(t, len(ts[0].Payload), len(payload))
+		assert.Empty(t, ts[1].Compression)
+		for _, task := range ts {
+			assert.Nil(t, decompressPayload(task))
+		}
+		assert.Equal(t, string(payload), string(ts[0].Payload))
+		assert.Equal(t, "small", string(ts[1].Payload))
+	}
+	err := decompressPayload(&TaskInfo{Compression: StringBytes("lz4"), Payload: StringBytes("x")})
+	assert.True(t, IsSkipRetry(err))
+
+	opt := Compress(nil, 1024)
+	assert.Equal(t, "Compress(<nil>, 1024)", opt.String())
+	assert.NotNil(t, NewClientWithBroker(NewMemoryBroker()).EnqueueContext(ctx, NewTask("task", payload), opt))
+}
@@ -0,0 +1,112 @@
+package acornq
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+)
+
+// Encryptor encrypts task payloads at rest, see Client.SetEncryptor and Config.Encryptor.
+// additionalData binds a ciphertext to its task, it is the task ID.
+type Encryptor interface {
+	// Encrypt returns ciphertext and id of the key encrypted it, the id is stored in TaskInfo.EncryptionKey.
+	Encrypt(plaintext, additionalData []byte) (ciphertext []byte, keyID string, err error)
+	// Decrypt returns ErrUnknownKeyID if keyID is not known.
+	Decrypt(ciphertext, additionalData []byte, keyID string) ([]byte, error)
+	// MAC returns a keyed hash of data, unique keys of encrypted tasks are hashed by it
+	// so they do not reveal payloads.
+	MAC(data []byte) []byte
+}
+
+var (
+	ErrUnknownKeyID       = errors.New("unknown encryption key id")
+	ErrCiphertextTooShort = errors.New("ciphertext too short")
+)
+
+// AESGCMEncryptor encrypts by AES-GCM with a random nonce prepended to ciphertext.
+// Keys are rotated by adding a new key as current while keeping old ones for decryption
+// until tasks encrypted by them are gone.
+//
+// MAC is HMAC-SHA256 by a key derived from the current key, so unique keys change
+// when the current key is rotated.
+type AESGCMEncryptor struct {
+	current string
+	aeads   map[string]cipher.AEAD
+	macKey  []byte
+}
+
+// NewAESGCMEncryptor returns an AESGCMEncryptor encrypts by keys[currentKeyID],
+// keys are 16, 24 or 32 bytes for AES-128, AES-192 or AES-256.
+func NewAESGCMEncryptor(currentKeyID string, keys map[string][]byte) (e *AESGCMEncryptor, err error) {
+	if _, ok := keys[currentKeyID]; !ok {
+		return nil, fmt.Errorf("current key %q: %w", currentKeyID, ErrUnknownKeyID)
+	}
+	e = &AESGCMEncryptor{current: currentKeyID, aeads: make(map[string]cipher.AEAD, len(keys))}
+	for id, key := range keys {
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, fmt.Errorf("key %q: %w", id, err)
+		}
+		e.aeads[id], err = cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+	}
+	mac := hmac.New(sha256.New, keys[currentKeyID])
+	mac.Write([]byte("acornq unique key"))
+	e.macKey = mac.Sum(nil)
+	return
+}
+
+func (e *AESGCMEncryptor) Encrypt(plaintext, additionalData []byte) (ciphertext []byte, keyID string, err error) {
+	aead := e.aeads[e.current]
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	if _, err = rand.Read(nonce); err != nil {
+		return
+	}
+	return aead.Seal(nonce, nonce, plaintext, additionalData), e.current, nil
+}
+
+func (e *AESGCMEncryptor) Decrypt(ciphertext, additionalData []byte, keyID string) ([]byte, error) {
+	aead, ok := e.aeads[keyID]
+	if !ok {
+		return nil, fmt.Errorf("%w %q", ErrUnknownKeyID, keyID)
+	}
+	if len(ciphertext) < aead.NonceSize() {
+		return nil, ErrCiphertextTooShort
+	}
+	nonce, ciphertext := ciphertext[:aead.NonceSize()], ciphertext[aead.NonceSize():]
+	return aead.Open(nil, nonce, ciphertext, additionalData)
+}
+
+func (e *AESGCMEncryptor) MAC(data []byte) []byte {
+	mac := hmac.New(sha256.New, e.macKey)
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+// decryptPayload replaces encrypted payload of t by its plaintext before handling.
+// A payload failed authentication is archived without retry, while an unknown key is retried
+// as it may be deployed to the server later.
+func decryptPayload(e Encryptor, t *TaskInfo) (err error) {
+	if len(t.EncryptionKey) == 0 {
+		return
+	}
+	if e == nil {
+		return fmt.Errorf("payload of task %q is encrypted but server has no encryptor: %w", b2s(t.ID), SkipRetry)
+	}
+	payload, err := e.Decrypt(t.Payload, t.ID, b2s(t.EncryptionKey))
+	if err != nil {
+		if errors.Is(err, ErrUnknownKeyID) {
+			return
+		}
+		return fmt.Errorf("decrypt payload: %w: %w", err, SkipRetry)
+	}
+	t.Payload = payload
+	t.EncryptionKey = nil
+	return
+}
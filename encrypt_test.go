@@ -0,0 +1,108 @@
+package acornq
+
+import (
+	"bytes"
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestAESGCMEncryptor(t *testing.T) {
+	ctx := context.Background()
+	old, err := NewAESGCMEncryptor("k1", map[string][]byte{"k1": bytes.Repeat([]byte{1}, 32)})
+	require.Nil(t, err)
+	broker := NewMemoryBroker()
+	cli := NewClientWithBroker(broker)
+	cli.SetEncryptor(old)
+	require.Nil(t, cli.EnqueueContext(ctx, NewTask("task", []byte("secret")), TaskID("1")))
+
+	// rotated, tasks encrypted by k1 are still decrypted
+	e, err := NewAESGCMEncryptor("k2", map[string][]byte{"k1": bytes.Repeat([]byte{1}, 32), "k2": bytes.Repeat([]byte{2}, 16)})
+	require.Nil(t, err)
+	cli.SetEncryptor(e)
+	require.Nil(t, cli.EnqueueContext(ctx, NewTask("task", []byte("secret")), TaskID("2"), Compress(GzipCompressor, 0)))
+
+	ts, err := broker.PickTasks(ctx, []string{defaultQueueName}, 2, nil)
+	require.Nil(t, err)
+	require.Len(t, ts, 2)
+	for i, keyID := range []string{"k1", "k2"} {
+		task := ts[i]
+		assert.Equal(t, keyID, string(task.EncryptionKey))
+		assert.NotContains(t, string(task.Payload), "secret")
+		assert.Nil(t, decryptPayload(e, task))
+		assert.Nil(t, decompressPayload(task))
+		assert.Equal(t, "secret", string(task.Payload))
+	}
+
+	ciphertext, keyID, err := e.Encrypt([]byte("secret"), []byte("1"))
+	require.Nil(t, err)
+	// ciphertext of another task
+	err = decryptPayload(e, &TaskInfo{ID: StringBytes("2"), Payload: ciphertext, EncryptionKey: StringBytes(keyID)})
+	assert.True(t, IsSkipRetry(err))
+	// key not deployed yet is retried
+	err = decryptPayload(old, &TaskInfo{ID: StringBytes("1"), Payload: ciphertext, EncryptionKey: StringBytes(keyID)})
+	assert.ErrorIs(t, err, ErrUnknownKeyID)
+	assert.False(t, IsSkipRetry(err))
+}
+
+func TestClient_UniqueKeyEncrypted(t *testing.T) {
+	ctx := context.Background()
+	e, err := NewAESGCMEncryptor("k1", map[string][]byte{"k1": bytes.Repeat([]byte{1}, 32)})
+	require.Nil(t, err)
+	broker := NewMemoryBroker()
+	cli := NewClientWithBroker(broker)
+	cli.SetEncryptor(e)
+	require.Nil(t, cli.EnqueueContext(ctx, NewTask("task", []byte("alice@example.com")), Unique(time.Minute)))
+	ts, err := broker.PickTasks(ctx, []string{defaultQueueName}, 1, nil)
+	require.Nil(t, err)
+	require.Len(t, ts, 1)
+	// not the plain hash, which is computed by anyone knowing candidate payloads
+	assert.NotEqual(t, createUniqueKey(nil, "task", []byte("alice@example.com")), string(ts[0].UniqueKey))
+	assert.Equal(t, createUniqueKey(e, "task", []byte("alice@example.com")), string(ts[0].UniqueKey))
+	other, err := NewAESGCMEncryptor("k2", map[string][]byte{"k2": bytes.Repeat([]byte{2}, 32)})
+	require.Nil(t, err)
+	assert.NotEqual(t, createUniqueKey(other, "task", []byte("alice@example.com")), string(ts[0].UniqueKey))
+	assert.NotEqual(t, createUniqueKey(e, "task", []byte("bob@example.com")), string(ts[0].UniqueKey))
+}
+
+func TestServer_Encrypted(t *testing.T) {
+	ctx := context.Background()
+	e, err := NewAESGCMEncryptor("k1", map[string][]byte{"k1": bytes.Repeat([]byte{1}, 32)})
+	require.Nil(t, err)
+	broker := NewMemoryBroker()
+	got := make(chan string, 1)
+	s, err := NewServer(&Config{
+		Handler: TaskHandlerFunc(func(task *TaskInfo) error {
+			got <- string(task.Payload)
+			return nil
+		}),
+		Broker:           broker,
+		Encryptor:        e,
+		TaskPeekInterval: 10 * time.Millisecond,
+		ErrHandler:       func(err error) { t.Error(err) },
+	})
+	require.Nil(t, err)
+	cli := NewClientWithBroker(broker)
+	cli.SetEncryptor(e)
+	require.Nil(t, cli.EnqueueContext(ctx, NewTask("task", []byte("secret")), TaskID("1"), Compress(GzipCompressor, 0)))
+	// stored encrypted
+	broker.mu.Lock()
+	stored := string(broker.queue(defaultQueueName).tasks["1"].Payload)
+	broker.mu.Unlock()
+	assert.NotContains(t, stored, "secret")
+
+	go s.Start()
+	defer func() {
+		ctx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+		defer cancel()
+		s.ShutDown(ctx)
+	}()
+	select {
+	case payload := <-got:
+		assert.Equal(t, "secret", payload)
+	case <-time.After(5 * time.Second):
+		t.Fatal("task not handled")
+	}
+}
@@ -0,0 +1,189 @@
+package acornq
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+)
+
+// fetcher picks tasks for all workers of a server, the count of one pick is sized to
+// idle workers of pool plus prefetch, so one round-trip feeds many workers.
+// Queues reach their concurrency cap in pool are skipped, others are picked at most
+// up to their cap.
+//
+// Picked tasks are already in active list, they wait in taskCh until a worker takes them,
+// tasks left in taskCh are moved back to pending list when server stops.
+// taskCh is rebuilt when pool is resized, see resize.
+type fetcher struct {
+	broker     Broker
+	selector   QueueSelector
+	queues     []string
+	errHandler ErrHandler
+	stopCh     chan struct{}
+	// woken by notifier when tasks enter pending list
+	wakeCh       chan struct{}
+	pollInterval time.Duration
+	// tasks buffered beyond idle workers
+	prefetch int
+	// picked tasks, capacity is pool size + prefetch
+	taskCh atomic.Pointer[chan *TaskInfo]
+	pool   *WorkerPool
+}
+
+func newFetcher(stopCh chan struct{}, wakeCh chan struct{}, broker Broker, pool *WorkerPool, selector QueueSelector, queues []string,
+	concurrency, prefetch int, pollInterval time.Duration, errHandler ErrHandler) *fetcher {
+	f := &fetcher{
+		broker:       broker,
+		selector:     selector,
+		queues:       queues,
+		errHandler:   errHandler,
+		stopCh:       stopCh,
+		wakeCh:       wakeCh,
+		pollInterval: pollInterval,
+		prefetch:     prefetch,
+		pool:         pool,
+	}
+	taskCh := make(chan *TaskInfo, concurrency+prefetch)
+	f.taskCh.Store(&taskCh)
+	return f
+}
+
+// tasks returns current taskCh, workers receive from it again once it is closed by resize.
+func (f *fetcher) tasks() chan *TaskInfo {
+	return *f.taskCh.Load()
+}
+
+// resize rebuilds taskCh when its capacity differs from pool size + prefetch,
+// buffered tasks are moved into the new one and the old one is closed.
+// It shrinks taskCh only when buffered tasks fit, it is called by fetcher only, the only sender.
+func (f *fetcher) resize() {
+	n := f.pool.Size()
+	if n == 0 {
+		// pool not started
+		return
+	}
+	old := f.tasks()
+	size := n + f.prefetch
+	if cap(old) == size || len(old) > size {
+		return
+	}
+	taskCh := make(chan *TaskInfo, size)
+	f.taskCh.Store(&taskCh)
+	close(old)
+	for t := range old {
+		taskCh <- t
+	}
+}
+
+func (f *fetcher) Start() {
+	for {
+		select {
+		case <-f.stopCh:
+			f.drain()
+			return
+		default:
+		}
+		f.resize()
+		taskCh := f.tasks()
+		n := min(f.pool.Idle()+f.prefetch, cap(taskCh)) - len(taskCh)
+		if n <= 0 {
+			f.waitIdle()
+			continue
+		}
+		queues := f.queueNames()
+		if len(queues) == 0 {
+			f.wait()
+			continue
+		}
+		limits, saturated := f.limits(queues)
+		if saturated {
+			// all queues reach their cap, a worker done its task becomes idle.
+			f.waitIdle()
+			continue
+		}
+		ts, err := f.broker.PickTasks(context.Background(), queues, n, limits)
+		if err != nil {
+			f.errHandler(err)
+		}
+		for _, t := range ts {
+			f.pool.taskPicked(t)
+			taskCh <- t
+		}
+		if len(ts) == 0 || err != nil {
+			f.wait()
+		}
+	}
+}
+
+// limits returns max count can be picked of limited queues,
+// saturated reports whether all queues reach their cap.
+func (f *fetcher) limits(queues []string) (limits map[string]int, saturated bool) {
+	saturated = true
+	for _, queue := range queues {
+		n := f.pool.queueAvailable(queue)
+		if n != 0 {
+			saturated = false
+		}
+		if n < 0 {
+			continue
+		}
+		if limits == nil {
+			limits = make(map[string]int, len(queues))
+		}
+		limits[queue] = n
+	}
+	return
+}
+
+// drain moves tasks not taken by workers back to pending list.
+func (f *fetcher) drain() {
+	var ts []*TaskInfo
+	for {
+		select {
+		case t := <-f.tasks():
+			ts = append(ts, t)
+			continue
+		default:
+		}
+		break
+	}
+	if len(ts) == 0 {
+		return
+	}
+	for _, t := range ts {
+		f.pool.taskDone(t)
+	}
+	err := f.broker.Active2Pending(context.Background(), ts)
+	if err != nil {
+		f.errHandler(err)
+	}
+}
+
+// waitIdle blocks until a worker becomes idle or server stopped.
+func (f *fetcher) waitIdle() {
+	select {
+	case <-f.pool.idleCh:
+	case <-f.stopCh:
+	}
+}
+
+// wait blocks until woken by notifier, poll interval elapsed or server stopped.
+func (f *fetcher) wait() {
+	t := time.NewTimer(f.pollInterval)
+	select {
+	case <-f.wakeCh:
+	case <-t.C:
+	case <-f.stopCh:
+	}
+	t.Stop()
+}
+
+func (f *fetcher) queueNames() []string {
+	return f.selector.Select(f.queues, func() map[string]int64 {
+		m, err := f.broker.Backlog(context.Background(), f.queues)
+		if err != nil {
+			f.errHandler(err)
+		}
+		return m
+	})
+}
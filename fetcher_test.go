@@ -0,0 +1,146 @@
+package acornq
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newPrefetchServer returns a server of one worker prefetching 2 tasks, its handler blocks until release is closed.
+func newPrefetchServer(t *testing.T, broker *MemoryBroker, release chan struct{}) (s *Server, handled map[string]int, mu *sync.Mutex) {
+	handled, mu = map[string]int{}, &sync.Mutex{}
+	s, err := NewServer(&Config{
+		Handler: TaskHandlerFunc(func(task *TaskInfo) error {
+			mu.Lock()
+			handled[string(task.ID)]++
+			mu.Unlock()
+			<-release
+			return nil
+		}),
+		Concurrency:      1,
+		Prefetch:         2,
+		Broker:           broker,
+		TaskPeekInterval: 10 * time.Millisecond,
+		ErrHandler:       func(err error) { t.Error(err) },
+	})
+	require.Nil(t, err)
+	return
+}
+
+func TestFetcher_DrainOnStop(t *testing.T) {
+	ctx := context.Background()
+	broker := NewMemoryBroker()
+	release := make(chan struct{})
+	s, handled, mu := newPrefetchServer(t, broker, release)
+	go s.Start()
+	cli := NewClientWithBroker(broker)
+	for _, id := range []string{"a", "b", "c", "d"} {
+		require.Nil(t, cli.EnqueueContext(ctx, NewTask("task", nil), TaskID(id)))
+	}
+	// one task is handling, others are prefetched
+	require.Eventually(t, func() bool { return len(s.f.tasks()) >= 2 }, 5*time.Second, time.Millisecond)
+	queueLen := func(list func(q *memQueue) []string) int {
+		broker.mu.Lock()
+		defer broker.mu.Unlock()
+		return len(list(broker.queue(defaultQueueName)))
+	}
+	assert.Equal(t, 1+len(s.f.tasks()), queueLen(func(q *memQueue) []string { return q.active }))
+
+	stopped := make(chan struct{})
+	go func() {
+		s.ShutDown(ctx)
+		close(stopped)
+	}()
+	// prefetched tasks are moved back to pending list while the handling one is running
+	assert.Eventually(t, func() bool {
+		return queueLen(func(q *memQueue) []string { return q.pending }) == 3
+	}, 5*time.Second, time.Millisecond)
+	close(release)
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("server not stopped")
+	}
+	assert.Equal(t, 0, queueLen(func(q *memQueue) []string { return q.active }))
+	mu.Lock()
+	assert.Len(t, handled, 1)
+	mu.Unlock()
+}
+
+func TestFetcher_Resize(t *testing.T) {
+	ctx := context.Background()
+	broker := NewMemoryBroker()
+	release := make(chan struct{})
+	s, handled, mu := newPrefetchServer(t, broker, release)
+	go s.Start()
+	defer func() {
+		ctx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+		defer cancel()
+		s.ShutDown(ctx)
+	}()
+	cli := NewClientWithBroker(broker)
+	for _, id := range []string{"a", "b", "c"} {
+		require.Nil(t, cli.EnqueueContext(ctx, NewTask("task", nil), TaskID(id)))
+	}
+	require.Eventually(t, func() bool { return len(s.f.tasks()) == 2 }, 5*time.Second, time.Millisecond)
+	mu.Lock()
+	assert.Len(t, handled, 1)
+	mu.Unlock()
+
+	// prefetched tasks are moved into the rebuilt taskCh and taken by new workers
+	s.SetConcurrency(3)
+	assert.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(handled) == 3
+	}, 5*time.Second, time.Millisecond)
+	assert.Eventually(t, func() bool { return cap(s.f.tasks()) == 5 }, time.Second, time.Millisecond)
+	close(release)
+	assert.Eventually(t, func() bool {
+		broker.mu.Lock()
+		defer broker.mu.Unlock()
+		return len(broker.queue(defaultQueueName).active) == 0
+	}, 5*time.Second, time.Millisecond)
+	mu.Lock()
+	assert.Equal(t, map[string]int{"a": 1, "b": 1, "c": 1}, handled)
+	mu.Unlock()
+}
+
+func TestFetcher_ResizeBuffered(t *testing.T) {
+	pool := newWorkerPool(&Server{})
+	pool.workers = make([]*Worker, 1)
+	f := newFetcher(nil, nil, nil, pool, nil, nil, 1, 2, 0, nil)
+	old := f.tasks()
+	for _, id := range []string{"a", "b", "c"} {
+		old <- &TaskInfo{ID: StringBytes(id)}
+	}
+	ids := func(taskCh chan *TaskInfo) (ids []string) {
+		for len(taskCh) > 0 {
+			ids = append(ids, string((<-taskCh).ID))
+		}
+		return
+	}
+
+	// buffered tasks are moved in order, workers waiting on the old one are woken
+	pool.workers = make([]*Worker, 3)
+	f.resize()
+	assert.Equal(t, 5, cap(f.tasks()))
+	_, ok := <-old
+	assert.False(t, ok)
+	assert.Equal(t, []string{"a", "b", "c"}, ids(f.tasks()))
+
+	// not shrunk below buffered tasks
+	for _, id := range []string{"a", "b", "c", "d"} {
+		f.tasks() <- &TaskInfo{ID: StringBytes(id)}
+	}
+	pool.workers = make([]*Worker, 1)
+	f.resize()
+	assert.Equal(t, 5, cap(f.tasks()))
+	<-f.tasks()
+	f.resize()
+	assert.Equal(t, 3, cap(f.tasks()))
+	assert.Equal(t, []string{"b", "c", "d"}, ids(f.tasks()))
+}
@@ -4,7 +4,9 @@ go 1.23.0
 
 require (
 	github.com/fatih/color v1.17.0
+	github.com/golang/snappy v1.0.0
 	github.com/google/uuid v1.6.0
+	github.com/klauspost/compress v1.18.0
 	github.com/newacorn/simple-bytes-pool v0.0.0-20241013115238-875dc0294a71
 	github.com/olekukonko/tablewriter v0.0.5
 	github.com/redis/rueidis v1.0.47
@@ -1,5 +1,10 @@
 package acornq
 
+import (
+	"errors"
+	"fmt"
+)
+
 type TaskHandler interface {
 	Handle(task *TaskInfo) error
 }
@@ -9,3 +14,49 @@ type TaskHandlerFunc func(task *TaskInfo) error
 func (fn TaskHandlerFunc) Handle(task *TaskInfo) error {
 	return fn(task)
 }
+
+// PanicError is the error of a task whose handler panicked, it is retried or archived like other errors.
+type PanicError struct {
+	// value passed to panic
+	Value any
+	// frames from the panic site, separated by |
+	Stack []byte
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("panic: %v S=[%s]", e.Value, e.Stack)
+}
+
+// Unwrap returns the value passed to panic if it is an error.
+func (e *PanicError) Unwrap() error {
+	err, _ := e.Value.(error)
+	return err
+}
+
+// newPanicError must be called by the deferred function recovering the panic.
+func newPanicError(v any) *PanicError {
+	// skip newPanicError, the deferred function and runtime.gopanic
+	return &PanicError{Value: v, Stack: appendStack(nil, 3, 32, false)}
+}
+
+// IsPanic reports whether err is caused by a handler panic.
+func IsPanic(err error) bool {
+	var panicErr *PanicError
+	return errors.As(err, &panicErr)
+}
+
+// IsSkipRetry reports whether err returned by handler archives the task as failed without retry.
+func IsSkipRetry(err error) bool {
+	return errors.Is(err, SkipRetry)
+}
+
+// IsRevokeTask reports whether err returned by handler deletes the task outright.
+func IsRevokeTask(err error) bool {
+	return errors.Is(err, RevokeTask)
+}
+
+// IsRateLimited reports whether err returned by handler retries the task later without consuming a retry.
+func IsRateLimited(err error) bool {
+	var rateLimitErr *RateLimitError
+	return errors.As(err, &rateLimitErr)
+}
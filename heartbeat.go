@@ -13,30 +13,37 @@ type heartBeatWorker struct {
 	stopCh chan struct{}
 	// inherit from Worker
 	beatItemCh chan *liveItem
-	// 20 seconds fixed
+	// interval of refreshing live sorted set scores, Config.HeartbeatInterval
 	liveDuration time.Duration
-	// 10 seconds fixed
+	// window of collecting items into one batch, Config.HeartbeatBatchInterval
 	batchDuration time.Duration
 	beatContainer []*heartbeatBatch
 	zombieLive    []*liveItem
 	mu            sync.Mutex
-	broker        *Broker
+	broker        Broker
 	stop          atomic.Bool
 }
 
-func newHeartBeatWorker(stopCh chan struct{}, beatItemCh chan *liveItem, broker *Broker) *heartBeatWorker {
+func newHeartBeatWorker(stopCh chan struct{}, beatItemCh chan *liveItem, broker Broker, liveDuration, batchDuration time.Duration) *heartBeatWorker {
 	return &heartBeatWorker{
 		stopCh:        stopCh,
 		beatItemCh:    beatItemCh,
 		broker:        broker,
-		liveDuration:  25 * time.Second,
-		batchDuration: 20 * time.Second,
+		liveDuration:  liveDuration,
+		batchDuration: batchDuration,
 	}
 }
 
+// Start collects items sent by workers into batches, a batch is registered to ticker
+// w.batchDuration after its first item arrived, live scores of its items are written at once
+// then refreshed every w.liveDuration until all of them stop.
 func (w *heartBeatWorker) Start() {
-	start := nanoTime()
 	batch := &heartbeatBatch{duration: w.liveDuration, w: w}
+	timer := time.NewTimer(w.batchDuration)
+	timer.Stop()
+	defer timer.Stop()
+	var flushC <-chan time.Time
+	registerTickerItem(w, w.liveDuration)
 	for {
 		select {
 		case item := <-w.beatItemCh:
@@ -47,21 +54,23 @@ func (w *heartBeatWorker) Start() {
 				}
 				continue
 			}
-			// task is peeked and handling
-			now := nanoTime()
-			if now <= start+int64(w.batchDuration) {
-				batch.addItem(item)
-			} else {
-				start = now
-				if batch.len() > 0 {
-					// this batch collect at least one item during w.batchDuration
-					registerTickerItem(batch, w.liveDuration)
-					w.AddBatch(batch)
-					// create a new batch
-					batch = &heartbeatBatch{duration: w.liveDuration, w: w}
-				}
+			// task is picked and handling
+			if flushC == nil {
+				timer.Reset(w.batchDuration)
+				flushC = timer.C
+			}
+			batch.addItem(item)
+		case <-flushC:
+			flushC = nil
+			if batch.len() > 0 {
+				// this batch collect at least one item during w.batchDuration
+				w.AddBatch(batch)
+				registerTickerItem(batch, 0)
+				// create a new batch
+				batch = &heartbeatBatch{duration: w.liveDuration, w: w}
 			}
 		case <-w.stopCh:
+			w.stop.Store(true)
 			w.Stop()
 			return
 		}
@@ -73,16 +82,11 @@ func (w *heartBeatWorker) Stop() {
 	items := make([]*liveItem, 0, 10)
 	for _, batch := range w.beatContainer {
 		batch.stop.Store(true)
-		start := true
 		batch.mu.Lock()
-		start = batch.start
-		batch.mu.Unlock()
-		if !start {
-			continue
-		}
-		for _, item := range batch.items {
-			items = append(items, item)
+		if batch.start {
+			items = append(items, batch.items...)
 		}
+		batch.mu.Unlock()
 	}
 	clear(w.beatContainer)
 	if len(items) == 0 {
@@ -107,13 +111,19 @@ func (w *heartBeatWorker) Clean() (duration time.Duration, stop bool) {
 	}
 	w.mu.Unlock()
 	if len(zombieLive) > 0 {
-		_ = w.broker.DeleteLiveTasks(context.Background(), w.zombieLive)
+		_ = w.broker.DeleteLiveTasks(context.Background(), zombieLive)
 	}
 	duration = w.liveDuration
 	return
 }
 
+// AddBatch adds batch to w.beatContainer, batches whose items all stopped are dropped.
 func (w *heartBeatWorker) AddBatch(batch *heartbeatBatch) {
+	w.beatContainer = slices.DeleteFunc(w.beatContainer, func(batch1 *heartbeatBatch) bool {
+		batch1.mu.Lock()
+		defer batch1.mu.Unlock()
+		return len(batch1.items) == 0
+	})
 	w.beatContainer = append(w.beatContainer, batch)
 }
 
@@ -143,7 +153,8 @@ func (h *heartbeatBatch) Clean() (duration time.Duration, stop bool) {
 		h.mu.Unlock()
 		return
 	}
-	items := h.items
+	// items is changed by StopItem while broker is called
+	items := slices.Clone(h.items)
 	duration = h.duration
 	start := h.start
 	if !start {
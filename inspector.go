@@ -0,0 +1,91 @@
+package acornq
+
+import (
+	"context"
+	"github.com/redis/rueidis"
+	"sort"
+	"strings"
+)
+
+// Inspector is a client interface to inspect servers and queues.
+type Inspector struct {
+	broker Broker
+}
+
+func NewInspector(redisCli rueidis.Client) *Inspector {
+	return NewInspectorWithBroker(NewRedisBroker(redisCli))
+}
+
+func NewInspectorWithBroker(b Broker) *Inspector {
+	return &Inspector{
+		broker: b,
+	}
+}
+
+// Servers returns alive servers and tasks they are handling, sorted by start time.
+func (i *Inspector) Servers(ctx context.Context) (servers []*ServerInfo, err error) {
+	servers, err = i.broker.ListServers(ctx)
+	if err != nil {
+		return
+	}
+	sort.Slice(servers, func(i, j int) bool {
+		return servers[i].StartedAt.Before(servers[j].StartedAt)
+	})
+	for _, s := range servers {
+		sort.Slice(s.ActiveWorkers, func(i, j int) bool {
+			return s.ActiveWorkers[i].WorkerID < s.ActiveWorkers[j].WorkerID
+		})
+	}
+	return
+}
+
+// SetQueueMaxActive limits active tasks of queue across all servers, picks stop when
+// active list of queue reaches n. n <= 0 removes the limit.
+func (i *Inspector) SetQueueMaxActive(ctx context.Context, queue string, n int) (err error) {
+	if err = validateQueueName(queue); err != nil {
+		return
+	}
+	return i.broker.SetMaxActive(ctx, queue, n)
+}
+
+// QueueMaxActive returns active tasks limit of queue across all servers, 0 means no limit.
+func (i *Inspector) QueueMaxActive(ctx context.Context, queue string) (n int, err error) {
+	return i.broker.MaxActive(ctx, queue)
+}
+
+// SetQueueRateLimit limits how fast tasks of queue are picked across all servers, zero rate removes the limit.
+func (i *Inspector) SetQueueRateLimit(ctx context.Context, queue string, limit RateLimit) (err error) {
+	if err = validateQueueName(queue); err != nil {
+		return
+	}
+	return i.broker.SetRateLimit(ctx, queue, "", limit)
+}
+
+// SetTaskTypeRateLimit limits how fast tasks of taskType in queue are picked across all servers,
+// zero rate removes the limit. Tasks over the limit are scheduled until a token is available.
+func (i *Inspector) SetTaskTypeRateLimit(ctx context.Context, queue string, taskType string, limit RateLimit) (err error) {
+	if err = validateQueueName(queue); err != nil {
+		return
+	}
+	if strings.TrimSpace(taskType) == "" {
+		return ErrEmptyTaskType
+	}
+	return i.broker.SetRateLimit(ctx, queue, taskType, limit)
+}
+
+// DeadLetterTasks returns at most count oldest tasks in the dead letter stream of queue.
+func (i *Inspector) DeadLetterTasks(ctx context.Context, queue string, count int) (ts []*DeadLetterTask, err error) {
+	if err = validateQueueName(queue); err != nil {
+		return
+	}
+	return i.broker.DeadLetterTasks(ctx, queue, count)
+}
+
+// ReplayDeadLetter moves dead letter tasks with entry ids back into pending list of queue
+// with retried count reset, returns count of replayed tasks.
+func (i *Inspector) ReplayDeadLetter(ctx context.Context, queue string, ids ...string) (n int, err error) {
+	if err = validateQueueName(queue); err != nil {
+		return
+	}
+	return i.broker.ReplayDeadLetter(ctx, queue, ids)
+}
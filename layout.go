@@ -0,0 +1,405 @@
+package acornq
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/redis/rueidis"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// StorageLayout is how RedisBroker stores a task under its task key.
+type StorageLayout int
+
+const (
+	// LayoutJSON stores a task as a RedisJSON document, it requires RedisJSON module(Redis Stack).
+	LayoutJSON StorageLayout = iota
+	// LayoutHash stores fields of a task in a redis hash, it works on plain redis.
+	// Every attempt is kept in its own field attempt:{seq}.
+	LayoutHash
+)
+
+var ErrUnknownLayout = errors.New("unknown storage layout")
+
+func (l StorageLayout) String() string {
+	switch l {
+	case LayoutJSON:
+		return "json"
+	case LayoutHash:
+		return "hash"
+	}
+	return "unknown"
+}
+
+// keyType is the TYPE of task keys in layout l.
+func (l StorageLayout) keyType() string {
+	if l == LayoutHash {
+		return "hash"
+	}
+	return "ReJSON-RL"
+}
+
+// taskScripts are lua scripts reading or writing task keys, one set per layout.
+type taskScripts struct {
+	enqueuePending    *rueidis.Lua
+	enqueueScheduled  *rueidis.Lua
+	pickTasks         *rueidis.Lua
+	recovery          *rueidis.Lua
+	active2pending    *rueidis.Lua
+	retryTasks        *rueidis.Lua
+	active2Archive    *rueidis.Lua
+	active2DeadLetter *rueidis.Lua
+	replayDeadLetter  *rueidis.Lua
+}
+
+var jsonScripts = &taskScripts{
+	enqueuePending:    enqueuePendingLs,
+	enqueueScheduled:  enqueueScheduledLs,
+	pickTasks:         pickTasksLs,
+	recovery:          recoveryLs,
+	active2pending:    active2pendingLs,
+	retryTasks:        retryTasksLs,
+	active2Archive:    active2ArchiveLs,
+	active2DeadLetter: active2DeadLetterLs,
+	replayDeadLetter:  replayDeadLetterLs,
+}
+
+var hashScripts = &taskScripts{
+	enqueuePending:    rueidis.NewLuaScript(enqueuePendingHashLuaScript),
+	enqueueScheduled:  rueidis.NewLuaScript(enqueueScheduledHashLuaScript),
+	pickTasks:         rueidis.NewLuaScript(pickTasksHashLuaScript),
+	recovery:          rueidis.NewLuaScript(recoveryTasksHashLuaScript),
+	active2pending:    rueidis.NewLuaScript(active2pendingHashLuaScript),
+	retryTasks:        rueidis.NewLuaScript(retryTasksHashLuaScript),
+	active2Archive:    rueidis.NewLuaScript(active2ArchiveHashLuaScript),
+	active2DeadLetter: rueidis.NewLuaScript(active2DeadLetterHashLuaScript),
+	replayDeadLetter:  rueidis.NewLuaScript(replayDeadLetterHashLuaScript),
+}
+
+func (l StorageLayout) scripts() *taskScripts {
+	if l == LayoutHash {
+		return hashScripts
+	}
+	return jsonScripts
+}
+
+// taskArgs appends t encoded for enqueue scripts of layout l to args,
+// json document for LayoutJSON, count of fields followed by field value pairs for LayoutHash.
+func (l StorageLayout) taskArgs(args []string, t *TaskInfo) ([]string, error) {
+	if l == LayoutHash {
+		fields := taskHashFields(t)
+		args = append(args, strconv.Itoa(len(fields)/2))
+		return append(args, fields...), nil
+	}
+	b, err := MarshalTask(t)
+	if err != nil {
+		return args, err
+	}
+	return append(args, b2s(b)), nil
+}
+
+// decodeTask decodes a task returned by scripts of layout l.
+func (l StorageLayout) decodeTask(v rueidis.RedisMessage) (*TaskInfo, error) {
+	if l == LayoutHash {
+		m, err := v.AsStrMap()
+		if err != nil {
+			return nil, err
+		}
+		return taskFromHash(m)
+	}
+	str, err := v.ToString()
+	if err != nil {
+		return nil, err
+	}
+	return unmarshalTask(s2b(str))
+}
+
+// decodeDeadLetter decodes a dead letter stream entry written by scripts of layout l.
+func (l StorageLayout) decodeDeadLetter(e rueidis.XRangeEntry) (*DeadLetterTask, error) {
+	var t *TaskInfo
+	var err error
+	if l == LayoutHash {
+		t, err = taskFromHash(e.FieldValues)
+	} else {
+		t, err = unmarshalTask(s2b(e.FieldValues["task"]))
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &DeadLetterTask{ID: e.ID, Queue: e.FieldValues["queue"], Task: t}, nil
+}
+
+func isWrongType(err error) bool {
+	redisErr, ok := rueidis.IsRedisErr(err)
+	return ok && strings.HasPrefix(redisErr.Error(), "WRONGTYPE")
+}
+
+const attemptFieldPrefix = "attempt:"
+
+// taskHashFields returns field value pairs of t in LayoutHash, zero fields are omitted like json.
+func taskHashFields(t *TaskInfo) []string {
+	fields := make([]string, 0, 32)
+	fields = append(fields, "id", b2s(t.ID), "type", b2s(t.Type), "payload", b2s(t.Payload), "queue", b2s(t.Queue))
+	str := func(name string, v StringBytes) {
+		if len(v) > 0 {
+			fields = append(fields, name, b2s(v))
+		}
+	}
+	num := func(name string, v int64) {
+		if v != 0 {
+			fields = append(fields, name, strconv.FormatInt(v, 10))
+		}
+	}
+	str("compression", t.Compression)
+	str("payload_ref", t.PayloadRef)
+	str("encryption_key", t.EncryptionKey)
+	str("unique_key", t.UniqueKey)
+	str("error_msg", t.ErrorMsg)
+	num("state", int64(t.State))
+	num("retry", int64(t.Retry))
+	num("retried", int64(t.Retried))
+	num("timeout", int64(t.Timeout))
+	num("deadline", t.Deadline)
+	num("retention", int64(t.Retention))
+	num("start_at", t.StartAt)
+	num("last_failed_at", t.LastFailedAt)
+	num("pending_at", t.PendingAt)
+	num("completed_at", t.CompletedAt)
+	if len(t.Headers) > 0 {
+		b, err := json.Marshal(t.Headers)
+		if err == nil {
+			fields = append(fields, "headers", b2s(b))
+		}
+	}
+	for i, a := range t.Attempts {
+		b, err := json.Marshal(a)
+		if err != nil {
+			continue
+		}
+		fields = append(fields, attemptFieldPrefix+strconv.Itoa(i+1), b2s(b))
+	}
+	num("attempt_seq", int64(len(t.Attempts)))
+	return fields
+}
+
+// taskFromHash decodes fields of a task hash.
+func taskFromHash(m map[string]string) (t *TaskInfo, err error) {
+	if len(m) == 0 {
+		return nil, rueidis.Nil
+	}
+	t = &TaskInfo{}
+	type attempt struct {
+		seq int
+		a   *TaskAttempt
+	}
+	var attempts []attempt
+	for k, v := range m {
+		var n int64
+		switch k {
+		case "id":
+			t.ID = StringBytes(v)
+		case "type":
+			t.Type = StringBytes(v)
+		case "payload":
+			t.Payload = StringBytes(v)
+		case "queue":
+			t.Queue = StringBytes(v)
+		case "compression":
+			t.Compression = StringBytes(v)
+		case "payload_ref":
+			t.PayloadRef = StringBytes(v)
+		case "encryption_key":
+			t.EncryptionKey = StringBytes(v)
+		case "headers":
+			if err = json.Unmarshal(s2b(v), &t.Headers); err != nil {
+				return nil, err
+			}
+		case "unique_key":
+			t.UniqueKey = StringBytes(v)
+		case "error_msg":
+			t.ErrorMsg = StringBytes(v)
+		case "state", "retry", "retried", "timeout", "deadline", "retention",
+			"start_at", "last_failed_at", "pending_at", "completed_at":
+			n, err = strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				return nil, err
+			}
+		default:
+			if seq, ok := strings.CutPrefix(k, attemptFieldPrefix); ok {
+				a := &TaskAttempt{}
+				if err = json.Unmarshal(s2b(v), a); err != nil {
+					return nil, err
+				}
+				i, _ := strconv.Atoi(seq)
+				attempts = append(attempts, attempt{seq: i, a: a})
+			}
+			continue
+		}
+		switch k {
+		case "state":
+			t.State = TaskState(n)
+		case "retry":
+			t.Retry = int(n)
+		case "retried":
+			t.Retried = int(n)
+		case "timeout":
+			t.Timeout = int(n)
+		case "deadline":
+			t.Deadline = n
+		case "retention":
+			t.Retention = int(n)
+		case "start_at":
+			t.StartAt = n
+		case "last_failed_at":
+			t.LastFailedAt = n
+		case "pending_at":
+			t.PendingAt = n
+		case "completed_at":
+			t.CompletedAt = n
+		}
+	}
+	sort.Slice(attempts, func(i, j int) bool { return attempts[i].seq < attempts[j].seq })
+	for _, a := range attempts {
+		t.Attempts = append(t.Attempts, a.a)
+	}
+	return
+}
+
+// MigrateLayout converts tasks and dead letter entries of queues stored in layout from to layout to,
+// it returns count of converted tasks. Servers and clients of queues must be stopped while migrating,
+// migrating twice is safe as keys already in layout to are skipped.
+func MigrateLayout(ctx context.Context, redisCli rueidis.Client, queues []string, from, to StorageLayout) (n int, err error) {
+	if from != LayoutJSON && from != LayoutHash || to != LayoutJSON && to != LayoutHash {
+		return 0, ErrUnknownLayout
+	}
+	if from == to {
+		return
+	}
+	for _, queue := range queues {
+		keyInfo := NewKeyInfo(queue)
+		var n1 int
+		n1, err = migrateTasks(ctx, redisCli, keyInfo, from, to)
+		n += n1
+		if err != nil {
+			return
+		}
+		err = migrateDeadLetter(ctx, redisCli, keyInfo, from, to)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// migrateTasks scans task keys of queue on every node, keys seen on replicas are deduplicated.
+func migrateTasks(ctx context.Context, redisCli rueidis.Client, keyInfo *KeyInfo, from, to StorageLayout) (n int, err error) {
+	srcType := from.keyType()
+	seen := map[string]struct{}{}
+	for _, node := range redisCli.Nodes() {
+		var cursor uint64
+		for {
+			var entry rueidis.ScanEntry
+			entry, err = node.Do(ctx, node.B().Scan().Cursor(cursor).Match(keyInfo.TaskKey("*")).Count(500).Type(srcType).Build()).AsScanEntry()
+			if err != nil {
+				return
+			}
+			for _, key := range entry.Elements {
+				if _, ok := seen[key]; ok {
+					continue
+				}
+				seen[key] = struct{}{}
+				var ok bool
+				ok, err = migrateTask(ctx, redisCli, key, from, to)
+				if err != nil {
+					return
+				}
+				if ok {
+					n++
+				}
+			}
+			cursor = entry.Cursor
+			if cursor == 0 {
+				break
+			}
+		}
+	}
+	return
+}
+
+// migrateTask rewrites key in layout to by one script, the ttl of key is kept.
+func migrateTask(ctx context.Context, redisCli rueidis.Client, key string, from, to StorageLayout) (ok bool, err error) {
+	var t *TaskInfo
+	if from == LayoutHash {
+		var m map[string]string
+		m, err = redisCli.Do(ctx, redisCli.B().Hgetall().Key(key).Build()).AsStrMap()
+		if err == nil {
+			t, err = taskFromHash(m)
+		}
+	} else {
+		var str string
+		str, err = redisCli.Do(ctx, redisCli.B().JsonGet().Key(key).Build()).ToString()
+		if err == nil {
+			t, err = unmarshalTask(s2b(str))
+		}
+	}
+	//goland:noinspection GoDirectComparisonOfErrors
+	if err == rueidis.Nil || isWrongType(err) {
+		// expired or already migrated, replicas may lag behind
+		return false, nil
+	}
+	if err != nil {
+		return
+	}
+	args := []string{from.keyType(), to.String()}
+	if to == LayoutHash {
+		args = append(args, taskHashFields(t)...)
+	} else {
+		b, err1 := MarshalTask(t)
+		if err1 != nil {
+			return false, err1
+		}
+		args = append(args, b2s(b))
+	}
+	n, err := migrateTaskLs.Exec(ctx, redisCli, []string{key}, args).AsInt64()
+	return n == 1, err
+}
+
+// migrateDeadLetter re-adds entries of the dead letter stream in layout to, entry ids change.
+func migrateDeadLetter(ctx context.Context, redisCli rueidis.Client, keyInfo *KeyInfo, from, to StorageLayout) (err error) {
+	entries, err := redisCli.Do(ctx, redisCli.B().Xrange().Key(keyInfo.DeadLetterKey()).Start("-").End("+").Build()).AsXRange()
+	if err != nil {
+		return
+	}
+	for _, e := range entries {
+		// entries already in layout to are skipped
+		if _, isJSON := e.FieldValues["task"]; isJSON == (to == LayoutJSON) {
+			continue
+		}
+		dt, err1 := from.decodeDeadLetter(e)
+		if err1 != nil {
+			continue
+		}
+		var fields []string
+		if to == LayoutHash {
+			fields = taskHashFields(dt.Task)
+		} else {
+			b, err2 := MarshalTask(dt.Task)
+			if err2 != nil {
+				return err2
+			}
+			fields = []string{"queue", dt.Queue, "task", b2s(b)}
+		}
+		cmds := rueidis.Commands{
+			redisCli.B().Arbitrary("XADD").Keys(keyInfo.DeadLetterKey()).Args(append([]string{"*"}, fields...)...).Build(),
+			redisCli.B().Xdel().Key(keyInfo.DeadLetterKey()).Id(e.ID).Build(),
+		}
+		for _, resp := range redisCli.DoMulti(ctx, cmds...) {
+			if err = resp.Error(); err != nil {
+				return
+			}
+		}
+	}
+	return
+}
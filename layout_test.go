@@ -0,0 +1,86 @@
+package acornq
+
+import (
+	"context"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestTaskHashFields(t *testing.T) {
+	t1 := &TaskInfo{
+		ID:            StringBytes("id"),
+		Type:          StringBytes("type"),
+		Payload:       StringBytes("pay\x00load\""),
+		Compression:   StringBytes("zstd"),
+		PayloadRef:    StringBytes("acornq:{queue}:t:id"),
+		EncryptionKey: StringBytes("k1"),
+		Headers:       map[string]string{"tenant": "t1", "trace": "a\"b"},
+		Queue:         StringBytes("queue"),
+		ErrorMsg:      StringBytes("error"),
+		State:         Archived | Failed,
+		Retry:         3,
+		Retried:       3,
+		StartAt:       1700000000,
+		Retention:     -1,
+		Attempts: []*TaskAttempt{
+			{StartedAt: 1700000001, Duration: time.Second, Error: "a", ServerID: "s"},
+			{StartedAt: 1700000002, Duration: time.Minute, ServerID: "s"},
+		},
+	}
+	fields := taskHashFields(t1)
+	m := map[string]string{}
+	for i := 0; i < len(fields); i += 2 {
+		m[fields[i]] = fields[i+1]
+	}
+	assert.NotContains(t, m, "timeout")
+	t2, err := taskFromHash(m)
+	assert.Nil(t, err)
+	assert.Equal(t, t1, t2)
+
+	_, err = taskFromHash(map[string]string{"id": "id", "state": "x"})
+	assert.NotNil(t, err)
+}
+
+func TestMigrateLayout(t *testing.T) {
+	cli := client(t)
+	if !slices.Contains(testLayouts(t, cli), LayoutJSON) {
+		t.Skip("RedisJSON module is not loaded")
+	}
+	ctx := context.Background()
+	queue := testQueue(t)
+	keyInfo := NewKeyInfo(queue)
+	client := NewClientWithBroker(NewRedisBrokerWithLayout(cli, LayoutHash))
+	for i := 0; i < 5; i++ {
+		require.Nil(t, client.EnqueueContext(ctx, NewTask("task", []byte(fmt.Sprint(i))), Queue(queue), TaskID(fmt.Sprint(i))))
+	}
+	require.Nil(t, cli.Do(ctx, cli.B().Pexpire().Key(keyInfo.TaskKey("0")).Milliseconds(60000).Build()).Error())
+
+	for _, layouts := range [][2]StorageLayout{{LayoutHash, LayoutJSON}, {LayoutJSON, LayoutHash}} {
+		from, to := layouts[0], layouts[1]
+		n, err := MigrateLayout(ctx, cli, []string{queue}, from, to)
+		require.Nil(t, err)
+		assert.Equal(t, 5, n, "%s to %s", from, to)
+		n, err = MigrateLayout(ctx, cli, []string{queue}, from, to)
+		require.Nil(t, err)
+		assert.Zero(t, n)
+		typ, err := cli.Do(ctx, cli.B().Type().Key(keyInfo.TaskKey("0")).Build()).ToString()
+		require.Nil(t, err)
+		assert.Equal(t, to.keyType(), typ)
+		ttl, err := cli.Do(ctx, cli.B().Pttl().Key(keyInfo.TaskKey("0")).Build()).AsInt64()
+		require.Nil(t, err)
+		assert.Greater(t, ttl, int64(0))
+		task := getTask(t, cli, to, keyInfo.TaskKey("1"))
+		assert.Equal(t, "1", string(task.Payload))
+		assert.Equal(t, Pending, task.State)
+	}
+
+	broker := NewRedisBrokerWithLayout(cli, LayoutHash)
+	broker.AddQueue(queue)
+	ts, err := broker.PickTasks(ctx, []string{queue}, 5, nil)
+	require.Nil(t, err)
+	assert.Len(t, ts, 5)
+}
@@ -10,8 +10,6 @@ import (
 )
 
 func LogStack(hint string, message string, skip int, dst io.Writer, ideMode bool) {
-	ps := make([]uintptr, 8)
-	fs := runtime.CallersFrames(ps[:runtime.Callers(skip+1, ps)])
 	const timestampPrefix = "T="
 	now := time.Now()
 	pb := bpool.Get(1024)
@@ -31,6 +29,22 @@ func LogStack(hint string, message string, skip int, dst io.Writer, ideMode bool
 	if ideMode {
 		buf = append(buf, "\n"...)
 	}
+	buf = appendStack(buf, skip, 8, ideMode)
+	if ideMode {
+		buf = append(buf, '\n')
+	}
+	buf = append(buf, "]\n"...)
+	dst = os.Stdout
+	//goland:noinspection GoUnhandledErrorResult
+	dst.Write(buf)
+	pb.RecycleToPool00()
+}
+
+// appendStack appends at most depth frames of current goroutine to buf,
+// skip 0 is the caller of appendStack.
+func appendStack(buf []byte, skip, depth int, ideMode bool) []byte {
+	ps := make([]uintptr, depth)
+	fs := runtime.CallersFrames(ps[:runtime.Callers(skip+2, ps)])
 	start := false
 	for {
 		f, more := fs.Next()
@@ -54,12 +68,5 @@ func LogStack(hint string, message string, skip int, dst io.Writer, ideMode bool
 		buf = strconv.AppendInt(buf, int64(f.Line), 10)
 		start = true
 	}
-	if ideMode {
-		buf = append(buf, '\n')
-	}
-	buf = append(buf, "]\n"...)
-	dst = os.Stdout
-	//goland:noinspection GoUnhandledErrorResult
-	dst.Write(buf)
-	pb.RecycleToPool00()
+	return buf
 }
@@ -3,27 +3,38 @@ package acornq
 import "github.com/redis/rueidis"
 
 var (
-	cleanerLs          = rueidis.NewLuaScript(cleanerLuaScript)
-	recoveryLs         = rueidis.NewLuaScript(recoveryTasksLuaScript)
-	pickTasksLs        = rueidis.NewLuaScript(pickTasksLuaScript)
-	retryTasksLs       = rueidis.NewLuaScript(retryTasksLuaScript)
-	active2pendingLs   = rueidis.NewLuaScript(active2pendingLuaScript)
-	active2ArchiveLs   = rueidis.NewLuaScript(active2ArchiveLuaScript)
-	enqueuePendingLs   = rueidis.NewLuaScript(enqueuePendingLuaScript)
-	enqueueScheduledLs = rueidis.NewLuaScript(enqueueScheduledLuaScript)
+	cleanerLs           = rueidis.NewLuaScript(cleanerLuaScript)
+	recoveryLs          = rueidis.NewLuaScript(recoveryTasksLuaScript)
+	pickTasksLs         = rueidis.NewLuaScript(pickTasksLuaScript)
+	retryTasksLs        = rueidis.NewLuaScript(retryTasksLuaScript)
+	active2pendingLs    = rueidis.NewLuaScript(active2pendingLuaScript)
+	active2ArchiveLs    = rueidis.NewLuaScript(active2ArchiveLuaScript)
+	enqueuePendingLs    = rueidis.NewLuaScript(enqueuePendingLuaScript)
+	enqueueScheduledLs  = rueidis.NewLuaScript(enqueueScheduledLuaScript)
+	acquireSemaphoreLs  = rueidis.NewLuaScript(acquireSemaphoreLuaScript)
+	deleteActiveLs      = rueidis.NewLuaScript(deleteActiveLuaScript)
+	active2DeadLetterLs = rueidis.NewLuaScript(active2DeadLetterLuaScript)
+	replayDeadLetterLs  = rueidis.NewLuaScript(replayDeadLetterLuaScript)
+	streamEnqueueLs     = rueidis.NewLuaScript(streamLayoutLuaScript + streamEnqueueLuaScript)
+	streamPickLs        = rueidis.NewLuaScript(streamLayoutLuaScript + streamPickLuaScript)
+	streamRequeueLs     = rueidis.NewLuaScript(streamLayoutLuaScript + streamRequeueLuaScript)
+	streamRecoveryLs    = rueidis.NewLuaScript(streamLayoutLuaScript + streamRecoveryLuaScript)
+	migrateTaskLs       = rueidis.NewLuaScript(migrateTaskLuaScript)
 )
 
 // --- KEYS[1] -> asynq:{queueName}:pending
 // --- KEYS[2..n] -> asynq:{queueName}:t:taskID
-// --- ARGV[1..n] -> task json encoded data
+// --- ARGV[1] -> asynq:{queueName}:notify channel
+// --- ARGV[2..n] -> task json encoded data
 // ---
 var enqueuePendingLuaScript =
 // lang=lua
 `local pending = KEYS[1]
-for i=1, #ARGV do
-    redis.call('json.set', KEYS[i+1],'$', ARGV[i])
-    redis.call('LPUSH',pending, KEYS[i+1])
+for i=2, #ARGV do
+    redis.call('json.set', KEYS[i],'$', ARGV[i])
+    redis.call('LPUSH',pending, KEYS[i])
 end
+redis.call('PUBLISH', ARGV[1], #ARGV-1)
 return redis.status_reply("OK")`
 
 // --- KEYS[1] -> asynq:{queueName}:scheduled
@@ -45,6 +56,8 @@ return redis.status_reply("OK")`
 // --- KEYS[3] -> asynq:{queueName}:pending
 // --- ARGV[1] -> task idle duration in seconds
 // --- ARGV[2] -> pending state
+// --- ARGV[3] -> asynq:{queueName}:notify channel
+// --- return -> task keys moved back to pending list
 // ---
 var recoveryTasksLuaScript = `local function pendingAt(task,active)
     local resp = redis.call("JSON.GET",task,"$.pending_at")
@@ -134,20 +147,26 @@ if #activeList > 0 then
     end
     if #del2 > 0 then
         redis.call("LPUSH",pending, unpack(del2))
-        for i=1, #del1 do
+        for i=1, #del2 do
             redis.call("JSON.MSET",del2[i],"$.state",pendingState,del2[i],"$.pending_at",now)
             redis.call("LREM",active,1,del2[i])
         end
-        redis.call("SREM",live, unpack(del2))
+        redis.call("ZREM",live, unpack(del2))
     end
     local del3 = deleteZombieLive(liveTable,activeTable)
     if #del3 > 0 then
-        redis.call("SREM",live, unpack(del3))
+        redis.call("ZREM",live, unpack(del3))
+    end
+    for i=1, #del2 do
+        table.insert(del1, del2[i])
+    end
+    if #del1 > 0 then
+        redis.call("PUBLISH", ARGV[3], #del1)
     end
-    return redis.status_reply("OK")
+    return del1
 end
 redis.call("DEL",live)
-return redis.status_reply("OK")`
+return {}`
 
 // --// PickTasks from pending set.
 // --// 1. move task from scheduled list to pending list.
@@ -158,18 +177,25 @@ return redis.status_reply("OK")`
 // --- KEYS[2] -> asynq:{queueName}:active
 // --- KEYS[3] -> asynq:{queueName}:scheduled
 // --- KEYS[4] -> asynq:{queueName}:retry
+// --- KEYS[5] -> asynq:{queueName}:maxactive
+// --- KEYS[6] -> asynq:{queueName}:ratelimit
 // --- ARGV[1] -> task count
 // --- ARGV[2] -> pending state
 // --- ARGV[3] -> active state
+// --- ARGV[4] -> asynq:{queueName}:notify channel
+// --- ARGV[5] -> scheduled state
 // ---
 var pickTasksLuaScript = `local pending = KEYS[1]
 local active = KEYS[2]
 local scheduled = KEYS[3]
 local retry = KEYS[4]
+local maxActive = tonumber(redis.call("GET", KEYS[5]))
+local limiter = KEYS[6]
 local count = tonumber(ARGV[1])
 local now = tonumber(redis.call("TIME")[1])
 local pendingState = ARGV[2]
 local activeState = ARGV[3]
+local scheduledState = ARGV[5]
 
 local move1=redis.call("ZRANGEBYSCORE",scheduled,0,now)
 if #move1 > 0 then
@@ -189,16 +215,81 @@ if #move2 > 0 then
     end
     redis.call("ZREM",retry, unpack(move2))
 end
+--- wake other idle workers for due tasks beyond count
+if #move1 + #move2 > count then
+    redis.call("PUBLISH", ARGV[4], #move1 + #move2 - count)
+end
 local result ={}
-for _=1,count do
-    local taskKey = redis.call("RPOPLPUSH",pending,active)
+--- cluster-wide limit of active tasks
+if maxActive then
+    count = math.min(count, maxActive - redis.call("LLEN", active))
+end
+local limited = redis.call("EXISTS", limiter) == 1
+local nowMs = 0
+if limited then
+    local t = redis.call("TIME")
+    nowMs = tonumber(t[1]) * 1000 + math.floor(tonumber(t[2]) / 1000)
+end
+--- token bucket of fields with prefix in limiter, nil if not limited
+local function bucket(prefix)
+    local v = redis.call("HMGET", limiter, prefix.."rate", prefix.."burst", prefix.."tokens", prefix.."ts")
+    local rate = tonumber(v[1])
+    if not rate or rate <= 0 then
+        return nil
+    end
+    local burst = tonumber(v[2]) or 1
+    local tokens = tonumber(v[3]) or burst
+    local ts = tonumber(v[4]) or nowMs
+    if nowMs > ts then
+        tokens = math.min(burst, tokens + (nowMs - ts) * rate / 1000)
+    end
+    return {rate = rate, tokens = tokens}
+end
+local function take(prefix, b)
+    redis.call("HSET", limiter, prefix.."tokens", tostring(b.tokens - 1), prefix.."ts", tostring(nowMs))
+end
+local attempts = 0
+while #result < count and attempts < count + 100 do
+    attempts = attempts + 1
+    local qb
+    if limited then
+        qb = bucket("")
+        if qb and qb.tokens < 1 then
+            break
+        end
+    end
+    local taskKey = redis.call("RPOP", pending)
     if not taskKey then
-        return result
+        break
     end
-    redis.call("JSON.MSET",taskKey,"$.pending_at",now,taskKey,"$.state",activeState)
-    local task = redis.call("json.get",taskKey)
-    if task then
-        table.insert(result, task)
+    local deferred = false
+    if limited then
+        local taskType = redis.call("JSON.GET", taskKey, "$.type")
+        if taskType then
+            local prefix = "t:"..cjson.decode(taskType)[1]..":"
+            local tb = bucket(prefix)
+            if tb then
+                if tb.tokens < 1 then
+                    --- task type is limited, schedule it when next token is available
+                    redis.call("ZADD", scheduled, now + math.ceil((1 - tb.tokens) / tb.rate), taskKey)
+                    redis.call("JSON.SET", taskKey, "$.state", scheduledState)
+                    deferred = true
+                else
+                    take(prefix, tb)
+                end
+            end
+        end
+    end
+    if not deferred then
+        if qb then
+            take("", qb)
+        end
+        redis.call("LPUSH", active, taskKey)
+        redis.call("JSON.MSET",taskKey,"$.pending_at",now,taskKey,"$.state",activeState)
+        local task = redis.call("json.get",taskKey)
+        if task then
+            table.insert(result, task)
+        end
     end
 end
 return result`
@@ -208,19 +299,35 @@ return result`
 // -- KEYS[2] -> asynq:{queueName}:active
 // -- KEYS[3..n] -> asynq:{queueName}:t:taskID
 // -- ARGV[1] -> retry state
-// -- ARGV[2n] -> task start at unix timestamp seconds
-// -- ARGV[2n+1] -> retried count
-var retryTasksLuaScript = `local retry = KEYS[1]
+// -- ARGV[2] -> max attempts kept in task
+// -- ARGV[3n] -> task start at unix timestamp seconds
+// -- ARGV[3n+1] -> retried count
+// -- ARGV[3n+2] -> attempt json, empty if not recorded
+var retryTasksLuaScript = `local function appendAttempt(taskKey, attempt, maxAttempts)
+    if attempt == "" then
+        return
+    end
+    local n = redis.call("JSON.ARRAPPEND", taskKey, "$.attempts", attempt)[1]
+    if not n then
+        redis.call("JSON.SET", taskKey, "$.attempts", "[" .. attempt .. "]")
+    elseif n > maxAttempts then
+        redis.call("JSON.ARRTRIM", taskKey, "$.attempts", n - maxAttempts, n - 1)
+    end
+end
+local retry = KEYS[1]
 local active = KEYS[2]
 local retryState = ARGV[1]
-local j = 2
+local maxAttempts = tonumber(ARGV[2])
+local now = tonumber(redis.call("TIME")[1])
+local j = 3
 for i = 3, #KEYS do
     local taskKey = KEYS[i]
     local score = tonumber(ARGV[j])
     local retriedCount = tonumber(ARGV[j + 1])
-    j = j + 2
+    appendAttempt(taskKey, ARGV[j + 2], maxAttempts)
+    j = j + 3
     redis.call("ZADD", retry, score, taskKey)
-    redis.call("JSON.MSET", taskKey, "$.state", retryState, taskKey, "$.retried", retriedCount)
+    redis.call("JSON.MSET", taskKey, "$.state", retryState, taskKey, "$.retried", retriedCount, taskKey, "$.last_failed_at", now)
     redis.call("LREM", active, 1, taskKey)
 end
 return redis.status_reply("OK")`
@@ -228,6 +335,7 @@ return redis.status_reply("OK")`
 // -- KEYS[1] -> asynq:{queueName}:pending
 // -- KEYS[2] -> asynq:{queueName}:active
 // -- KEYS[3..n] -> asynq:{queueName}:t:taskID
+// -- ARGV[1] -> asynq:{queueName}:notify channel
 var active2pendingLuaScript = `local pending = KEYS[1]
 local active = KEYS[2]
 local now = tonumber(redis.call("TIME")[1])
@@ -237,28 +345,149 @@ for i=3, #KEYS do
         redis.call('LREM', active, 1, KEYS[i])
         redis.call('json.set', KEYS[i], '$.pending_at', now)
 end
+redis.call('PUBLISH', ARGV[1], #KEYS-2)
 return redis.status_reply("OK")`
 
-// -- KEYS[1] -> asynq:{queueName}:success or asynq:{queueName}:failed
+// -- KEYS[1] -> asynq:{queueName}:active
+// -- KEYS[2..n] -> asynq:{queueName}:t:taskID
+var deleteActiveLuaScript = `local active = KEYS[1]
+for i=2, #KEYS do
+    redis.call('LREM', active, 1, KEYS[i])
+    redis.call('DEL', KEYS[i])
+end
+return redis.status_reply("OK")`
+
+// -- KEYS[1] -> asynq:{queueName}:deadletter
 // -- KEYS[2] -> asynq:{queueName}:active
 // -- KEYS[3..n] -> asynq:{queueName}:t:taskID
-// -- ARGV[2..n] -> task retention
-var active2ArchiveLuaScript = `local archive = KEYS[1]
+// -- ARGV[1] -> queue name
+// -- ARGV[2] -> archived failed state
+// -- ARGV[3] -> dead letter stream max length
+// -- ARGV[4] -> max attempts kept in task
+// -- ARGV[5..n] -> attempt json, empty if not recorded
+// -- return -> entries trimmed from dead letter stream
+var active2DeadLetterLuaScript = `local function appendAttempt(taskKey, attempt, maxAttempts)
+    if attempt == "" then
+        return
+    end
+    local n = redis.call("JSON.ARRAPPEND", taskKey, "$.attempts", attempt)[1]
+    if not n then
+        redis.call("JSON.SET", taskKey, "$.attempts", "[" .. attempt .. "]")
+    elseif n > maxAttempts then
+        redis.call("JSON.ARRTRIM", taskKey, "$.attempts", n - maxAttempts, n - 1)
+    end
+end
+local deadLetter = KEYS[1]
+local active = KEYS[2]
+local queue = ARGV[1]
+local state = ARGV[2]
+local maxLen = ARGV[3]
+local maxAttempts = tonumber(ARGV[4])
+local now = tonumber(redis.call("TIME")[1])
+for i=3, #KEYS do
+    local taskKey = KEYS[i]
+    if redis.call("EXISTS", taskKey) == 1 then
+        appendAttempt(taskKey, ARGV[i + 2], maxAttempts)
+        redis.call("JSON.MSET", taskKey, "$.state", state, taskKey, "$.completed_at", now, taskKey, "$.last_failed_at", now)
+        local task = redis.call("JSON.GET", taskKey)
+        redis.call("XADD", deadLetter, "*", "queue", queue, "task", task)
+        redis.call("DEL", taskKey)
+    end
+    redis.call("LREM", active, 1, taskKey)
+end
+--- entries over max length are trimmed exactly and returned, their payload blobs are deleted by caller
+local trimmed = {}
+local n = redis.call("XLEN", deadLetter) - tonumber(maxLen)
+if n > 0 then
+    trimmed = redis.call("XRANGE", deadLetter, "-", "+", "COUNT", n)
+    redis.call("XTRIM", deadLetter, "MAXLEN", maxLen)
+end
+return trimmed`
+
+// -- KEYS[1] -> asynq:{queueName}:deadletter
+// -- KEYS[2] -> asynq:{queueName}:pending
+// -- KEYS[3..n] -> asynq:{queueName}:t:taskID
+// -- ARGV[1] -> asynq:{queueName}:notify channel
+// -- ARGV[2] -> pending state
+// -- ARGV[3..n] -> dead letter entry id of task
+// -- return -> count of replayed tasks
+var replayDeadLetterLuaScript = `local deadLetter = KEYS[1]
+local pending = KEYS[2]
+local pendingState = ARGV[2]
+local now = tonumber(redis.call("TIME")[1])
+local n = 0
+for i=3, #KEYS do
+    local taskKey = KEYS[i]
+    local entries = redis.call("XRANGE", deadLetter, ARGV[i], ARGV[i])
+    if #entries > 0 then
+        local fields = entries[1][2]
+        for j=1, #fields, 2 do
+            if fields[j] == "task" then
+                redis.call("JSON.SET", taskKey, "$", fields[j+1])
+                redis.call("JSON.MSET", taskKey, "$.state", pendingState, taskKey, "$.retried", 0, taskKey, "$.pending_at", now)
+                redis.call("LPUSH", pending, taskKey)
+                n = n + 1
+            end
+        end
+        redis.call("XDEL", deadLetter, ARGV[i])
+    end
+end
+if n > 0 then
+    redis.call("PUBLISH", ARGV[1], n)
+end
+return n`
+
+// -- KEYS[1] -> asynq:{queueName}:success or asynq:{queueName}:failed
+// -- KEYS[2] -> asynq:{queueName}:active
+// -- KEYS[3] -> asynq:{queueName}:todel
+// -- KEYS[4] -> asynq:{queueName}:blobs
+// -- KEYS[5..n] -> asynq:{queueName}:t:taskID
+// -- ARGV[1] -> archived state
+// -- ARGV[2] -> max attempts kept in task
+// -- ARGV[3] -> 1 if tasks failed else 0
+// -- ARGV[2n+2] -> task retention
+// -- ARGV[2n+3] -> attempt json, empty if not recorded
+var active2ArchiveLuaScript = `local function appendAttempt(taskKey, attempt, maxAttempts)
+    if attempt == "" then
+        return
+    end
+    local n = redis.call("JSON.ARRAPPEND", taskKey, "$.attempts", attempt)[1]
+    if not n then
+        redis.call("JSON.SET", taskKey, "$.attempts", "[" .. attempt .. "]")
+    elseif n > maxAttempts then
+        redis.call("JSON.ARRTRIM", taskKey, "$.attempts", n - maxAttempts, n - 1)
+    end
+end
+local archive = KEYS[1]
 local active = KEYS[2]
 local todel = KEYS[3]
+local blobs = KEYS[4]
 local state = ARGV[1]
+local maxAttempts = tonumber(ARGV[2])
+local failed = ARGV[3] == "1"
 local now = tonumber(redis.call("TIME")[1])
 
-for i = 2, #ARGV do
-    local taskKey = KEYS[i + 2]
-    local retention = tonumber(ARGV[i])
+for i = 5, #KEYS do
+    local taskKey = KEYS[i]
+    local retention = tonumber(ARGV[i * 2 - 6])
     if retention~=0 then
         redis.call('LPUSH', archive, taskKey)
+        local ref = redis.call('JSON.GET', taskKey, '$.payload_ref')
+        if ref then
+            ref = cjson.decode(ref)[1]
+            if ref then
+                redis.call('HSET', blobs, taskKey, ref)
+            end
+        end
         if retention>0 then
             redis.call('EXPIRE', taskKey, retention)
             redis.call('ZADD',todel,now+retention,taskKey)
         end
+        appendAttempt(taskKey, ARGV[i * 2 - 5], maxAttempts)
         redis.call('JSON.MSET', taskKey, '$.completed_at', now, taskKey, '$.state', state)
+        if failed then
+            redis.call('JSON.SET', taskKey, '$.last_failed_at', now)
+        end
     else
         redis.call('DEL', taskKey)
     end
@@ -266,56 +495,845 @@ for i = 2, #ARGV do
 end
 return redis.status_reply("OK")`
 
-// -- KEYS[3n] -> asynq:{queueName}:todel
-// -- KEYS[3n+1] -> asynq:{queueName}:success
-// -- KEYS[3n+2] -> asynq:{queueName}:failed
+// -- CleanUpArchive of one queue, keys of different queues are in different cluster slots.
+// -- KEYS[1] -> asynq:{queueName}:todel
+// -- KEYS[2] -> asynq:{queueName}:success
+// -- KEYS[3] -> asynq:{queueName}:failed
+// -- KEYS[4] -> asynq:{queueName}:blobs
 // -- ARGV[1] -> start position
 // -- ARGV[2] -> end position
-var cleanerLuaScript = `local startPos = tonumber(ARGV[1])
+// -- return -> start position of next batch(0 if done) and payload refs recorded of tasks removed from archive lists
+var cleanerLuaScript = `local toDelSet = KEYS[1]
+local successList = KEYS[2]
+local failedList = KEYS[3]
+local blobs = KEYS[4]
+local startPos = tonumber(ARGV[1])
 local endPos = tonumber(ARGV[2])
 local now = tonumber(redis.call("TIME")[1])
 local nextStartPos = 0
-for i=1,3,#KEYS do
-    local toDelSet = KEYS[i]
-    local successList = KEYS[i+1]
-    local failedList = KEYS[i+2]
-    --
-    if startPos==0 then
-        local resp = redis.call("ZRANGEBYSCORE", toDelSet, 0, now)
-        if #resp > 0 then
-            for j = 1, #resp do
-                local taskKey = resp[j]
-                if redis.call("LREM", successList, 1, taskKey)==0 then
-                    redis.call("LREM", failedList, 1, taskKey)
+local removed = {}
+--
+if startPos==0 then
+    local resp = redis.call("ZRANGEBYSCORE", toDelSet, 0, now)
+    if #resp > 0 then
+        for j = 1, #resp do
+            local taskKey = resp[j]
+            if redis.call("LREM", successList, 1, taskKey)==0 then
+                redis.call("LREM", failedList, 1, taskKey)
+            end
+            table.insert(removed, taskKey)
+        end
+        redis.call("ZREM", toDelSet, unpack(resp))
+    end
+end
+local successLen = tonumber(redis.call("LLEN", successList))
+local failedLen = tonumber(redis.call("LLEN", failedList))
+--
+if successLen > startPos then
+    local resp1 = redis.call("LRANGE", successList, startPos, endPos)
+    for _, taskKey in ipairs(resp1) do
+        if redis.call("EXISTS", taskKey) == 0 then
+            redis.call("LREM", successList, 1, taskKey)
+            table.insert(removed, taskKey)
+        end
+    end
+    if endPos+1 < successLen then
+        nextStartPos = endPos+1
+    end
+end
+if failedLen > startPos then
+    local resp1 = redis.call("LRANGE", failedList, startPos, endPos)
+    for _, taskKey in ipairs(resp1) do
+        if redis.call("EXISTS", taskKey) == 0 then
+            redis.call("LREM", failedList, 1, taskKey)
+            table.insert(removed, taskKey)
+        end
+    end
+    if endPos+1 < failedLen then
+        nextStartPos = endPos+1
+    end
+end
+local refs = {}
+for _, taskKey in ipairs(removed) do
+    local ref = redis.call("HGET", blobs, taskKey)
+    if ref then
+        redis.call("HDEL", blobs, taskKey)
+        table.insert(refs, ref)
+    end
+end
+return {nextStartPos, refs}`
+
+// -- KEYS[1] -> acornq:sema:{name}
+// -- ARGV[1] -> max leases
+// -- ARGV[2] -> lease holder, task key
+// -- ARGV[3] -> lease expire at unix timestamp seconds
+// -- return -> 1 if lease is acquired or refreshed, 0 if all leases are taken
+var acquireSemaphoreLuaScript = `local sema = KEYS[1]
+local limit = tonumber(ARGV[1])
+local holder = ARGV[2]
+local expireAt = tonumber(ARGV[3])
+local now = tonumber(redis.call("TIME")[1])
+--- drop expired leases
+redis.call("ZREMRANGEBYSCORE", sema, "-inf", now)
+if redis.call("ZSCORE", sema, holder) or redis.call("ZCARD", sema) < limit then
+    redis.call("ZADD", sema, expireAt, holder)
+    return 1
+end
+return 0`
+
+// -- KEYS[1] -> asynq:{queueName}:pending
+// -- KEYS[2..n] -> asynq:{queueName}:t:taskID
+// -- ARGV[1] -> asynq:{queueName}:notify channel
+// -- ARGV[2..n] -> for every task, count of fields followed by field value pairs
+var enqueuePendingHashLuaScript = `local pending = KEYS[1]
+local j = 2
+for i=2, #KEYS do
+    local n = tonumber(ARGV[j])
+    redis.call("DEL", KEYS[i])
+    redis.call("HSET", KEYS[i], unpack(ARGV, j + 1, j + n * 2))
+    j = j + n * 2 + 1
+    redis.call("LPUSH", pending, KEYS[i])
+end
+redis.call("PUBLISH", ARGV[1], #KEYS-1)
+return redis.status_reply("OK")`
+
+// -- KEYS[1] -> asynq:{queueName}:scheduled
+// -- KEYS[2..n] -> asynq:{queueName}:t:taskID
+// -- ARGV[1..n] -> for every task, count of fields followed by field value pairs
+var enqueueScheduledHashLuaScript = `local scheduled = KEYS[1]
+local j = 1
+for i=2, #KEYS do
+    local n = tonumber(ARGV[j])
+    local startAt
+    for k = j + 1, j + n * 2, 2 do
+        if ARGV[k] == "start_at" then
+            startAt = ARGV[k + 1]
+        end
+    end
+    redis.call("DEL", KEYS[i])
+    redis.call("HSET", KEYS[i], unpack(ARGV, j + 1, j + n * 2))
+    j = j + n * 2 + 1
+    if startAt then
+        redis.call("ZADD", scheduled, startAt, KEYS[i])
+    end
+end
+return redis.status_reply("OK")`
+
+// -- PickTasks of hash layout, see pickTasks.lua.
+// -- KEYS[1] -> asynq:{queueName}:pending
+// -- KEYS[2] -> asynq:{queueName}:active
+// -- KEYS[3] -> asynq:{queueName}:scheduled
+// -- KEYS[4] -> asynq:{queueName}:retry
+// -- KEYS[5] -> asynq:{queueName}:maxactive
+// -- KEYS[6] -> asynq:{queueName}:ratelimit
+// -- ARGV[1] -> task count
+// -- ARGV[2] -> pending state
+// -- ARGV[3] -> active state
+// -- ARGV[4] -> asynq:{queueName}:notify channel
+// -- ARGV[5] -> scheduled state
+// -- return -> field value pairs of picked tasks
+var pickTasksHashLuaScript = `--- update sets fields of existing task hash, missing task is not recreated
+local function update(taskKey, ...)
+    if redis.call("EXISTS", taskKey) == 1 then
+        redis.call("HSET", taskKey, ...)
+    end
+end
+local pending = KEYS[1]
+local active = KEYS[2]
+local scheduled = KEYS[3]
+local retry = KEYS[4]
+local maxActive = tonumber(redis.call("GET", KEYS[5]))
+local limiter = KEYS[6]
+local count = tonumber(ARGV[1])
+local now = tonumber(redis.call("TIME")[1])
+local pendingState = ARGV[2]
+local activeState = ARGV[3]
+local scheduledState = ARGV[5]
+
+local move1=redis.call("ZRANGEBYSCORE",scheduled,0,now)
+if #move1 > 0 then
+    redis.call("LPUSH",pending, unpack(move1))
+    for i=1, #move1 do
+        update(move1[i], "pending_at", now, "state", pendingState)
+    end
+    redis.call("ZREM",scheduled, unpack(move1))
+end
+local move2=redis.call("ZRANGEBYSCORE",retry,0,now)
+if #move2 > 0 then
+    redis.call("LPUSH",pending, unpack(move2))
+    for i=1, #move2 do
+        update(move2[i], "pending_at", now, "state", pendingState)
+    end
+    redis.call("ZREM",retry, unpack(move2))
+end
+--- wake other idle workers for due tasks beyond count
+if #move1 + #move2 > count then
+    redis.call("PUBLISH", ARGV[4], #move1 + #move2 - count)
+end
+local result ={}
+--- cluster-wide limit of active tasks
+if maxActive then
+    count = math.min(count, maxActive - redis.call("LLEN", active))
+end
+local limited = redis.call("EXISTS", limiter) == 1
+local nowMs = 0
+if limited then
+    local t = redis.call("TIME")
+    nowMs = tonumber(t[1]) * 1000 + math.floor(tonumber(t[2]) / 1000)
+end
+--- token bucket of fields with prefix in limiter, nil if not limited
+local function bucket(prefix)
+    local v = redis.call("HMGET", limiter, prefix.."rate", prefix.."burst", prefix.."tokens", prefix.."ts")
+    local rate = tonumber(v[1])
+    if not rate or rate <= 0 then
+        return nil
+    end
+    local burst = tonumber(v[2]) or 1
+    local tokens = tonumber(v[3]) or burst
+    local ts = tonumber(v[4]) or nowMs
+    if nowMs > ts then
+        tokens = math.min(burst, tokens + (nowMs - ts) * rate / 1000)
+    end
+    return {rate = rate, tokens = tokens}
+end
+local function take(prefix, b)
+    redis.call("HSET", limiter, prefix.."tokens", tostring(b.tokens - 1), prefix.."ts", tostring(nowMs))
+end
+local attempts = 0
+while #result < count and attempts < count + 100 do
+    attempts = attempts + 1
+    local qb
+    if limited then
+        qb = bucket("")
+        if qb and qb.tokens < 1 then
+            break
+        end
+    end
+    local taskKey = redis.call("RPOP", pending)
+    if not taskKey then
+        break
+    end
+    local deferred = false
+    if limited then
+        local taskType = redis.call("HGET", taskKey, "type")
+        if taskType then
+            local prefix = "t:"..taskType..":"
+            local tb = bucket(prefix)
+            if tb then
+                if tb.tokens < 1 then
+                    --- task type is limited, schedule it when next token is available
+                    redis.call("ZADD", scheduled, now + math.ceil((1 - tb.tokens) / tb.rate), taskKey)
+                    update(taskKey, "state", scheduledState)
+                    deferred = true
+                else
+                    take(prefix, tb)
                 end
             end
-            redis.call("ZREM", toDelSet, unpack(resp))
         end
     end
-    local successLen = tonumber(redis.call("LLEN", successList))
-    local failedLen = tonumber(redis.call("LLEN", failedList))
-    --
-    if successLen > startPos then
-        local resp1 = redis.call("LRANGE", successList, startPos, endPos)
-        for _, taskKey in ipairs(resp1) do
-            if redis.call("EXISTS", taskKey) == 0 then
-                redis.call("LREM", successList, 1, taskKey)
+    if not deferred then
+        if qb then
+            take("", qb)
+        end
+        redis.call("LPUSH", active, taskKey)
+        update(taskKey, "pending_at", now, "state", activeState)
+        local task = redis.call("HGETALL", taskKey)
+        if #task > 0 then
+            table.insert(result, task)
+        end
+    end
+end
+return result`
+
+// -- RecoveryTasks of hash layout, see recoveryTasks.lua.
+// -- KEYS[1] -> asynq:{queueName}:active
+// -- KEYS[2] -> asynq:{queueName}:live
+// -- KEYS[3] -> asynq:{queueName}:pending
+// -- ARGV[1] -> task idle duration in seconds
+// -- ARGV[2] -> pending state
+// -- ARGV[3] -> asynq:{queueName}:notify channel
+// -- return -> task keys moved back to pending list
+var recoveryTasksHashLuaScript = `local function pendingAt(task,active)
+    if redis.call("EXISTS", task) == 0 then
+        redis.call("LREM",active,1,task)
+        return
+    end
+    local v = redis.call("HGET", task, "pending_at")
+    if v then
+        return v
+    end
+end
+local function toActiveTable(l,active)
+    local result = {}
+    for i=1, #l do
+        local score = pendingAt(l[i],active)
+        if score then
+            result[l[i]] = score
+        end
+    end
+    return result
+end
+local function set2Table(s)
+    local result = {}
+    for i=1, #s, 2 do
+        result[s[i]] = s[i+1]
+    end
+    return result
+end
+local function deleteZombieActive(set1, set2,timeout,now)
+    local result = {}
+    for key in pairs(set1) do
+        if not set2[key] then
+            if now - tonumber(set1[key]) > timeout then
+                table.insert(result, key)
             end
         end
-        if endPos+1 < successLen then
-            nextStartPos = endPos+1
+    end
+    return result
+end
+local function deleteZombieLive(set1, set2)
+    local result = {}
+    for key in pairs(set1) do
+        if not set2[key] then
+            table.insert(result, key)
         end
     end
-    if failedLen > startPos then
-        local resp1 = redis.call("LRANGE", failedList, startPos, endPos)
-        for _, taskKey in ipairs(resp1) do
-            if redis.call("EXISTS", taskKey) == 0 then
-                redis.call("LREM", failedList, 1, taskKey)
+    return result
+end
+local function deleteIdleActive(set1,set2, timeout,now)
+    local result = {}
+    for key in pairs(set1) do
+        if set2[key] then
+            local score1 = tonumber(set1[key])
+            local score2 = tonumber(set2[key])
+            local score = score2
+            if score1 > score2 then
+                score = score1
+            end
+            if now -score > timeout then
+                table.insert(result, key)
+            end
+        end
+    end
+    return result
+end
+local active = KEYS[1]
+local live = KEYS[2]
+local pending = KEYS[3]
+local duration = tonumber(ARGV[1])
+local pendingState = ARGV[2]
+local liveSet = redis.call("ZRANGE",live,0,-1,"WITHSCORES")
+local activeList = redis.call("LRANGE",active,0,-1)
+if #activeList > 0 then
+    local now = tonumber(redis.call("TIME")[1])
+    local activeTable = toActiveTable(activeList,active)
+    local liveTable = set2Table(liveSet)
+    --- task in active list not in live set and idle more than duration
+    local del1 = deleteZombieActive(activeTable,liveTable,duration,now)
+    --- task in active and live, but idle more than duration
+    local del2 = deleteIdleActive(activeTable,liveTable,duration,now)
+    if #del1 > 0 then
+        redis.call("LPUSH",pending, unpack(del1))
+        for i=1, #del1 do
+            redis.call("HSET",del1[i],"state",pendingState,"pending_at",now)
+            redis.call("LREM",active,1,del1[i])
+        end
+    end
+    if #del2 > 0 then
+        redis.call("LPUSH",pending, unpack(del2))
+        for i=1, #del2 do
+            redis.call("HSET",del2[i],"state",pendingState,"pending_at",now)
+            redis.call("LREM",active,1,del2[i])
+        end
+        redis.call("ZREM",live, unpack(del2))
+    end
+    local del3 = deleteZombieLive(liveTable,activeTable)
+    if #del3 > 0 then
+        redis.call("ZREM",live, unpack(del3))
+    end
+    for i=1, #del2 do
+        table.insert(del1, del2[i])
+    end
+    if #del1 > 0 then
+        redis.call("PUBLISH", ARGV[3], #del1)
+    end
+    return del1
+end
+redis.call("DEL",live)
+return {}`
+
+// -- KEYS[1] -> asynq:{queueName}:pending
+// -- KEYS[2] -> asynq:{queueName}:active
+// -- KEYS[3..n] -> asynq:{queueName}:t:taskID
+// -- ARGV[1] -> asynq:{queueName}:notify channel
+var active2pendingHashLuaScript = `--- update sets fields of existing task hash, missing task is not recreated
+local function update(taskKey, ...)
+    if redis.call("EXISTS", taskKey) == 1 then
+        redis.call("HSET", taskKey, ...)
+    end
+end
+local pending = KEYS[1]
+local active = KEYS[2]
+local now = tonumber(redis.call("TIME")[1])
+
+redis.call('LPUSH', pending, unpack(KEYS, 3, #KEYS))
+for i=3, #KEYS do
+    redis.call('LREM', active, 1, KEYS[i])
+    update(KEYS[i], 'pending_at', now)
+end
+redis.call('PUBLISH', ARGV[1], #KEYS-2)
+return redis.status_reply("OK")`
+
+// -- RetryTasks of hash layout, see retryTasks.lua.
+// -- KEYS[1] -> asynq:{queueName}:retry
+// -- KEYS[2] -> asynq:{queueName}:active
+// -- KEYS[3..n] -> asynq:{queueName}:t:taskID
+// -- ARGV[1] -> retry state
+// -- ARGV[2] -> max attempts kept in task
+// -- ARGV[3n] -> task start at unix timestamp seconds
+// -- ARGV[3n+1] -> retried count
+// -- ARGV[3n+2] -> attempt json, empty if not recorded
+var retryTasksHashLuaScript = `local function appendAttempt(taskKey, attempt, maxAttempts)
+    if attempt == "" then
+        return
+    end
+    local seq = redis.call("HINCRBY", taskKey, "attempt_seq", 1)
+    redis.call("HSET", taskKey, "attempt:" .. seq, attempt)
+    if seq > maxAttempts then
+        redis.call("HDEL", taskKey, "attempt:" .. (seq - maxAttempts))
+    end
+end
+local retry = KEYS[1]
+local active = KEYS[2]
+local retryState = ARGV[1]
+local maxAttempts = tonumber(ARGV[2])
+local now = tonumber(redis.call("TIME")[1])
+local j = 3
+for i = 3, #KEYS do
+    local taskKey = KEYS[i]
+    local score = tonumber(ARGV[j])
+    local retriedCount = tonumber(ARGV[j + 1])
+    if redis.call("EXISTS", taskKey) == 1 then
+        appendAttempt(taskKey, ARGV[j + 2], maxAttempts)
+        redis.call("ZADD", retry, score, taskKey)
+        redis.call("HSET", taskKey, "state", retryState, "retried", retriedCount, "last_failed_at", now)
+    end
+    j = j + 3
+    redis.call("LREM", active, 1, taskKey)
+end
+return redis.status_reply("OK")`
+
+// -- KEYS[1] -> asynq:{queueName}:success or asynq:{queueName}:failed
+// -- KEYS[2] -> asynq:{queueName}:active
+// -- KEYS[3] -> asynq:{queueName}:todel
+// -- KEYS[4] -> asynq:{queueName}:blobs
+// -- KEYS[5..n] -> asynq:{queueName}:t:taskID
+// -- ARGV[1] -> archived state
+// -- ARGV[2] -> max attempts kept in task
+// -- ARGV[3] -> 1 if tasks failed else 0
+// -- ARGV[2n+2] -> task retention
+// -- ARGV[2n+3] -> attempt json, empty if not recorded
+var active2ArchiveHashLuaScript = `local function appendAttempt(taskKey, attempt, maxAttempts)
+    if attempt == "" then
+        return
+    end
+    local seq = redis.call("HINCRBY", taskKey, "attempt_seq", 1)
+    redis.call("HSET", taskKey, "attempt:" .. seq, attempt)
+    if seq > maxAttempts then
+        redis.call("HDEL", taskKey, "attempt:" .. (seq - maxAttempts))
+    end
+end
+local archive = KEYS[1]
+local active = KEYS[2]
+local todel = KEYS[3]
+local blobs = KEYS[4]
+local state = ARGV[1]
+local maxAttempts = tonumber(ARGV[2])
+local failed = ARGV[3] == "1"
+local now = tonumber(redis.call("TIME")[1])
+
+for i = 5, #KEYS do
+    local taskKey = KEYS[i]
+    local retention = tonumber(ARGV[i * 2 - 6])
+    if retention == 0 then
+        redis.call('DEL', taskKey)
+    elseif redis.call('EXISTS', taskKey) == 1 then
+        redis.call('LPUSH', archive, taskKey)
+        local ref = redis.call('HGET', taskKey, 'payload_ref')
+        if ref then
+            redis.call('HSET', blobs, taskKey, ref)
+        end
+        if retention>0 then
+            redis.call('EXPIRE', taskKey, retention)
+            redis.call('ZADD',todel,now+retention,taskKey)
+        end
+        appendAttempt(taskKey, ARGV[i * 2 - 5], maxAttempts)
+        redis.call('HSET', taskKey, 'completed_at', now, 'state', state)
+        if failed then
+            redis.call('HSET', taskKey, 'last_failed_at', now)
+        end
+    end
+    redis.call('LREM', active,1,taskKey)
+end
+return redis.status_reply("OK")`
+
+// -- KEYS[1] -> asynq:{queueName}:deadletter
+// -- KEYS[2] -> asynq:{queueName}:active
+// -- KEYS[3..n] -> asynq:{queueName}:t:taskID
+// -- ARGV[1] -> queue name
+// -- ARGV[2] -> archived failed state
+// -- ARGV[3] -> dead letter stream max length
+// -- ARGV[4] -> max attempts kept in task
+// -- ARGV[5..n] -> attempt json, empty if not recorded
+// -- return -> entries trimmed from dead letter stream
+// --- stream entry holds fields of task hash, queue field is the origin queue
+var active2DeadLetterHashLuaScript = `local function appendAttempt(taskKey, attempt, maxAttempts)
+    if attempt == "" then
+        return
+    end
+    local seq = redis.call("HINCRBY", taskKey, "attempt_seq", 1)
+    redis.call("HSET", taskKey, "attempt:" .. seq, attempt)
+    if seq > maxAttempts then
+        redis.call("HDEL", taskKey, "attempt:" .. (seq - maxAttempts))
+    end
+end
+local deadLetter = KEYS[1]
+local active = KEYS[2]
+local state = ARGV[2]
+local maxLen = ARGV[3]
+local maxAttempts = tonumber(ARGV[4])
+local now = tonumber(redis.call("TIME")[1])
+for i=3, #KEYS do
+    local taskKey = KEYS[i]
+    if redis.call("EXISTS", taskKey) == 1 then
+        appendAttempt(taskKey, ARGV[i + 2], maxAttempts)
+        redis.call("HSET", taskKey, "state", state, "completed_at", now, "last_failed_at", now)
+        local task = redis.call("HGETALL", taskKey)
+        redis.call("XADD", deadLetter, "*", unpack(task))
+        redis.call("DEL", taskKey)
+    end
+    redis.call("LREM", active, 1, taskKey)
+end
+--- entries over max length are trimmed exactly and returned, their payload blobs are deleted by caller
+local trimmed = {}
+local n = redis.call("XLEN", deadLetter) - tonumber(maxLen)
+if n > 0 then
+    trimmed = redis.call("XRANGE", deadLetter, "-", "+", "COUNT", n)
+    redis.call("XTRIM", deadLetter, "MAXLEN", maxLen)
+end
+return trimmed`
+
+// -- KEYS[1] -> asynq:{queueName}:deadletter
+// -- KEYS[2] -> asynq:{queueName}:pending
+// -- KEYS[3..n] -> asynq:{queueName}:t:taskID
+// -- ARGV[1] -> asynq:{queueName}:notify channel
+// -- ARGV[2] -> pending state
+// -- ARGV[3..n] -> dead letter entry id of task
+// -- return -> count of replayed tasks
+var replayDeadLetterHashLuaScript = `local deadLetter = KEYS[1]
+local pending = KEYS[2]
+local pendingState = ARGV[2]
+local now = tonumber(redis.call("TIME")[1])
+local n = 0
+for i=3, #KEYS do
+    local taskKey = KEYS[i]
+    local entries = redis.call("XRANGE", deadLetter, ARGV[i], ARGV[i])
+    if #entries > 0 then
+        redis.call("DEL", taskKey)
+        redis.call("HSET", taskKey, unpack(entries[1][2]))
+        redis.call("HSET", taskKey, "state", pendingState, "retried", 0, "pending_at", now)
+        redis.call("LPUSH", pending, taskKey)
+        redis.call("XDEL", deadLetter, ARGV[i])
+        n = n + 1
+    end
+end
+if n > 0 then
+    redis.call("PUBLISH", ARGV[1], n)
+end
+return n`
+
+// -- helpers shared by stream scripts, they are prepended to every stream script.
+// -- ARGV[1] -> storage layout of task keys, json or hash
+var streamLayoutLuaScript = `local hashLayout = ARGV[1] == "hash"
+--- setFields sets field value pairs of existing task, missing task is not recreated
+local function setFields(taskKey, ...)
+    if redis.call("EXISTS", taskKey) == 0 then
+        return
+    end
+    if hashLayout then
+        redis.call("HSET", taskKey, ...)
+        return
+    end
+    local fv = {...}
+    for i=1, #fv, 2 do
+        redis.call("JSON.SET", taskKey, "$."..fv[i], fv[i + 1])
+    end
+end
+--- getField returns a field of task, nil if task or field not exists
+local function getField(taskKey, field)
+    if hashLayout then
+        return redis.call("HGET", taskKey, field)
+    end
+    local v = redis.call("JSON.GET", taskKey, "$."..field)
+    if v then
+        return cjson.decode(v)[1]
+    end
+end
+--- getTask returns json document or field value pairs of task, nil if task not exists
+local function getTask(taskKey)
+    if hashLayout then
+        local task = redis.call("HGETALL", taskKey)
+        if #task > 0 then
+            return task
+        end
+        return
+    end
+    local task = redis.call("JSON.GET", taskKey)
+    if task then
+        return task
+    end
+end
+--- requeue adds task to the end of stream as pending
+local function requeue(stream, taskKey, pendingState, now)
+    setFields(taskKey, "state", pendingState, "pending_at", now)
+    redis.call("XADD", stream, "*", "task", taskKey)
+end
+`
+
+// -- KEYS[1] -> asynq:{queueName}:stream
+// -- KEYS[2..n] -> asynq:{queueName}:t:taskID
+// -- ARGV[1] -> storage layout, json or hash
+// -- ARGV[2..n] -> for every task, json document or count of fields followed by field value pairs
+var streamEnqueueLuaScript = `local stream = KEYS[1]
+local j = 2
+for i=2, #KEYS do
+    if hashLayout then
+        local n = tonumber(ARGV[j])
+        redis.call("DEL", KEYS[i])
+        redis.call("HSET", KEYS[i], unpack(ARGV, j + 1, j + n * 2))
+        j = j + n * 2 + 1
+    else
+        redis.call("JSON.SET", KEYS[i], "$", ARGV[j])
+        j = j + 1
+    end
+    redis.call("XADD", stream, "*", "task", KEYS[i])
+end
+return redis.status_reply("OK")`
+
+// -- PickTasks of stream mode, see pickTasks.lua.
+// -- KEYS[1] -> asynq:{queueName}:stream
+// -- KEYS[2] -> asynq:{queueName}:pending
+// -- KEYS[3] -> asynq:{queueName}:scheduled
+// -- KEYS[4] -> asynq:{queueName}:retry
+// -- KEYS[5] -> asynq:{queueName}:maxactive
+// -- KEYS[6] -> asynq:{queueName}:ratelimit
+// -- ARGV[1] -> storage layout, json or hash
+// -- ARGV[2] -> consumer group
+// -- ARGV[3] -> consumer name
+// -- ARGV[4] -> task count
+// -- ARGV[5] -> pending state
+// -- ARGV[6] -> active state
+// -- ARGV[7] -> scheduled state
+// -- return -> stream entry id and task of picked tasks
+var streamPickLuaScript = `local stream = KEYS[1]
+local pending = KEYS[2]
+local scheduled = KEYS[3]
+local retry = KEYS[4]
+local maxActive = tonumber(redis.call("GET", KEYS[5]))
+local limiter = KEYS[6]
+local group = ARGV[2]
+local consumer = ARGV[3]
+local count = tonumber(ARGV[4])
+local pendingState = ARGV[5]
+local activeState = ARGV[6]
+local scheduledState = ARGV[7]
+local now = tonumber(redis.call("TIME")[1])
+--- group is created on first pick, entries added before it are delivered too
+redis.pcall("XGROUP", "CREATE", stream, group, "0", "MKSTREAM")
+
+for _, key in ipairs({scheduled, retry}) do
+    local move = redis.call("ZRANGEBYSCORE", key, 0, now)
+    if #move > 0 then
+        for i=1, #move do
+            requeue(stream, move[i], pendingState, now)
+        end
+        redis.call("ZREM", key, unpack(move))
+    end
+end
+--- tasks replayed from dead letter queue or enqueued before stream mode
+while true do
+    local taskKey = redis.call("RPOP", pending)
+    if not taskKey then
+        break
+    end
+    requeue(stream, taskKey, pendingState, now)
+end
+local result = {}
+--- cluster-wide limit of active tasks, delivered but not acknowledged entries
+if maxActive then
+    count = math.min(count, maxActive - redis.call("XPENDING", stream, group)[1])
+end
+local limited = redis.call("EXISTS", limiter) == 1
+local nowMs = 0
+if limited then
+    local t = redis.call("TIME")
+    nowMs = tonumber(t[1]) * 1000 + math.floor(tonumber(t[2]) / 1000)
+end
+--- token bucket of fields with prefix in limiter, nil if not limited
+local function bucket(prefix)
+    local v = redis.call("HMGET", limiter, prefix.."rate", prefix.."burst", prefix.."tokens", prefix.."ts")
+    local rate = tonumber(v[1])
+    if not rate or rate <= 0 then
+        return nil
+    end
+    local burst = tonumber(v[2]) or 1
+    local tokens = tonumber(v[3]) or burst
+    local ts = tonumber(v[4]) or nowMs
+    if nowMs > ts then
+        tokens = math.min(burst, tokens + (nowMs - ts) * rate / 1000)
+    end
+    return {rate = rate, tokens = tokens}
+end
+local function take(prefix, b)
+    redis.call("HSET", limiter, prefix.."tokens", tostring(b.tokens - 1), prefix.."ts", tostring(nowMs))
+end
+local function drop(id)
+    redis.call("XACK", stream, group, id)
+    redis.call("XDEL", stream, id)
+end
+local attempts = 0
+while #result < count and attempts < count + 100 do
+    attempts = attempts + 1
+    local qb
+    if limited then
+        qb = bucket("")
+        if qb and qb.tokens < 1 then
+            break
+        end
+    end
+    local entries = redis.call("XREADGROUP", "GROUP", group, consumer, "COUNT", 1, "STREAMS", stream, ">")
+    --- no new entries is a nil reply, which is false or an empty table in lua
+    if not entries or #entries == 0 then
+        break
+    end
+    local entry = entries[1][2][1]
+    local id = entry[1]
+    local taskKey = entry[2][2]
+    local deferred = redis.call("EXISTS", taskKey) == 0
+    if deferred then
+        drop(id)
+    elseif limited then
+        local taskType = getField(taskKey, "type")
+        if taskType then
+            local prefix = "t:"..taskType..":"
+            local tb = bucket(prefix)
+            if tb then
+                if tb.tokens < 1 then
+                    --- task type is limited, schedule it when next token is available
+                    drop(id)
+                    redis.call("ZADD", scheduled, now + math.ceil((1 - tb.tokens) / tb.rate), taskKey)
+                    setFields(taskKey, "state", scheduledState)
+                    deferred = true
+                else
+                    take(prefix, tb)
+                end
             end
         end
-        if endPos+1 < failedLen then
-            nextStartPos = endPos+1
+    end
+    if not deferred then
+        if qb then
+            take("", qb)
         end
+        setFields(taskKey, "pending_at", now, "state", activeState)
+        table.insert(result, {id, getTask(taskKey)})
+    end
+end
+return result`
+
+// -- Active2Pending of stream mode, acknowledges entries of tasks and adds them to stream again.
+// -- KEYS[1] -> asynq:{queueName}:stream
+// -- KEYS[2..n] -> asynq:{queueName}:t:taskID
+// -- ARGV[1] -> storage layout, json or hash
+// -- ARGV[2] -> consumer group
+// -- ARGV[3] -> pending state
+// -- ARGV[4..n] -> stream entry id of task
+var streamRequeueLuaScript = `local stream = KEYS[1]
+local group = ARGV[2]
+local now = tonumber(redis.call("TIME")[1])
+for i=2, #KEYS do
+    redis.call("XACK", stream, group, ARGV[i + 2])
+    redis.call("XDEL", stream, ARGV[i + 2])
+    if redis.call("EXISTS", KEYS[i]) == 1 then
+        requeue(stream, KEYS[i], ARGV[3], now)
     end
 end
-return nextStartPos`
+return redis.status_reply("OK")`
+
+// -- RecoveryTasks of stream mode, see recoveryTasks.lua.
+// -- KEYS[1] -> asynq:{queueName}:stream
+// -- ARGV[1] -> storage layout, json or hash
+// -- ARGV[2] -> consumer group
+// -- ARGV[3] -> consumer name of recovery
+// -- ARGV[4] -> task idle duration in milliseconds
+// -- ARGV[5] -> pending state
+// -- ARGV[6] -> active state
+// -- return -> task keys added to stream again
+var streamRecoveryLuaScript = `local stream = KEYS[1]
+local group = ARGV[2]
+local consumer = ARGV[3]
+local idle = tonumber(ARGV[4])
+local pendingState = ARGV[5]
+local activeState = tonumber(ARGV[6])
+local now = tonumber(redis.call("TIME")[1])
+redis.pcall("XGROUP", "CREATE", stream, group, "0", "MKSTREAM")
+local result = {}
+--- entries delivered but not acknowledged for idle, their consumers are gone or stuck
+local claimed = redis.call("XAUTOCLAIM", stream, group, consumer, idle, "0-0", "COUNT", 1000)
+for _, entry in ipairs(claimed[2]) do
+    local id = entry[1]
+    local fields = entry[2]
+    redis.call("XACK", stream, group, id)
+    redis.call("XDEL", stream, id)
+    --- fields of deleted entries are nil
+    if fields then
+        local taskKey = fields[2]
+        --- entries of retried or archived tasks are left by a broken acknowledgement
+        if tonumber(getField(taskKey, "state")) == activeState then
+            requeue(stream, taskKey, pendingState, now)
+            table.insert(result, taskKey)
+        end
+    end
+end
+--- consumers of stopped servers
+local consumers = redis.call("XINFO", "CONSUMERS", stream, group)
+for _, c in ipairs(consumers) do
+    local info = {}
+    for i=1, #c, 2 do
+        info[c[i]] = c[i + 1]
+    end
+    if info["pending"] == 0 and tonumber(info["idle"]) > idle then
+        redis.call("XGROUP", "DELCONSUMER", stream, group, info["name"])
+    end
+end
+return result`
+
+// -- KEYS[1] -> asynq:{queueName}:t:taskID
+// -- ARGV[1] -> type of key in source layout, ReJSON-RL or hash
+// -- ARGV[2] -> target layout, json or hash
+// -- ARGV[3..n] -> json document, or field value pairs of task hash
+// -- return -> 1 if key is rewritten, 0 if it expired or is migrated already
+var migrateTaskLuaScript = `local key = KEYS[1]
+if redis.call("TYPE", key)["ok"] ~= ARGV[1] then
+    return 0
+end
+local ttl = redis.call("PTTL", key)
+redis.call("DEL", key)
+if ARGV[2] == "hash" then
+    redis.call("HSET", key, unpack(ARGV, 3))
+else
+    redis.call("JSON.SET", key, "$", ARGV[3])
+end
+if ttl > 0 then
+    redis.call("PEXPIRE", key, ttl)
+end
+return 1`
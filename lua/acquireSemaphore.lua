@@ -0,0 +1,17 @@
+-- KEYS[1] -> acornq:sema:{name}
+-- ARGV[1] -> max leases
+-- ARGV[2] -> lease holder, task key
+-- ARGV[3] -> lease expire at unix timestamp seconds
+-- return -> 1 if lease is acquired or refreshed, 0 if all leases are taken
+local sema = KEYS[1]
+local limit = tonumber(ARGV[1])
+local holder = ARGV[2]
+local expireAt = tonumber(ARGV[3])
+local now = tonumber(redis.call("TIME")[1])
+--- drop expired leases
+redis.call("ZREMRANGEBYSCORE", sema, "-inf", now)
+if redis.call("ZSCORE", sema, holder) or redis.call("ZCARD", sema) < limit then
+    redis.call("ZADD", sema, expireAt, holder)
+    return 1
+end
+return 0
\ No newline at end of file
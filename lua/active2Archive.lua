@@ -1,23 +1,54 @@
 -- KEYS[1] -> asynq:{queueName}:success or asynq:{queueName}:failed
 -- KEYS[2] -> asynq:{queueName}:active
--- KEYS[3..n] -> asynq:{queueName}:t:taskID
--- ARGV[2..n] -> task retention
+-- KEYS[3] -> asynq:{queueName}:todel
+-- KEYS[4] -> asynq:{queueName}:blobs
+-- KEYS[5..n] -> asynq:{queueName}:t:taskID
+-- ARGV[1] -> archived state
+-- ARGV[2] -> max attempts kept in task
+-- ARGV[3] -> 1 if tasks failed else 0
+-- ARGV[2n+2] -> task retention
+-- ARGV[2n+3] -> attempt json, empty if not recorded
+local function appendAttempt(taskKey, attempt, maxAttempts)
+    if attempt == "" then
+        return
+    end
+    local n = redis.call("JSON.ARRAPPEND", taskKey, "$.attempts", attempt)[1]
+    if not n then
+        redis.call("JSON.SET", taskKey, "$.attempts", "[" .. attempt .. "]")
+    elseif n > maxAttempts then
+        redis.call("JSON.ARRTRIM", taskKey, "$.attempts", n - maxAttempts, n - 1)
+    end
+end
 local archive = KEYS[1]
 local active = KEYS[2]
 local todel = KEYS[3]
+local blobs = KEYS[4]
 local state = ARGV[1]
+local maxAttempts = tonumber(ARGV[2])
+local failed = ARGV[3] == "1"
 local now = tonumber(redis.call("TIME")[1])
 
-for i = 2, #ARGV do
-    local taskKey = KEYS[i + 2]
-    local retention = tonumber(ARGV[i])
+for i = 5, #KEYS do
+    local taskKey = KEYS[i]
+    local retention = tonumber(ARGV[i * 2 - 6])
     if retention~=0 then
         redis.call('LPUSH', archive, taskKey)
+        local ref = redis.call('JSON.GET', taskKey, '$.payload_ref')
+        if ref then
+            ref = cjson.decode(ref)[1]
+            if ref then
+                redis.call('HSET', blobs, taskKey, ref)
+            end
+        end
         if retention>0 then
             redis.call('EXPIRE', taskKey, retention)
             redis.call('ZADD',todel,now+retention,taskKey)
         end
+        appendAttempt(taskKey, ARGV[i * 2 - 5], maxAttempts)
         redis.call('JSON.MSET', taskKey, '$.completed_at', now, taskKey, '$.state', state)
+        if failed then
+            redis.call('JSON.SET', taskKey, '$.last_failed_at', now)
+        end
     else
         redis.call('DEL', taskKey)
     end
@@ -0,0 +1,46 @@
+-- KEYS[1] -> asynq:{queueName}:deadletter
+-- KEYS[2] -> asynq:{queueName}:active
+-- KEYS[3..n] -> asynq:{queueName}:t:taskID
+-- ARGV[1] -> queue name
+-- ARGV[2] -> archived failed state
+-- ARGV[3] -> dead letter stream max length
+-- ARGV[4] -> max attempts kept in task
+-- ARGV[5..n] -> attempt json, empty if not recorded
+-- return -> entries trimmed from dead letter stream
+local function appendAttempt(taskKey, attempt, maxAttempts)
+    if attempt == "" then
+        return
+    end
+    local n = redis.call("JSON.ARRAPPEND", taskKey, "$.attempts", attempt)[1]
+    if not n then
+        redis.call("JSON.SET", taskKey, "$.attempts", "[" .. attempt .. "]")
+    elseif n > maxAttempts then
+        redis.call("JSON.ARRTRIM", taskKey, "$.attempts", n - maxAttempts, n - 1)
+    end
+end
+local deadLetter = KEYS[1]
+local active = KEYS[2]
+local queue = ARGV[1]
+local state = ARGV[2]
+local maxLen = ARGV[3]
+local maxAttempts = tonumber(ARGV[4])
+local now = tonumber(redis.call("TIME")[1])
+for i=3, #KEYS do
+    local taskKey = KEYS[i]
+    if redis.call("EXISTS", taskKey) == 1 then
+        appendAttempt(taskKey, ARGV[i + 2], maxAttempts)
+        redis.call("JSON.MSET", taskKey, "$.state", state, taskKey, "$.completed_at", now, taskKey, "$.last_failed_at", now)
+        local task = redis.call("JSON.GET", taskKey)
+        redis.call("XADD", deadLetter, "*", "queue", queue, "task", task)
+        redis.call("DEL", taskKey)
+    end
+    redis.call("LREM", active, 1, taskKey)
+end
+--- entries over max length are trimmed exactly and returned, their payload blobs are deleted by caller
+local trimmed = {}
+local n = redis.call("XLEN", deadLetter) - tonumber(maxLen)
+if n > 0 then
+    trimmed = redis.call("XRANGE", deadLetter, "-", "+", "COUNT", n)
+    redis.call("XTRIM", deadLetter, "MAXLEN", maxLen)
+end
+return trimmed
\ No newline at end of file
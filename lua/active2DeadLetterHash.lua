@@ -0,0 +1,45 @@
+-- KEYS[1] -> asynq:{queueName}:deadletter
+-- KEYS[2] -> asynq:{queueName}:active
+-- KEYS[3..n] -> asynq:{queueName}:t:taskID
+-- ARGV[1] -> queue name
+-- ARGV[2] -> archived failed state
+-- ARGV[3] -> dead letter stream max length
+-- ARGV[4] -> max attempts kept in task
+-- ARGV[5..n] -> attempt json, empty if not recorded
+-- return -> entries trimmed from dead letter stream
+--- stream entry holds fields of task hash, queue field is the origin queue
+local function appendAttempt(taskKey, attempt, maxAttempts)
+    if attempt == "" then
+        return
+    end
+    local seq = redis.call("HINCRBY", taskKey, "attempt_seq", 1)
+    redis.call("HSET", taskKey, "attempt:" .. seq, attempt)
+    if seq > maxAttempts then
+        redis.call("HDEL", taskKey, "attempt:" .. (seq - maxAttempts))
+    end
+end
+local deadLetter = KEYS[1]
+local active = KEYS[2]
+local state = ARGV[2]
+local maxLen = ARGV[3]
+local maxAttempts = tonumber(ARGV[4])
+local now = tonumber(redis.call("TIME")[1])
+for i=3, #KEYS do
+    local taskKey = KEYS[i]
+    if redis.call("EXISTS", taskKey) == 1 then
+        appendAttempt(taskKey, ARGV[i + 2], maxAttempts)
+        redis.call("HSET", taskKey, "state", state, "completed_at", now, "last_failed_at", now)
+        local task = redis.call("HGETALL", taskKey)
+        redis.call("XADD", deadLetter, "*", unpack(task))
+        redis.call("DEL", taskKey)
+    end
+    redis.call("LREM", active, 1, taskKey)
+end
+--- entries over max length are trimmed exactly and returned, their payload blobs are deleted by caller
+local trimmed = {}
+local n = redis.call("XLEN", deadLetter) - tonumber(maxLen)
+if n > 0 then
+    trimmed = redis.call("XRANGE", deadLetter, "-", "+", "COUNT", n)
+    redis.call("XTRIM", deadLetter, "MAXLEN", maxLen)
+end
+return trimmed
\ No newline at end of file
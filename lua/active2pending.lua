@@ -1,6 +1,7 @@
 -- KEYS[1] -> asynq:{queueName}:pending
 -- KEYS[2] -> asynq:{queueName}:active
 -- KEYS[3..n] -> asynq:{queueName}:t:taskID
+-- ARGV[1] -> asynq:{queueName}:notify channel
 local pending = KEYS[1]
 local active = KEYS[2]
 local now = tonumber(redis.call("TIME")[1])
@@ -10,4 +11,5 @@ for i=3, #KEYS do
         redis.call('LREM', active, 1, KEYS[i])
         redis.call('json.set', KEYS[i], '$.pending_at', now)
 end
+redis.call('PUBLISH', ARGV[1], #KEYS-2)
 return redis.status_reply("OK")
\ No newline at end of file
@@ -0,0 +1,21 @@
+-- KEYS[1] -> asynq:{queueName}:pending
+-- KEYS[2] -> asynq:{queueName}:active
+-- KEYS[3..n] -> asynq:{queueName}:t:taskID
+-- ARGV[1] -> asynq:{queueName}:notify channel
+--- update sets fields of existing task hash, missing task is not recreated
+local function update(taskKey, ...)
+    if redis.call("EXISTS", taskKey) == 1 then
+        redis.call("HSET", taskKey, ...)
+    end
+end
+local pending = KEYS[1]
+local active = KEYS[2]
+local now = tonumber(redis.call("TIME")[1])
+
+redis.call('LPUSH', pending, unpack(KEYS, 3, #KEYS))
+for i=3, #KEYS do
+    redis.call('LREM', active, 1, KEYS[i])
+    update(KEYS[i], 'pending_at', now)
+end
+redis.call('PUBLISH', ARGV[1], #KEYS-2)
+return redis.status_reply("OK")
\ No newline at end of file
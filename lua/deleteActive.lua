@@ -0,0 +1,8 @@
+-- KEYS[1] -> asynq:{queueName}:active
+-- KEYS[2..n] -> asynq:{queueName}:t:taskID
+local active = KEYS[1]
+for i=2, #KEYS do
+    redis.call('LREM', active, 1, KEYS[i])
+    redis.call('DEL', KEYS[i])
+end
+return redis.status_reply("OK")
\ No newline at end of file
@@ -1,10 +1,12 @@
 -- KEYS[1] -> asynq:{queueName}:pending
 --- KEYS[2..n] -> asynq:{queueName}:t:taskID
---- ARGV[1..n] -> task json encoded data
+--- ARGV[1] -> asynq:{queueName}:notify channel
+--- ARGV[2..n] -> task json encoded data
 ---
 local pending = KEYS[1]
-for i=1, #ARGV do
-redis.call('json.set', KEYS[i+1],'$', ARGV[i])
-redis.call('LPUSH',pending, KEYS[i+1])
+for i=2, #ARGV do
+redis.call('json.set', KEYS[i],'$', ARGV[i])
+redis.call('LPUSH',pending, KEYS[i])
 end
+redis.call('PUBLISH', ARGV[1], #ARGV-1)
 return redis.status_reply("OK")
\ No newline at end of file
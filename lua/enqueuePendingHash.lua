@@ -0,0 +1,15 @@
+-- KEYS[1] -> asynq:{queueName}:pending
+-- KEYS[2..n] -> asynq:{queueName}:t:taskID
+-- ARGV[1] -> asynq:{queueName}:notify channel
+-- ARGV[2..n] -> for every task, count of fields followed by field value pairs
+local pending = KEYS[1]
+local j = 2
+for i=2, #KEYS do
+    local n = tonumber(ARGV[j])
+    redis.call("DEL", KEYS[i])
+    redis.call("HSET", KEYS[i], unpack(ARGV, j + 1, j + n * 2))
+    j = j + n * 2 + 1
+    redis.call("LPUSH", pending, KEYS[i])
+end
+redis.call("PUBLISH", ARGV[1], #KEYS-1)
+return redis.status_reply("OK")
\ No newline at end of file
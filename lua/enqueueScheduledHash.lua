@@ -0,0 +1,21 @@
+-- KEYS[1] -> asynq:{queueName}:scheduled
+-- KEYS[2..n] -> asynq:{queueName}:t:taskID
+-- ARGV[1..n] -> for every task, count of fields followed by field value pairs
+local scheduled = KEYS[1]
+local j = 1
+for i=2, #KEYS do
+    local n = tonumber(ARGV[j])
+    local startAt
+    for k = j + 1, j + n * 2, 2 do
+        if ARGV[k] == "start_at" then
+            startAt = ARGV[k + 1]
+        end
+    end
+    redis.call("DEL", KEYS[i])
+    redis.call("HSET", KEYS[i], unpack(ARGV, j + 1, j + n * 2))
+    j = j + n * 2 + 1
+    if startAt then
+        redis.call("ZADD", scheduled, startAt, KEYS[i])
+    end
+end
+return redis.status_reply("OK")
\ No newline at end of file
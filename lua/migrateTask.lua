@@ -0,0 +1,20 @@
+-- KEYS[1] -> asynq:{queueName}:t:taskID
+-- ARGV[1] -> type of key in source layout, ReJSON-RL or hash
+-- ARGV[2] -> target layout, json or hash
+-- ARGV[3..n] -> json document, or field value pairs of task hash
+-- return -> 1 if key is rewritten, 0 if it expired or is migrated already
+local key = KEYS[1]
+if redis.call("TYPE", key)["ok"] ~= ARGV[1] then
+    return 0
+end
+local ttl = redis.call("PTTL", key)
+redis.call("DEL", key)
+if ARGV[2] == "hash" then
+    redis.call("HSET", key, unpack(ARGV, 3))
+else
+    redis.call("JSON.SET", key, "$", ARGV[3])
+end
+if ttl > 0 then
+    redis.call("PEXPIRE", key, ttl)
+end
+return 1
\ No newline at end of file
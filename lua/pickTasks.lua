@@ -7,18 +7,25 @@
 --- KEYS[2] -> asynq:{queueName}:active
 --- KEYS[3] -> asynq:{queueName}:scheduled
 --- KEYS[4] -> asynq:{queueName}:retry
+--- KEYS[5] -> asynq:{queueName}:maxactive
+--- KEYS[6] -> asynq:{queueName}:ratelimit
 --- ARGV[1] -> task count
 --- ARGV[2] -> pending state
 --- ARGV[3] -> active state
+--- ARGV[4] -> asynq:{queueName}:notify channel
+--- ARGV[5] -> scheduled state
 ---
 local pending = KEYS[1]
 local active = KEYS[2]
 local scheduled = KEYS[3]
 local retry = KEYS[4]
+local maxActive = tonumber(redis.call("GET", KEYS[5]))
+local limiter = KEYS[6]
 local count = tonumber(ARGV[1])
 local now = tonumber(redis.call("TIME")[1])
 local pendingState = ARGV[2]
 local activeState = ARGV[3]
+local scheduledState = ARGV[5]
 
 local move1=redis.call("ZRANGEBYSCORE",scheduled,0,now)
 if #move1 > 0 then
@@ -38,16 +45,81 @@ if #move2 > 0 then
     end
     redis.call("ZREM",retry, unpack(move2))
 end
+--- wake other idle workers for due tasks beyond count
+if #move1 + #move2 > count then
+    redis.call("PUBLISH", ARGV[4], #move1 + #move2 - count)
+end
 local result ={}
-for _=1,count do
-    local taskKey = redis.call("RPOPLPUSH",pending,active)
+--- cluster-wide limit of active tasks
+if maxActive then
+    count = math.min(count, maxActive - redis.call("LLEN", active))
+end
+local limited = redis.call("EXISTS", limiter) == 1
+local nowMs = 0
+if limited then
+    local t = redis.call("TIME")
+    nowMs = tonumber(t[1]) * 1000 + math.floor(tonumber(t[2]) / 1000)
+end
+--- token bucket of fields with prefix in limiter, nil if not limited
+local function bucket(prefix)
+    local v = redis.call("HMGET", limiter, prefix.."rate", prefix.."burst", prefix.."tokens", prefix.."ts")
+    local rate = tonumber(v[1])
+    if not rate or rate <= 0 then
+        return nil
+    end
+    local burst = tonumber(v[2]) or 1
+    local tokens = tonumber(v[3]) or burst
+    local ts = tonumber(v[4]) or nowMs
+    if nowMs > ts then
+        tokens = math.min(burst, tokens + (nowMs - ts) * rate / 1000)
+    end
+    return {rate = rate, tokens = tokens}
+end
+local function take(prefix, b)
+    redis.call("HSET", limiter, prefix.."tokens", tostring(b.tokens - 1), prefix.."ts", tostring(nowMs))
+end
+local attempts = 0
+while #result < count and attempts < count + 100 do
+    attempts = attempts + 1
+    local qb
+    if limited then
+        qb = bucket("")
+        if qb and qb.tokens < 1 then
+            break
+        end
+    end
+    local taskKey = redis.call("RPOP", pending)
     if not taskKey then
-        return result
+        break
+    end
+    local deferred = false
+    if limited then
+        local taskType = redis.call("JSON.GET", taskKey, "$.type")
+        if taskType then
+            local prefix = "t:"..cjson.decode(taskType)[1]..":"
+            local tb = bucket(prefix)
+            if tb then
+                if tb.tokens < 1 then
+                    --- task type is limited, schedule it when next token is available
+                    redis.call("ZADD", scheduled, now + math.ceil((1 - tb.tokens) / tb.rate), taskKey)
+                    redis.call("JSON.SET", taskKey, "$.state", scheduledState)
+                    deferred = true
+                else
+                    take(prefix, tb)
+                end
+            end
+        end
     end
-    redis.call("JSON.MSET",taskKey,"$.pending_at",now,taskKey,"$.state",activeState)
-    local task = redis.call("json.get",taskKey)
-    if task then
-        table.insert(result, task)
+    if not deferred then
+        if qb then
+            take("", qb)
+        end
+        redis.call("LPUSH", active, taskKey)
+        redis.call("JSON.MSET",taskKey,"$.pending_at",now,taskKey,"$.state",activeState)
+        local task = redis.call("json.get",taskKey)
+        if task then
+            table.insert(result, task)
+        end
     end
 end
 return result
\ No newline at end of file
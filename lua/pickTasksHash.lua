@@ -0,0 +1,125 @@
+-- PickTasks of hash layout, see pickTasks.lua.
+-- KEYS[1] -> asynq:{queueName}:pending
+-- KEYS[2] -> asynq:{queueName}:active
+-- KEYS[3] -> asynq:{queueName}:scheduled
+-- KEYS[4] -> asynq:{queueName}:retry
+-- KEYS[5] -> asynq:{queueName}:maxactive
+-- KEYS[6] -> asynq:{queueName}:ratelimit
+-- ARGV[1] -> task count
+-- ARGV[2] -> pending state
+-- ARGV[3] -> active state
+-- ARGV[4] -> asynq:{queueName}:notify channel
+-- ARGV[5] -> scheduled state
+-- return -> field value pairs of picked tasks
+--- update sets fields of existing task hash, missing task is not recreated
+local function update(taskKey, ...)
+    if redis.call("EXISTS", taskKey) == 1 then
+        redis.call("HSET", taskKey, ...)
+    end
+end
+local pending = KEYS[1]
+local active = KEYS[2]
+local scheduled = KEYS[3]
+local retry = KEYS[4]
+local maxActive = tonumber(redis.call("GET", KEYS[5]))
+local limiter = KEYS[6]
+local count = tonumber(ARGV[1])
+local now = tonumber(redis.call("TIME")[1])
+local pendingState = ARGV[2]
+local activeState = ARGV[3]
+local scheduledState = ARGV[5]
+
+local move1=redis.call("ZRANGEBYSCORE",scheduled,0,now)
+if #move1 > 0 then
+    redis.call("LPUSH",pending, unpack(move1))
+    for i=1, #move1 do
+        update(move1[i], "pending_at", now, "state", pendingState)
+    end
+    redis.call("ZREM",scheduled, unpack(move1))
+end
+local move2=redis.call("ZRANGEBYSCORE",retry,0,now)
+if #move2 > 0 then
+    redis.call("LPUSH",pending, unpack(move2))
+    for i=1, #move2 do
+        update(move2[i], "pending_at", now, "state", pendingState)
+    end
+    redis.call("ZREM",retry, unpack(move2))
+end
+--- wake other idle workers for due tasks beyond count
+if #move1 + #move2 > count then
+    redis.call("PUBLISH", ARGV[4], #move1 + #move2 - count)
+end
+local result ={}
+--- cluster-wide limit of active tasks
+if maxActive then
+    count = math.min(count, maxActive - redis.call("LLEN", active))
+end
+local limited = redis.call("EXISTS", limiter) == 1
+local nowMs = 0
+if limited then
+    local t = redis.call("TIME")
+    nowMs = tonumber(t[1]) * 1000 + math.floor(tonumber(t[2]) / 1000)
+end
+--- token bucket of fields with prefix in limiter, nil if not limited
+local function bucket(prefix)
+    local v = redis.call("HMGET", limiter, prefix.."rate", prefix.."burst", prefix.."tokens", prefix.."ts")
+    local rate = tonumber(v[1])
+    if not rate or rate <= 0 then
+        return nil
+    end
+    local burst = tonumber(v[2]) or 1
+    local tokens = tonumber(v[3]) or burst
+    local ts = tonumber(v[4]) or nowMs
+    if nowMs > ts then
+        tokens = math.min(burst, tokens + (nowMs - ts) * rate / 1000)
+    end
+    return {rate = rate, tokens = tokens}
+end
+local function take(prefix, b)
+    redis.call("HSET", limiter, prefix.."tokens", tostring(b.tokens - 1), prefix.."ts", tostring(nowMs))
+end
+local attempts = 0
+while #result < count and attempts < count + 100 do
+    attempts = attempts + 1
+    local qb
+    if limited then
+        qb = bucket("")
+        if qb and qb.tokens < 1 then
+            break
+        end
+    end
+    local taskKey = redis.call("RPOP", pending)
+    if not taskKey then
+        break
+    end
+    local deferred = false
+    if limited then
+        local taskType = redis.call("HGET", taskKey, "type")
+        if taskType then
+            local prefix = "t:"..taskType..":"
+            local tb = bucket(prefix)
+            if tb then
+                if tb.tokens < 1 then
+                    --- task type is limited, schedule it when next token is available
+                    redis.call("ZADD", scheduled, now + math.ceil((1 - tb.tokens) / tb.rate), taskKey)
+                    update(taskKey, "state", scheduledState)
+                    deferred = true
+                else
+                    take(prefix, tb)
+                end
+            end
+        end
+    end
+    if not deferred then
+        if qb then
+            take("", qb)
+        end
+        redis.call("LPUSH", active, taskKey)
+        update(taskKey, "pending_at", now, "state", activeState)
+        local task = redis.call("HGETALL", taskKey)
+        if #task > 0 then
+            table.insert(result, task)
+        end
+    end
+end
+return result
\ No newline at end of file
@@ -3,6 +3,8 @@
 --- KEYS[3] -> asynq:{queueName}:pending
 --- ARGV[1] -> task idle duration in seconds
 --- ARGV[2] -> pending state
+--- ARGV[3] -> asynq:{queueName}:notify channel
+--- return -> task keys moved back to pending list
 ---
 local function pendingAt(task,active)
     local resp = redis.call("JSON.GET",task,"$.pending_at")
@@ -92,17 +94,23 @@ if #activeList > 0 then
     end
     if #del2 > 0 then
         redis.call("LPUSH",pending, unpack(del2))
-        for i=1, #del1 do
+        for i=1, #del2 do
             redis.call("JSON.MSET",del2[i],"$.state",pendingState,del2[i],"$.pending_at",now)
             redis.call("LREM",active,1,del2[i])
         end
-        redis.call("SREM",live, unpack(del2))
+        redis.call("ZREM",live, unpack(del2))
     end
     local del3 = deleteZombieLive(liveTable,activeTable)
     if #del3 > 0 then
-        redis.call("SREM",live, unpack(del3))
+        redis.call("ZREM",live, unpack(del3))
+    end
+    for i=1, #del2 do
+        table.insert(del1, del2[i])
+    end
+    if #del1 > 0 then
+        redis.call("PUBLISH", ARGV[3], #del1)
     end
-    return redis.status_reply("OK")
+    return del1
 end
 redis.call("DEL",live)
-return redis.status_reply("OK")
\ No newline at end of file
+return {}
\ No newline at end of file
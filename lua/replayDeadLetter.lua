@@ -0,0 +1,32 @@
+-- KEYS[1] -> asynq:{queueName}:deadletter
+-- KEYS[2] -> asynq:{queueName}:pending
+-- KEYS[3..n] -> asynq:{queueName}:t:taskID
+-- ARGV[1] -> asynq:{queueName}:notify channel
+-- ARGV[2] -> pending state
+-- ARGV[3..n] -> dead letter entry id of task
+-- return -> count of replayed tasks
+local deadLetter = KEYS[1]
+local pending = KEYS[2]
+local pendingState = ARGV[2]
+local now = tonumber(redis.call("TIME")[1])
+local n = 0
+for i=3, #KEYS do
+    local taskKey = KEYS[i]
+    local entries = redis.call("XRANGE", deadLetter, ARGV[i], ARGV[i])
+    if #entries > 0 then
+        local fields = entries[1][2]
+        for j=1, #fields, 2 do
+            if fields[j] == "task" then
+                redis.call("JSON.SET", taskKey, "$", fields[j+1])
+                redis.call("JSON.MSET", taskKey, "$.state", pendingState, taskKey, "$.retried", 0, taskKey, "$.pending_at", now)
+                redis.call("LPUSH", pending, taskKey)
+                n = n + 1
+            end
+        end
+        redis.call("XDEL", deadLetter, ARGV[i])
+    end
+end
+if n > 0 then
+    redis.call("PUBLISH", ARGV[1], n)
+end
+return n
\ No newline at end of file
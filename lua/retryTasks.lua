@@ -3,19 +3,35 @@
 -- KEYS[2] -> asynq:{queueName}:active
 -- KEYS[3..n] -> asynq:{queueName}:t:taskID
 -- ARGV[1] -> retry state
--- ARGV[2n] -> task start at unix timestamp seconds
--- ARGV[2n+1] -> retried count
+-- ARGV[2] -> max attempts kept in task
+-- ARGV[3n] -> task start at unix timestamp seconds
+-- ARGV[3n+1] -> retried count
+-- ARGV[3n+2] -> attempt json, empty if not recorded
+local function appendAttempt(taskKey, attempt, maxAttempts)
+    if attempt == "" then
+        return
+    end
+    local n = redis.call("JSON.ARRAPPEND", taskKey, "$.attempts", attempt)[1]
+    if not n then
+        redis.call("JSON.SET", taskKey, "$.attempts", "[" .. attempt .. "]")
+    elseif n > maxAttempts then
+        redis.call("JSON.ARRTRIM", taskKey, "$.attempts", n - maxAttempts, n - 1)
+    end
+end
 local retry = KEYS[1]
 local active = KEYS[2]
 local retryState = ARGV[1]
-local j = 2
+local maxAttempts = tonumber(ARGV[2])
+local now = tonumber(redis.call("TIME")[1])
+local j = 3
 for i = 3, #KEYS do
     local taskKey = KEYS[i]
     local score = tonumber(ARGV[j])
     local retriedCount = tonumber(ARGV[j + 1])
-    j = j + 2
+    appendAttempt(taskKey, ARGV[j + 2], maxAttempts)
+    j = j + 3
     redis.call("ZADD", retry, score, taskKey)
-    redis.call("JSON.MSET", taskKey, "$.state", retryState, taskKey, "$.retried", retriedCount)
+    redis.call("JSON.MSET", taskKey, "$.state", retryState, taskKey, "$.retried", retriedCount, taskKey, "$.last_failed_at", now)
     redis.call("LREM", active, 1, taskKey)
 end
 return redis.status_reply("OK")
\ No newline at end of file
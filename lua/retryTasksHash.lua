@@ -0,0 +1,38 @@
+-- RetryTasks of hash layout, see retryTasks.lua.
+-- KEYS[1] -> asynq:{queueName}:retry
+-- KEYS[2] -> asynq:{queueName}:active
+-- KEYS[3..n] -> asynq:{queueName}:t:taskID
+-- ARGV[1] -> retry state
+-- ARGV[2] -> max attempts kept in task
+-- ARGV[3n] -> task start at unix timestamp seconds
+-- ARGV[3n+1] -> retried count
+-- ARGV[3n+2] -> attempt json, empty if not recorded
+local function appendAttempt(taskKey, attempt, maxAttempts)
+    if attempt == "" then
+        return
+    end
+    local seq = redis.call("HINCRBY", taskKey, "attempt_seq", 1)
+    redis.call("HSET", taskKey, "attempt:" .. seq, attempt)
+    if seq > maxAttempts then
+        redis.call("HDEL", taskKey, "attempt:" .. (seq - maxAttempts))
+    end
+end
+local retry = KEYS[1]
+local active = KEYS[2]
+local retryState = ARGV[1]
+local maxAttempts = tonumber(ARGV[2])
+local now = tonumber(redis.call("TIME")[1])
+local j = 3
+for i = 3, #KEYS do
+    local taskKey = KEYS[i]
+    local score = tonumber(ARGV[j])
+    local retriedCount = tonumber(ARGV[j + 1])
+    if redis.call("EXISTS", taskKey) == 1 then
+        appendAttempt(taskKey, ARGV[j + 2], maxAttempts)
+        redis.call("ZADD", retry, score, taskKey)
+        redis.call("HSET", taskKey, "state", retryState, "retried", retriedCount, "last_failed_at", now)
+    end
+    j = j + 3
+    redis.call("LREM", active, 1, taskKey)
+end
+return redis.status_reply("OK")
\ No newline at end of file
@@ -0,0 +1,19 @@
+-- KEYS[1] -> asynq:{queueName}:stream
+-- KEYS[2..n] -> asynq:{queueName}:t:taskID
+-- ARGV[1] -> storage layout, json or hash
+-- ARGV[2..n] -> for every task, json document or count of fields followed by field value pairs
+local stream = KEYS[1]
+local j = 2
+for i=2, #KEYS do
+    if hashLayout then
+        local n = tonumber(ARGV[j])
+        redis.call("DEL", KEYS[i])
+        redis.call("HSET", KEYS[i], unpack(ARGV, j + 1, j + n * 2))
+        j = j + n * 2 + 1
+    else
+        redis.call("JSON.SET", KEYS[i], "$", ARGV[j])
+        j = j + 1
+    end
+    redis.call("XADD", stream, "*", "task", KEYS[i])
+end
+return redis.status_reply("OK")
\ No newline at end of file
@@ -0,0 +1,46 @@
+-- helpers shared by stream scripts, they are prepended to every stream script.
+-- ARGV[1] -> storage layout of task keys, json or hash
+local hashLayout = ARGV[1] == "hash"
+--- setFields sets field value pairs of existing task, missing task is not recreated
+local function setFields(taskKey, ...)
+    if redis.call("EXISTS", taskKey) == 0 then
+        return
+    end
+    if hashLayout then
+        redis.call("HSET", taskKey, ...)
+        return
+    end
+    local fv = {...}
+    for i=1, #fv, 2 do
+        redis.call("JSON.SET", taskKey, "$."..fv[i], fv[i + 1])
+    end
+end
+--- getField returns a field of task, nil if task or field not exists
+local function getField(taskKey, field)
+    if hashLayout then
+        return redis.call("HGET", taskKey, field)
+    end
+    local v = redis.call("JSON.GET", taskKey, "$."..field)
+    if v then
+        return cjson.decode(v)[1]
+    end
+end
+--- getTask returns json document or field value pairs of task, nil if task not exists
+local function getTask(taskKey)
+    if hashLayout then
+        local task = redis.call("HGETALL", taskKey)
+        if #task > 0 then
+            return task
+        end
+        return
+    end
+    local task = redis.call("JSON.GET", taskKey)
+    if task then
+        return task
+    end
+end
+--- requeue adds task to the end of stream as pending
+local function requeue(stream, taskKey, pendingState, now)
+    setFields(taskKey, "state", pendingState, "pending_at", now)
+    redis.call("XADD", stream, "*", "task", taskKey)
+end
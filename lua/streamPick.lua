@@ -0,0 +1,129 @@
+-- PickTasks of stream mode, see pickTasks.lua.
+-- KEYS[1] -> asynq:{queueName}:stream
+-- KEYS[2] -> asynq:{queueName}:pending
+-- KEYS[3] -> asynq:{queueName}:scheduled
+-- KEYS[4] -> asynq:{queueName}:retry
+-- KEYS[5] -> asynq:{queueName}:maxactive
+-- KEYS[6] -> asynq:{queueName}:ratelimit
+-- ARGV[1] -> storage layout, json or hash
+-- ARGV[2] -> consumer group
+-- ARGV[3] -> consumer name
+-- ARGV[4] -> task count
+-- ARGV[5] -> pending state
+-- ARGV[6] -> active state
+-- ARGV[7] -> scheduled state
+-- return -> stream entry id and task of picked tasks
+local stream = KEYS[1]
+local pending = KEYS[2]
+local scheduled = KEYS[3]
+local retry = KEYS[4]
+local maxActive = tonumber(redis.call("GET", KEYS[5]))
+local limiter = KEYS[6]
+local group = ARGV[2]
+local consumer = ARGV[3]
+local count = tonumber(ARGV[4])
+local pendingState = ARGV[5]
+local activeState = ARGV[6]
+local scheduledState = ARGV[7]
+local now = tonumber(redis.call("TIME")[1])
+--- group is created on first pick, entries added before it are delivered too
+redis.pcall("XGROUP", "CREATE", stream, group, "0", "MKSTREAM")
+
+for _, key in ipairs({scheduled, retry}) do
+    local move = redis.call("ZRANGEBYSCORE", key, 0, now)
+    if #move > 0 then
+        for i=1, #move do
+            requeue(stream, move[i], pendingState, now)
+        end
+        redis.call("ZREM", key, unpack(move))
+    end
+end
+--- tasks replayed from dead letter queue or enqueued before stream mode
+while true do
+    local taskKey = redis.call("RPOP", pending)
+    if not taskKey then
+        break
+    end
+    requeue(stream, taskKey, pendingState, now)
+end
+local result = {}
+--- cluster-wide limit of active tasks, delivered but not acknowledged entries
+if maxActive then
+    count = math.min(count, maxActive - redis.call("XPENDING", stream, group)[1])
+end
+local limited = redis.call("EXISTS", limiter) == 1
+local nowMs = 0
+if limited then
+    local t = redis.call("TIME")
+    nowMs = tonumber(t[1]) * 1000 + math.floor(tonumber(t[2]) / 1000)
+end
+--- token bucket of fields with prefix in limiter, nil if not limited
+local function bucket(prefix)
+    local v = redis.call("HMGET", limiter, prefix.."rate", prefix.."burst", prefix.."tokens", prefix.."ts")
+    local rate = tonumber(v[1])
+    if not rate or rate <= 0 then
+        return nil
+    end
+    local burst = tonumber(v[2]) or 1
+    local tokens = tonumber(v[3]) or burst
+    local ts = tonumber(v[4]) or nowMs
+    if nowMs > ts then
+        tokens = math.min(burst, tokens + (nowMs - ts) * rate / 1000)
+    end
+    return {rate = rate, tokens = tokens}
+end
+local function take(prefix, b)
+    redis.call("HSET", limiter, prefix.."tokens", tostring(b.tokens - 1), prefix.."ts", tostring(nowMs))
+end
+local function drop(id)
+    redis.call("XACK", stream, group, id)
+    redis.call("XDEL", stream, id)
+end
+local attempts = 0
+while #result < count and attempts < count + 100 do
+    attempts = attempts + 1
+    local qb
+    if limited then
+        qb = bucket("")
+        if qb and qb.tokens < 1 then
+            break
+        end
+    end
+    local entries = redis.call("XREADGROUP", "GROUP", group, consumer, "COUNT", 1, "STREAMS", stream, ">")
+    --- no new entries is a nil reply, which is false or an empty table in lua
+    if not entries or #entries == 0 then
+        break
+    end
+    local entry = entries[1][2][1]
+    local id = entry[1]
+    local taskKey = entry[2][2]
+    local deferred = redis.call("EXISTS", taskKey) == 0
+    if deferred then
+        drop(id)
+    elseif limited then
+        local taskType = getField(taskKey, "type")
+        if taskType then
+            local prefix = "t:"..taskType..":"
+            local tb = bucket(prefix)
+            if tb then
+                if tb.tokens < 1 then
+                    --- task type is limited, schedule it when next token is available
+                    drop(id)
+                    redis.call("ZADD", scheduled, now + math.ceil((1 - tb.tokens) / tb.rate), taskKey)
+                    setFields(taskKey, "state", scheduledState)
+                    deferred = true
+                else
+                    take(prefix, tb)
+                end
+            end
+        end
+    end
+    if not deferred then
+        if qb then
+            take("", qb)
+        end
+        setFields(taskKey, "pending_at", now, "state", activeState)
+        table.insert(result, {id, getTask(taskKey)})
+    end
+end
+return result
\ No newline at end of file
@@ -0,0 +1,47 @@
+-- RecoveryTasks of stream mode, see recoveryTasks.lua.
+-- KEYS[1] -> asynq:{queueName}:stream
+-- ARGV[1] -> storage layout, json or hash
+-- ARGV[2] -> consumer group
+-- ARGV[3] -> consumer name of recovery
+-- ARGV[4] -> task idle duration in milliseconds
+-- ARGV[5] -> pending state
+-- ARGV[6] -> active state
+-- return -> task keys added to stream again
+local stream = KEYS[1]
+local group = ARGV[2]
+local consumer = ARGV[3]
+local idle = tonumber(ARGV[4])
+local pendingState = ARGV[5]
+local activeState = tonumber(ARGV[6])
+local now = tonumber(redis.call("TIME")[1])
+redis.pcall("XGROUP", "CREATE", stream, group, "0", "MKSTREAM")
+local result = {}
+--- entries delivered but not acknowledged for idle, their consumers are gone or stuck
+local claimed = redis.call("XAUTOCLAIM", stream, group, consumer, idle, "0-0", "COUNT", 1000)
+for _, entry in ipairs(claimed[2]) do
+    local id = entry[1]
+    local fields = entry[2]
+    redis.call("XACK", stream, group, id)
+    redis.call("XDEL", stream, id)
+    --- fields of deleted entries are nil
+    if fields then
+        local taskKey = fields[2]
+        --- entries of retried or archived tasks are left by a broken acknowledgement
+        if tonumber(getField(taskKey, "state")) == activeState then
+            requeue(stream, taskKey, pendingState, now)
+            table.insert(result, taskKey)
+        end
+    end
+end
+--- consumers of stopped servers
+local consumers = redis.call("XINFO", "CONSUMERS", stream, group)
+for _, c in ipairs(consumers) do
+    local info = {}
+    for i=1, #c, 2 do
+        info[c[i]] = c[i + 1]
+    end
+    if info["pending"] == 0 and tonumber(info["idle"]) > idle then
+        redis.call("XGROUP", "DELCONSUMER", stream, group, info["name"])
+    end
+end
+return result
\ No newline at end of file
@@ -0,0 +1,18 @@
+-- Active2Pending of stream mode, acknowledges entries of tasks and adds them to stream again.
+-- KEYS[1] -> asynq:{queueName}:stream
+-- KEYS[2..n] -> asynq:{queueName}:t:taskID
+-- ARGV[1] -> storage layout, json or hash
+-- ARGV[2] -> consumer group
+-- ARGV[3] -> pending state
+-- ARGV[4..n] -> stream entry id of task
+local stream = KEYS[1]
+local group = ARGV[2]
+local now = tonumber(redis.call("TIME")[1])
+for i=2, #KEYS do
+    redis.call("XACK", stream, group, ARGV[i + 2])
+    redis.call("XDEL", stream, ARGV[i + 2])
+    if redis.call("EXISTS", KEYS[i]) == 1 then
+        requeue(stream, KEYS[i], ARGV[3], now)
+    end
+end
+return redis.status_reply("OK")
\ No newline at end of file
@@ -0,0 +1,44 @@
+package acornq
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestLuaScripts_Load(t *testing.T) {
+	cli := client(t)
+	scripts := map[string]string{
+		"cleaner":               cleanerLuaScript,
+		"recoveryTasks":         recoveryTasksLuaScript,
+		"pickTasks":             pickTasksLuaScript,
+		"retryTasks":            retryTasksLuaScript,
+		"active2pending":        active2pendingLuaScript,
+		"active2Archive":        active2ArchiveLuaScript,
+		"enqueuePending":        enqueuePendingLuaScript,
+		"enqueueScheduled":      enqueueScheduledLuaScript,
+		"acquireSemaphore":      acquireSemaphoreLuaScript,
+		"deleteActive":          deleteActiveLuaScript,
+		"active2DeadLetter":     active2DeadLetterLuaScript,
+		"replayDeadLetter":      replayDeadLetterLuaScript,
+		"enqueuePendingHash":    enqueuePendingHashLuaScript,
+		"enqueueScheduledHash":  enqueueScheduledHashLuaScript,
+		"pickTasksHash":         pickTasksHashLuaScript,
+		"recoveryTasksHash":     recoveryTasksHashLuaScript,
+		"active2pendingHash":    active2pendingHashLuaScript,
+		"retryTasksHash":        retryTasksHashLuaScript,
+		"active2ArchiveHash":    active2ArchiveHashLuaScript,
+		"active2DeadLetterHash": active2DeadLetterHashLuaScript,
+		"replayDeadLetterHash":  replayDeadLetterHashLuaScript,
+		"streamEnqueue":         streamLayoutLuaScript + streamEnqueueLuaScript,
+		"streamPick":            streamLayoutLuaScript + streamPickLuaScript,
+		"streamRequeue":         streamLayoutLuaScript + streamRequeueLuaScript,
+		"streamRecovery":        streamLayoutLuaScript + streamRecoveryLuaScript,
+		"migrateTask":           migrateTaskLuaScript,
+	}
+	for name, script := range scripts {
+		// SCRIPT LOAD compiles the script without running it, so scripts of LayoutJSON load on plain redis
+		err := cli.Do(context.Background(), cli.B().ScriptLoad().Script(script).Build()).Error()
+		assert.Nil(t, err, name)
+	}
+}
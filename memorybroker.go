@@ -0,0 +1,646 @@
+package acornq
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"slices"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// MemoryBroker is a Broker keeps tasks in process memory with the same state transitions
+// as RedisBroker, it is meant for tests and local development.
+// Tasks are shared only by Client, Server and Inspector using the same MemoryBroker.
+type MemoryBroker struct {
+	mu      sync.Mutex
+	queues  map[string]*memQueue
+	servers map[string]*memServer
+	subs    []*memSub
+	// seq of dead letter entry ids
+	seq int64
+	now func() time.Time
+}
+
+type memQueue struct {
+	tasks map[string]*TaskInfo
+	// pending and active lists, tasks enter at the end and leave from the start
+	pending []string
+	active  []string
+	// sorted sets, task id -> score
+	scheduled map[string]int64
+	retry     map[string]int64
+	live      map[string]int64
+	toDelete  map[string]int64
+	// archive lists, newest first
+	successful []string
+	failed     []string
+	deadLetter []*DeadLetterTask
+	maxActive  int
+	// token buckets, queue bucket has empty key
+	buckets map[string]*memBucket
+}
+
+type memBucket struct {
+	rate   float64
+	burst  int
+	tokens float64
+	// unix milliseconds tokens updated at, 0 if never taken
+	ts int64
+}
+
+type memServer struct {
+	info     ServerInfo
+	workers  []*WorkerInfo
+	expireAt time.Time
+}
+
+type memSub struct {
+	queues []string
+	fn     func(queue string, n int)
+}
+
+func NewMemoryBroker() *MemoryBroker {
+	return &MemoryBroker{
+		queues:  map[string]*memQueue{},
+		servers: map[string]*memServer{},
+		now:     time.Now,
+	}
+}
+
+// queue returns queue state, it is created if not exist. b.mu must be held.
+func (b *MemoryBroker) queue(name string) *memQueue {
+	q := b.queues[name]
+	if q == nil {
+		q = &memQueue{
+			tasks:     map[string]*TaskInfo{},
+			scheduled: map[string]int64{},
+			retry:     map[string]int64{},
+			live:      map[string]int64{},
+			toDelete:  map[string]int64{},
+			buckets:   map[string]*memBucket{},
+		}
+		b.queues[name] = q
+	}
+	return q
+}
+
+// publish calls subscribers of queue, b.mu must be held.
+func (b *MemoryBroker) publish(queue string, n int) {
+	for _, sub := range b.subs {
+		if slices.Contains(sub.queues, queue) {
+			sub.fn(queue, n)
+		}
+	}
+}
+
+// cloneTask copies t through json like it is stored in redis.
+func cloneTask(t *TaskInfo) *TaskInfo {
+	b, err := MarshalTask(t)
+	if err != nil {
+		return nil
+	}
+	t1, err := unmarshalTask(b)
+	if err != nil {
+		return nil
+	}
+	return t1
+}
+
+func removeID(ids []string, id string) []string {
+	if i := slices.Index(ids, id); i >= 0 {
+		return slices.Delete(ids, i, i+1)
+	}
+	return ids
+}
+
+// dueIDs returns ids with score <= now ordered by score and deletes them from set.
+func dueIDs(set map[string]int64, now int64) []string {
+	var ids []string
+	for id, score := range set {
+		if score <= now {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		if set[ids[i]] != set[ids[j]] {
+			return set[ids[i]] < set[ids[j]]
+		}
+		return ids[i] < ids[j]
+	})
+	for _, id := range ids {
+		delete(set, id)
+	}
+	return ids
+}
+
+func (b *MemoryBroker) AddQueue(queue string) {
+	b.mu.Lock()
+	b.queue(queue)
+	b.mu.Unlock()
+}
+
+func (b *MemoryBroker) EnqueueTasks(_ context.Context, ts []*TaskInfo) (err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := b.now().Unix()
+	notify := map[string]int{}
+	for _, t := range ts {
+		t1 := cloneTask(t)
+		if t1 == nil {
+			continue
+		}
+		queue := b2s(t.Queue)
+		q := b.queue(queue)
+		id := b2s(t.ID)
+		q.tasks[id] = t1
+		if t.Scheduled(now) {
+			q.scheduled[id] = t.StartAt
+			continue
+		}
+		q.pending = append(q.pending, id)
+		notify[queue]++
+	}
+	for queue, n := range notify {
+		b.publish(queue, n)
+	}
+	return
+}
+
+func (b *MemoryBroker) PickTasks(_ context.Context, queues []string, count int, limits map[string]int) (ts []*TaskInfo, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, queue := range queues {
+		n := count
+		if limit, ok := limits[queue]; ok {
+			if limit <= 0 {
+				continue
+			}
+			n = min(n, limit)
+		}
+		q := b.queues[queue]
+		if q == nil {
+			continue
+		}
+		ts1 := b.pickTasks(queue, q, n)
+		ts = append(ts, ts1...)
+		count -= len(ts1)
+		if count == 0 {
+			return
+		}
+	}
+	return
+}
+
+// pickTasks mirrors pickTasks lua script.
+func (b *MemoryBroker) pickTasks(queue string, q *memQueue, count int) (ts []*TaskInfo) {
+	nowTime := b.now()
+	now := nowTime.Unix()
+	nowMs := nowTime.UnixMilli()
+	moved := 0
+	for _, set := range []map[string]int64{q.scheduled, q.retry} {
+		for _, id := range dueIDs(set, now) {
+			q.pending = append(q.pending, id)
+			if t := q.tasks[id]; t != nil {
+				t.PendingAt = now
+				t.State = Pending
+			}
+			moved++
+		}
+	}
+	if moved > count {
+		b.publish(queue, moved-count)
+	}
+	if q.maxActive > 0 {
+		count = min(count, q.maxActive-len(q.active))
+	}
+	for attempts := 0; len(ts) < count && attempts < count+100; attempts++ {
+		qb := q.bucket("", nowMs)
+		if qb != nil && qb.tokens < 1 {
+			break
+		}
+		if len(q.pending) == 0 {
+			break
+		}
+		id := q.pending[0]
+		q.pending = q.pending[1:]
+		t := q.tasks[id]
+		if t != nil {
+			if tb := q.bucket(b2s(t.Type), nowMs); tb != nil {
+				if tb.tokens < 1 {
+					// task type is limited, schedule it when next token is available
+					q.scheduled[id] = now + int64(math.Ceil((1-tb.tokens)/tb.rate))
+					t.State = Scheduled
+					continue
+				}
+				tb.take(nowMs)
+			}
+		}
+		if qb != nil {
+			qb.take(nowMs)
+		}
+		q.active = append(q.active, id)
+		if t != nil {
+			t.PendingAt = now
+			t.State = Active
+			ts = append(ts, cloneTask(t))
+		}
+	}
+	return
+}
+
+// bucket returns refilled token bucket of taskType, queue bucket if taskType is empty,
+// nil if not limited.
+func (q *memQueue) bucket(taskType string, nowMs int64) *memBucket {
+	bk := q.buckets[taskType]
+	if bk == nil || bk.rate <= 0 {
+		return nil
+	}
+	if bk.ts == 0 {
+		bk.tokens = float64(bk.burst)
+		bk.ts = nowMs
+	}
+	if nowMs > bk.ts {
+		bk.tokens = math.Min(float64(bk.burst), bk.tokens+float64(nowMs-bk.ts)*bk.rate/1000)
+		bk.ts = nowMs
+	}
+	return bk
+}
+
+func (bk *memBucket) take(nowMs int64) {
+	bk.tokens--
+	bk.ts = nowMs
+}
+
+func (b *MemoryBroker) Backlog(_ context.Context, queues []string) (m map[string]int64, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, queue := range queues {
+		q := b.queues[queue]
+		if q == nil {
+			continue
+		}
+		if m == nil {
+			m = make(map[string]int64, len(queues))
+		}
+		m[queue] = int64(len(q.pending))
+	}
+	return
+}
+
+// SubscribeNotify calls fn with the broker locked, fn must not call the broker.
+func (b *MemoryBroker) SubscribeNotify(ctx context.Context, queues []string, fn func(queue string, n int)) (err error) {
+	sub := &memSub{queues: queues, fn: fn}
+	b.mu.Lock()
+	b.subs = append(b.subs, sub)
+	b.mu.Unlock()
+	<-ctx.Done()
+	b.mu.Lock()
+	b.subs = slices.DeleteFunc(b.subs, func(s *memSub) bool { return s == sub })
+	b.mu.Unlock()
+	return
+}
+
+// appendAttempt mirrors appendAttempt of lua scripts.
+func appendAttempt(t *TaskInfo, src *TaskInfo) {
+	if src.attempt == nil {
+		return
+	}
+	a := *src.attempt
+	t.Attempts = append(t.Attempts, &a)
+	if len(t.Attempts) > maxTaskAttempts {
+		t.Attempts = t.Attempts[len(t.Attempts)-maxTaskAttempts:]
+	}
+}
+
+func (b *MemoryBroker) RetryTasks(_ context.Context, ts []*TaskInfo) (err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := b.now().Unix()
+	for _, t := range ts {
+		q := b.queue(b2s(t.Queue))
+		id := b2s(t.ID)
+		q.retry[id] = t.PendingAt
+		if t1 := q.tasks[id]; t1 != nil {
+			appendAttempt(t1, t)
+			t1.State = Retried
+			t1.Retried = t.Retried
+			t1.LastFailedAt = now
+		}
+		q.active = removeID(q.active, id)
+	}
+	return
+}
+
+func (b *MemoryBroker) Active2Pending(_ context.Context, ts []*TaskInfo) (err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := b.now().Unix()
+	notify := map[string]int{}
+	for _, t := range ts {
+		queue := b2s(t.Queue)
+		q := b.queue(queue)
+		id := b2s(t.ID)
+		q.pending = append(q.pending, id)
+		q.active = removeID(q.active, id)
+		if t1 := q.tasks[id]; t1 != nil {
+			t1.PendingAt = now
+		}
+		notify[queue]++
+	}
+	for queue, n := range notify {
+		b.publish(queue, n)
+	}
+	return
+}
+
+func (b *MemoryBroker) Active2Archive(_ context.Context, ts []*TaskInfo, successful bool) (err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := b.now().Unix()
+	state := Archived
+	if successful {
+		state |= Successful
+	} else {
+		state |= Failed
+	}
+	for _, t := range ts {
+		q := b.queue(b2s(t.Queue))
+		id := b2s(t.ID)
+		if t.Retention != 0 {
+			if successful {
+				q.successful = slices.Insert(q.successful, 0, id)
+			} else {
+				q.failed = slices.Insert(q.failed, 0, id)
+			}
+			if t.Retention > 0 {
+				q.toDelete[id] = now + int64(t.Retention)
+			}
+			if t1 := q.tasks[id]; t1 != nil {
+				appendAttempt(t1, t)
+				t1.CompletedAt = now
+				t1.State = state
+				if !successful {
+					t1.LastFailedAt = now
+				}
+			}
+		} else {
+			delete(q.tasks, id)
+		}
+		q.active = removeID(q.active, id)
+	}
+	return
+}
+
+func (b *MemoryBroker) Active2DeadLetter(_ context.Context, ts []*TaskInfo) (trimmed []*DeadLetterTask, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := b.now()
+	for _, t := range ts {
+		queue := b2s(t.Queue)
+		q := b.queue(queue)
+		id := b2s(t.ID)
+		if t1 := q.tasks[id]; t1 != nil {
+			appendAttempt(t1, t)
+			t1.State = Archived | Failed
+			t1.CompletedAt = now.Unix()
+			t1.LastFailedAt = now.Unix()
+			b.seq++
+			q.deadLetter = append(q.deadLetter, &DeadLetterTask{
+				ID:    strconv.FormatInt(now.UnixMilli(), 10) + "-" + strconv.FormatInt(b.seq, 10),
+				Queue: queue,
+				Task:  t1,
+			})
+			if n := len(q.deadLetter) - deadLetterMaxLen; n > 0 {
+				trimmed = append(trimmed, q.deadLetter[:n]...)
+				q.deadLetter = slices.Clone(q.deadLetter[n:])
+			}
+			delete(q.tasks, id)
+		}
+		q.active = removeID(q.active, id)
+	}
+	return
+}
+
+func (b *MemoryBroker) DeadLetterTasks(_ context.Context, queue string, count int) (ts []*DeadLetterTask, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	q := b.queue(queue)
+	entries := q.deadLetter
+	if count > 0 && len(entries) > count {
+		entries = entries[:count]
+	}
+	ts = make([]*DeadLetterTask, 0, len(entries))
+	for _, e := range entries {
+		ts = append(ts, &DeadLetterTask{ID: e.ID, Queue: e.Queue, Task: cloneTask(e.Task)})
+	}
+	return
+}
+
+func (b *MemoryBroker) ReplayDeadLetter(_ context.Context, queue string, ids []string) (n int, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	q := b.queue(queue)
+	now := b.now().Unix()
+	for _, id := range ids {
+		i := slices.IndexFunc(q.deadLetter, func(e *DeadLetterTask) bool { return e.ID == id })
+		if i < 0 {
+			continue
+		}
+		t := q.deadLetter[i].Task
+		q.deadLetter = slices.Delete(q.deadLetter, i, i+1)
+		t.State = Pending
+		t.Retried = 0
+		t.PendingAt = now
+		q.tasks[b2s(t.ID)] = t
+		q.pending = append(q.pending, b2s(t.ID))
+		n++
+	}
+	if n > 0 {
+		b.publish(queue, n)
+	}
+	return
+}
+
+func (b *MemoryBroker) DeleteActiveTasks(_ context.Context, ts []*TaskInfo) (err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, t := range ts {
+		q := b.queue(b2s(t.Queue))
+		q.active = removeID(q.active, b2s(t.ID))
+		delete(q.tasks, b2s(t.ID))
+	}
+	return
+}
+
+func (b *MemoryBroker) SetErrorMsg(_ context.Context, t *TaskInfo) (err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if t1 := b.queue(b2s(t.Queue)).tasks[b2s(t.ID)]; t1 != nil {
+		t1.ErrorMsg = slices.Clone(t.ErrorMsg)
+	}
+	return
+}
+
+// RecoveryTasks mirrors recovery lua script.
+func (b *MemoryBroker) RecoveryTasks(queues []string, idleTimeout time.Duration) (n int, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := b.now().Unix()
+	timeout := int64(idleTimeout.Seconds())
+	for _, queue := range queues {
+		q := b.queues[queue]
+		if q == nil {
+			continue
+		}
+		var recovered []string
+		active := q.active[:0]
+		for _, id := range q.active {
+			t := q.tasks[id]
+			if t == nil {
+				continue
+			}
+			score := t.PendingAt
+			if live, ok := q.live[id]; ok {
+				score = max(score, live)
+			}
+			if now-score > timeout {
+				recovered = append(recovered, id)
+				delete(q.live, id)
+				continue
+			}
+			active = append(active, id)
+		}
+		q.active = active
+		for id := range q.live {
+			if !slices.Contains(q.active, id) {
+				delete(q.live, id)
+			}
+		}
+		for _, id := range recovered {
+			q.tasks[id].State = Pending
+			q.tasks[id].PendingAt = now
+		}
+		q.pending = append(q.pending, recovered...)
+		if len(recovered) > 0 {
+			b.publish(queue, len(recovered))
+		}
+		n += len(recovered)
+	}
+	return
+}
+
+func (b *MemoryBroker) LiveTasksChange(_ context.Context, items []*liveItem, update bool) (err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := b.now().Unix()
+	for _, item := range items {
+		q := b.queue(item.queue)
+		if _, ok := q.live[item.taskID]; ok == update {
+			q.live[item.taskID] = now
+		}
+	}
+	return
+}
+
+func (b *MemoryBroker) DeleteLiveTasks(_ context.Context, items []*liveItem) (err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, item := range items {
+		delete(b.queue(item.queue).live, item.taskID)
+	}
+	return
+}
+
+// CleanUpArchive deletes archived tasks whose retention expired.
+func (b *MemoryBroker) CleanUpArchive(_ context.Context, _ int) (payloadRefs []string, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := b.now().Unix()
+	for _, q := range b.queues {
+		for _, id := range dueIDs(q.toDelete, now) {
+			if t := q.tasks[id]; t != nil && len(t.PayloadRef) > 0 {
+				payloadRefs = append(payloadRefs, string(t.PayloadRef))
+			}
+			delete(q.tasks, id)
+		}
+		deleted := func(id string) bool {
+			return q.tasks[id] == nil
+		}
+		q.successful = slices.DeleteFunc(q.successful, deleted)
+		q.failed = slices.DeleteFunc(q.failed, deleted)
+	}
+	return
+}
+
+func (b *MemoryBroker) SetMaxActive(_ context.Context, queue string, n int) (err error) {
+	b.mu.Lock()
+	b.queue(queue).maxActive = max(n, 0)
+	b.mu.Unlock()
+	return
+}
+
+func (b *MemoryBroker) MaxActive(_ context.Context, queue string) (n int, err error) {
+	b.mu.Lock()
+	n = b.queue(queue).maxActive
+	b.mu.Unlock()
+	return
+}
+
+func (b *MemoryBroker) SetRateLimit(_ context.Context, queue string, taskType string, limit RateLimit) (err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	q := b.queue(queue)
+	if limit.Rate <= 0 {
+		delete(q.buckets, taskType)
+		return
+	}
+	bk := q.buckets[taskType]
+	if bk == nil {
+		bk = &memBucket{}
+		q.buckets[taskType] = bk
+	}
+	bk.rate = limit.Rate
+	bk.burst = max(limit.Burst, 1)
+	return
+}
+
+func (b *MemoryBroker) WriteServerState(_ context.Context, info *ServerInfo, workers []*WorkerInfo, ttl time.Duration) (err error) {
+	// copy through json like it is stored in redis
+	data, err := json.Marshal(workers)
+	if err != nil {
+		return
+	}
+	var ws []*WorkerInfo
+	if err = json.Unmarshal(data, &ws); err != nil {
+		return
+	}
+	s := &memServer{info: *info, workers: ws, expireAt: b.now().Add(ttl)}
+	s.info.Queues = make(map[string]int, len(info.Queues))
+	for k, v := range info.Queues {
+		s.info.Queues[k] = v
+	}
+	s.info.ActiveWorkers = nil
+	b.mu.Lock()
+	b.servers[info.ID] = s
+	b.mu.Unlock()
+	return
+}
+
+func (b *MemoryBroker) ListServers(_ context.Context) (servers []*ServerInfo, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := b.now()
+	for id, s := range b.servers {
+		if !now.Before(s.expireAt) {
+			delete(b.servers, id)
+			continue
+		}
+		info := s.info
+		info.ActiveWorkers = slices.Clone(s.workers)
+		servers = append(servers, &info)
+	}
+	return
+}
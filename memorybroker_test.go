@@ -0,0 +1,113 @@
+package acornq
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func newTestMemoryBroker() (*MemoryBroker, *time.Time) {
+	b := NewMemoryBroker()
+	now := time.Unix(1_000_000, 0)
+	b.now = func() time.Time { return now }
+	return b, &now
+}
+
+func TestMemoryBroker_Lifecycle(t *testing.T) {
+	ctx := context.Background()
+	b, now := newTestMemoryBroker()
+	b.AddQueue("q")
+	ts := []*TaskInfo{
+		{ID: StringBytes("1"), Type: StringBytes("a"), Queue: StringBytes("q"), Retention: 10, PayloadRef: StringBytes("ref")},
+		{ID: StringBytes("2"), Type: StringBytes("a"), Queue: StringBytes("q"), StartAt: now.Unix() + 5},
+	}
+	assert.Nil(t, b.EnqueueTasks(ctx, ts))
+
+	picked, err := b.PickTasks(ctx, []string{"q"}, 2, nil)
+	assert.Nil(t, err)
+	assert.Len(t, picked, 1)
+	assert.Equal(t, Active, picked[0].State)
+
+	// retry is due after 5 seconds together with the scheduled task
+	picked[0].Retried = 1
+	picked[0].PendingAt = now.Unix() + 5
+	picked[0].attempt = &TaskAttempt{Error: "boom"}
+	assert.Nil(t, b.RetryTasks(ctx, picked))
+	picked, _ = b.PickTasks(ctx, []string{"q"}, 2, nil)
+	assert.Len(t, picked, 0)
+	*now = now.Add(5 * time.Second)
+	picked, _ = b.PickTasks(ctx, []string{"q"}, 2, nil)
+	assert.Len(t, picked, 2)
+	// scheduled set is moved before retry set
+	assert.Equal(t, "2", string(picked[0].ID))
+	assert.Equal(t, 1, picked[1].Retried)
+	assert.Len(t, picked[1].Attempts, 1)
+
+	assert.Nil(t, b.Active2Archive(ctx, picked[1:], true))
+	trimmed, err := b.Active2DeadLetter(ctx, picked[:1])
+	assert.Nil(t, err)
+	assert.Empty(t, trimmed)
+	assert.Len(t, b.queues["q"].active, 0)
+	assert.Len(t, b.queues["q"].successful, 1)
+
+	dead, err := b.DeadLetterTasks(ctx, "q", 10)
+	assert.Nil(t, err)
+	assert.Len(t, dead, 1)
+	assert.Equal(t, Archived|Failed, dead[0].Task.State)
+	n, err := b.ReplayDeadLetter(ctx, "q", []string{dead[0].ID, "unknown"})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, n)
+	m, _ := b.Backlog(ctx, []string{"q"})
+	assert.Equal(t, int64(1), m["q"])
+
+	*now = now.Add(10 * time.Second)
+	payloadRefs, err := b.CleanUpArchive(ctx, 100)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"ref"}, payloadRefs)
+	assert.Len(t, b.queues["q"].successful, 0)
+	assert.Nil(t, b.queues["q"].tasks["1"])
+}
+
+func TestMemoryBroker_RecoveryTasks(t *testing.T) {
+	ctx := context.Background()
+	b, now := newTestMemoryBroker()
+	b.AddQueue("q")
+	notified := 0
+	b.subs = append(b.subs, &memSub{queues: []string{"q"}, fn: func(_ string, n int) { notified += n }})
+	assert.Nil(t, b.EnqueueTasks(ctx, []*TaskInfo{
+		{ID: StringBytes("1"), Type: StringBytes("a"), Queue: StringBytes("q")},
+		{ID: StringBytes("2"), Type: StringBytes("a"), Queue: StringBytes("q")},
+	}))
+	_, _ = b.PickTasks(ctx, []string{"q"}, 2, nil)
+	*now = now.Add(20 * time.Second)
+	assert.Nil(t, b.LiveTasksChange(ctx, []*liveItem{{taskID: "2", queue: "q"}}, false))
+	*now = now.Add(20 * time.Second)
+	n, err := b.RecoveryTasks([]string{"q"}, 30*time.Second)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, n)
+	assert.Equal(t, []string{"2"}, b.queues["q"].active)
+	assert.Equal(t, []string{"1"}, b.queues["q"].pending)
+	assert.Equal(t, 3, notified)
+}
+
+func TestMemoryBroker_Limits(t *testing.T) {
+	ctx := context.Background()
+	b, now := newTestMemoryBroker()
+	for i := 0; i < 4; i++ {
+		assert.Nil(t, b.EnqueueTasks(ctx, []*TaskInfo{{ID: StringBytes{byte('0' + i)}, Type: StringBytes("a"), Queue: StringBytes("q")}}))
+	}
+	assert.Nil(t, b.SetMaxActive(ctx, "q", 3))
+	assert.Nil(t, b.SetRateLimit(ctx, "q", "a", RateLimit{Rate: 1, Burst: 2}))
+	picked, _ := b.PickTasks(ctx, []string{"q"}, 4, nil)
+	assert.Len(t, picked, 2)
+	// tasks over the type limit are scheduled until next token
+	assert.Len(t, b.queues["q"].scheduled, 2)
+	*now = now.Add(time.Second)
+	picked, _ = b.PickTasks(ctx, []string{"q"}, 4, nil)
+	assert.Len(t, picked, 1)
+	assert.Len(t, b.queues["q"].active, 3)
+	*now = now.Add(time.Minute)
+	picked, _ = b.PickTasks(ctx, []string{"q"}, 4, nil)
+	assert.Len(t, picked, 0)
+}
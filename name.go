@@ -2,6 +2,9 @@ package acornq
 
 import "time"
 
+// KeyInfo holds keys of a queue, they share hash tag {queue} so they are in one cluster slot.
+// A lua script or a transaction must only touch keys of one queue, operations over queues
+// are split per queue; keys not belong to a queue are only used by single key commands.
 type KeyInfo struct {
 	queue          string
 	taskKeyPrefix  string
@@ -14,6 +17,14 @@ type KeyInfo struct {
 	//
 	liveKey  string
 	toDelKey string
+	// payload refs of archived tasks, deleted by Cleaner with their tasks
+	blobsKey string
+	// pub/sub channel notified when tasks enter pending list
+	notifyChannel string
+	maxActiveKey  string
+	rateLimitKey  string
+	deadLetterKey string
+	streamKey     string
 	//
 	successfulKey string
 	failedKey     string
@@ -30,6 +41,12 @@ type KeyInfo struct {
 // pending queue(set): acornq:{default}:pending
 // active queue(set): acornq:{default}:active
 // retry queue(sorted set): acornq:{default}:retry
+// notify channel(pub/sub): acornq:{default}:notify
+// cluster-wide max active tasks(int): acornq:{default}:maxactive
+// rate limit token buckets of queue and task types(hash): acornq:{default}:ratelimit
+// payload refs of archived tasks(hash): acornq:{default}:blobs
+// dead letter queue(stream): acornq:{default}:deadletter
+// task stream of StreamBroker(stream): acornq:{default}:stream
 //
 // failed queue(sorted set): acornq:{default}:failed
 // successful queue(sorted set): acornq:{default}:success
@@ -52,6 +69,12 @@ func NewKeyInfo(queue string) *KeyInfo {
 	//
 	n.liveKey = n.queueKeyPrefix + "live"
 	n.toDelKey = n.queueKeyPrefix + "todel"
+	n.blobsKey = n.queueKeyPrefix + "blobs"
+	n.notifyChannel = n.queueKeyPrefix + "notify"
+	n.maxActiveKey = n.queueKeyPrefix + "maxactive"
+	n.rateLimitKey = n.queueKeyPrefix + "ratelimit"
+	n.deadLetterKey = n.queueKeyPrefix + "deadletter"
+	n.streamKey = n.queueKeyPrefix + "stream"
 	//
 	n.failedKey = n.queueKeyPrefix + "failed"
 	n.successfulKey = n.queueKeyPrefix + "success"
@@ -83,6 +106,9 @@ func (n *KeyInfo) PendingKey() string {
 func (n *KeyInfo) ToDeleteKey() string {
 	return n.toDelKey
 }
+func (n *KeyInfo) BlobsKey() string {
+	return n.blobsKey
+}
 func (n *KeyInfo) ActiveKey() string {
 	return n.activeKey
 }
@@ -94,6 +120,23 @@ func (n *KeyInfo) LiveKey() string {
 	return n.liveKey
 }
 
+func (n *KeyInfo) NotifyChannel() string {
+	return n.notifyChannel
+}
+func (n *KeyInfo) MaxActiveKey() string {
+	return n.maxActiveKey
+}
+func (n *KeyInfo) RateLimitKey() string {
+	return n.rateLimitKey
+}
+func (n *KeyInfo) DeadLetterKey() string {
+	return n.deadLetterKey
+}
+
+func (n *KeyInfo) StreamKey() string {
+	return n.streamKey
+}
+
 func (n *KeyInfo) FailedKey() string {
 	return n.failedKey
 }
@@ -110,3 +153,27 @@ func (n *KeyInfo) ProcessedTotalKey() string {
 func (n *KeyInfo) FailedDayKey(t time.Time) string {
 	return n.failedDayKeyPrefix + t.UTC().Format("2006-01-02")
 }
+
+// servers index(sorted set, score is expire at): acornq:servers
+// server info(hash): acornq:servers:{serverID}
+// server workers(hash, taskID -> worker info json): acornq:workers:{serverID}
+const serversKey = "acornq:servers"
+
+func ServerInfoKey(serverID string) string {
+	return "acornq:servers:{" + serverID + "}"
+}
+func WorkersKey(serverID string) string {
+	return "acornq:workers:{" + serverID + "}"
+}
+
+// semaphores(set of semaphore names): acornq:semaphores
+// semaphore leases(sorted set, task key -> lease expire at): acornq:sema:{name}
+const semaphoresKey = "acornq:semaphores"
+
+func SemaphoreKey(name string) string {
+	return "acornq:sema:{" + name + "}"
+}
+
+func taskKey(queue, id string) string {
+	return "acornq:{" + queue + "}:t:" + id
+}
@@ -0,0 +1,63 @@
+package acornq
+
+import (
+	"context"
+	"time"
+)
+
+// notifier subscribes notify channels of server queues and wakes idle workers
+// as soon as tasks enter pending list, so workers do not wait a whole poll interval.
+// Notifications may be lost while reconnecting, workers still poll every interval.
+type notifier struct {
+	broker     Broker
+	queues     []string
+	stopCh     chan struct{}
+	errHandler ErrHandler
+	// one token wakes one idle worker
+	wakeCh chan struct{}
+}
+
+func newNotifier(stopCh chan struct{}, broker Broker, queues []string, concurrency int, errHandler ErrHandler) *notifier {
+	return &notifier{
+		broker:     broker,
+		queues:     queues,
+		stopCh:     stopCh,
+		errHandler: errHandler,
+		wakeCh:     make(chan struct{}, concurrency),
+	}
+}
+
+func (n *notifier) Start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-n.stopCh
+		cancel()
+	}()
+	for {
+		err := n.broker.SubscribeNotify(ctx, n.queues, n.wake)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			n.errHandler(err)
+		}
+		// resubscribe after connection broken
+		select {
+		case <-time.After(time.Second):
+		case <-n.stopCh:
+			return
+		}
+	}
+}
+
+func (n *notifier) wake(_ string, count int) {
+	count = max(count, 1)
+	for i := 0; i < count; i++ {
+		select {
+		case n.wakeCh <- struct{}{}:
+		default:
+			// all workers will be woken
+			return
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package acornq
+
+import (
+	"context"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestNotifier_WakesFetcher(t *testing.T) {
+	t.Run("memory", func(t *testing.T) {
+		testNotifierWakesFetcher(t, NewMemoryBroker(), defaultQueueName)
+	})
+	t.Run("redis", func(t *testing.T) {
+		redisCli := client(t)
+		for _, layout := range testLayouts(t, redisCli) {
+			t.Run(layout.String(), func(t *testing.T) {
+				testNotifierWakesFetcher(t, NewRedisBrokerWithLayout(redisCli, layout), testQueue(t))
+			})
+		}
+	})
+}
+
+// testNotifierWakesFetcher checks an enqueued task is handled long before the next poll of an idle fetcher.
+func testNotifierWakesFetcher(t *testing.T, broker Broker, queue string) {
+	ctx := context.Background()
+	handled := make(chan struct{}, 1)
+	s, err := NewServer(&Config{
+		Handler: TaskHandlerFunc(func(task *TaskInfo) error {
+			handled <- struct{}{}
+			return nil
+		}),
+		Queues:           map[string]int{queue: 1},
+		Broker:           broker,
+		TaskPeekInterval: 10 * time.Second,
+		ErrHandler:       func(err error) { t.Error(err) },
+	})
+	require.Nil(t, err)
+	go s.Start()
+	defer func() {
+		ctx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+		defer cancel()
+		s.ShutDown(ctx)
+	}()
+	// fetcher found nothing and waits for the next poll, notifier has subscribed
+	time.Sleep(200 * time.Millisecond)
+	require.Nil(t, NewClientWithBroker(broker).EnqueueContext(ctx, NewTask("task", nil), Queue(queue)))
+	select {
+	case <-handled:
+	case <-time.After(time.Second):
+		t.Fatal("fetcher not woken by notification")
+	}
+}
@@ -0,0 +1,194 @@
+package acornq
+
+import (
+	"math/rand"
+	"slices"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// weightedQueues orders queues for every pick.
+//
+// strict: queues are always ordered by priority from high to low, lower priority queues
+// are only picked when all higher priority queues are empty.
+//
+// weighted: the first queue is chosen randomly with probability priority/sum(priorities),
+// the next one among the rest likewise, so every queue is still tried in a pick.
+// priority less than 1 is treated as 1, so such a queue is never starved.
+//
+// weightedQueues is immutable after creation and safe for concurrent use.
+type weightedQueues struct {
+	// sorted by priority from high to low, ties by name.
+	names   []string
+	weights []int
+	total   int
+	strict  bool
+}
+
+func newWeightedQueues(queues map[string]int, strict bool) *weightedQueues {
+	q := &weightedQueues{
+		names:   make([]string, 0, len(queues)),
+		weights: make([]int, len(queues)),
+		strict:  strict,
+	}
+	for name := range queues {
+		q.names = append(q.names, name)
+	}
+	sort.Slice(q.names, func(i, j int) bool {
+		pi, pj := queues[q.names[i]], queues[q.names[j]]
+		if pi != pj {
+			return pi > pj
+		}
+		return q.names[i] < q.names[j]
+	})
+	for i, name := range q.names {
+		q.weights[i] = max(queues[name], 1)
+		q.total += q.weights[i]
+	}
+	return q
+}
+
+// order returns queue names in the order they should be tried for one pick.
+// The returned slice must not be modified.
+func (q *weightedQueues) order() []string {
+	if q.strict || len(q.names) == 1 {
+		return q.names
+	}
+	names := make([]string, len(q.names))
+	copy(names, q.names)
+	var buf [16]int
+	weights := append(buf[:0], q.weights...)
+	total := q.total
+	for i := 0; i < len(names)-1; i++ {
+		r := rand.Intn(total)
+		j := i
+		for ; j < len(names)-1; j++ {
+			r -= weights[j]
+			if r < 0 {
+				break
+			}
+		}
+		total -= weights[j]
+		names[i], names[j] = names[j], names[i]
+		weights[i], weights[j] = weights[j], weights[i]
+	}
+	return names
+}
+
+// Select implements QueueSelector.
+func (q *weightedQueues) Select(_ []string, _ BacklogFunc) []string {
+	return q.order()
+}
+
+// BacklogFunc returns pending list length of every queue, it queries broker lazily
+// so only selectors need backlog pay for it. A nil map is returned on network error.
+type BacklogFunc func() map[string]int64
+
+// QueueSelector decides which queues are tried and in which order for one pick.
+// It is shared by all workers of a server and must be safe for concurrent use.
+type QueueSelector interface {
+	// Select returns queue names in the order they should be tried,
+	// queues not returned are skipped this pick.
+	// queues are all queues of the server ordered by priority from high to low.
+	Select(queues []string, backlog BacklogFunc) []string
+}
+
+// NewWeightedSelector returns a QueueSelector tries the first queue chosen randomly
+// with probability priority/sum(priorities), it is used by default.
+func NewWeightedSelector(queues map[string]int) QueueSelector {
+	return newWeightedQueues(queues, false)
+}
+
+// NewStrictSelector returns a QueueSelector always tries queues by priority from high to low.
+func NewStrictSelector(queues map[string]int) QueueSelector {
+	return newWeightedQueues(queues, true)
+}
+
+type roundRobinSelector struct {
+	next atomic.Uint64
+}
+
+// NewRoundRobinSelector returns a QueueSelector rotates the first queue every pick.
+func NewRoundRobinSelector() QueueSelector {
+	return &roundRobinSelector{}
+}
+
+func (s *roundRobinSelector) Select(queues []string, _ BacklogFunc) []string {
+	if len(queues) <= 1 {
+		return queues
+	}
+	start := int((s.next.Add(1) - 1) % uint64(len(queues)))
+	names := make([]string, 0, len(queues))
+	names = append(names, queues[start:]...)
+	return append(names, queues[:start]...)
+}
+
+type leastBacklogSelector struct{}
+
+// NewLeastBacklogSelector returns a QueueSelector tries queues with the shortest pending list first,
+// queues with empty pending list are tried last because due scheduled and retry tasks
+// are only moved to pending list by a pick.
+func NewLeastBacklogSelector() QueueSelector {
+	return leastBacklogSelector{}
+}
+
+func (leastBacklogSelector) Select(queues []string, backlog BacklogFunc) []string {
+	m := backlog()
+	if len(queues) <= 1 || m == nil {
+		return queues
+	}
+	names := make([]string, len(queues))
+	copy(names, queues)
+	sort.SliceStable(names, func(i, j int) bool {
+		li, lj := m[names[i]], m[names[j]]
+		if li == 0 || lj == 0 {
+			return lj == 0 && li != 0
+		}
+		return li < lj
+	})
+	return names
+}
+
+type stickySelector struct {
+	mu      sync.Mutex
+	current string
+}
+
+// NewStickySelector returns a QueueSelector keeps trying the same queue first until its
+// pending list is empty, then moves to the next queue with backlog in priority order.
+func NewStickySelector() QueueSelector {
+	return &stickySelector{}
+}
+
+func (s *stickySelector) Select(queues []string, backlog BacklogFunc) []string {
+	if len(queues) <= 1 {
+		return queues
+	}
+	m := backlog()
+	if m == nil {
+		return queues
+	}
+	s.mu.Lock()
+	current := s.current
+	if m[current] == 0 {
+		idx := slices.Index(queues, current)
+		for i := 1; i <= len(queues); i++ {
+			name := queues[(idx+i)%len(queues)]
+			if m[name] > 0 {
+				current = name
+				break
+			}
+		}
+		s.current = current
+	}
+	s.mu.Unlock()
+	idx := slices.Index(queues, current)
+	if idx <= 0 {
+		return queues
+	}
+	names := make([]string, 0, len(queues))
+	names = append(names, current)
+	names = append(names, queues[:idx]...)
+	return append(names, queues[idx+1:]...)
+}
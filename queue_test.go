@@ -0,0 +1,65 @@
+package acornq
+
+import (
+	"github.com/stretchr/testify/assert"
+	"math"
+	"testing"
+)
+
+func TestWeightedQueues_Order(t *testing.T) {
+	queues := map[string]int{"critical": 6, "default": 3, "low": 1, "zero": 0}
+	q := newWeightedQueues(queues, false)
+	const n = 200000
+	first := map[string]int{}
+	for i := 0; i < n; i++ {
+		order := q.order()
+		assert.ElementsMatch(t, []string{"critical", "default", "low", "zero"}, order)
+		first[order[0]]++
+	}
+	// zero priority is treated as 1.
+	expected := map[string]float64{"critical": 6.0 / 11, "default": 3.0 / 11, "low": 1.0 / 11, "zero": 1.0 / 11}
+	for name, p := range expected {
+		got := float64(first[name]) / n
+		assert.Truef(t, math.Abs(got-p) < 0.01, "queue %s picked first %.4f, expected %.4f", name, got, p)
+	}
+	// shared slice is never mutated.
+	assert.Equal(t, []string{"critical", "default", "low", "zero"}, q.names)
+}
+
+func TestWeightedQueues_Strict(t *testing.T) {
+	q := newWeightedQueues(map[string]int{"b": 1, "a": 1, "critical": 6, "zero": 0}, true)
+	for i := 0; i < 100; i++ {
+		assert.Equal(t, []string{"critical", "a", "b", "zero"}, q.order())
+	}
+}
+
+func TestRoundRobinSelector(t *testing.T) {
+	s := NewRoundRobinSelector()
+	queues := []string{"a", "b", "c"}
+	assert.Equal(t, []string{"a", "b", "c"}, s.Select(queues, nil))
+	assert.Equal(t, []string{"b", "c", "a"}, s.Select(queues, nil))
+	assert.Equal(t, []string{"c", "a", "b"}, s.Select(queues, nil))
+	assert.Equal(t, []string{"a", "b", "c"}, s.Select(queues, nil))
+}
+
+func TestLeastBacklogSelector(t *testing.T) {
+	s := NewLeastBacklogSelector()
+	backlog := func() map[string]int64 { return map[string]int64{"a": 10, "b": 0, "c": 3, "d": 7} }
+	assert.Equal(t, []string{"c", "d", "a", "b"}, s.Select([]string{"a", "b", "c", "d"}, backlog))
+}
+
+func TestStickySelector(t *testing.T) {
+	s := NewStickySelector()
+	queues := []string{"a", "b", "c"}
+	m := map[string]int64{"a": 0, "b": 2, "c": 5}
+	backlog := func() map[string]int64 { return m }
+	assert.Equal(t, []string{"b", "a", "c"}, s.Select(queues, backlog))
+	m["c"] = 1
+	assert.Equal(t, []string{"b", "a", "c"}, s.Select(queues, backlog))
+	m["b"] = 0
+	assert.Equal(t, []string{"c", "a", "b"}, s.Select(queues, backlog))
+	m["a"] = 4
+	assert.Equal(t, []string{"c", "a", "b"}, s.Select(queues, backlog))
+	m["c"] = 0
+	assert.Equal(t, []string{"a", "b", "c"}, s.Select(queues, backlog))
+}
@@ -0,0 +1,50 @@
+package acornq
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// RateLimit is a token bucket shared by all servers, it is refilled Rate tokens
+// per second up to Burst tokens, every picked task takes one token.
+// Zero Rate means no limit.
+type RateLimit struct {
+	Rate float64
+	// Burst is max tokens the bucket holds, less than 1 is treated as 1.
+	Burst int
+}
+
+// rateLimitPrefix returns field prefix of the limit in ratelimit hash,
+// queue limit has no prefix and task type limit is prefixed by t:{type}:.
+func rateLimitPrefix(taskType string) string {
+	if taskType == "" {
+		return ""
+	}
+	return "t:" + taskType + ":"
+}
+
+func (r RateLimit) fields(prefix string) []string {
+	return []string{
+		prefix + "rate", strconv.FormatFloat(r.Rate, 'f', -1, 64),
+		prefix + "burst", strconv.Itoa(max(r.Burst, 1)),
+	}
+}
+
+// RateLimitError is returned by handler when the task hits a rate limit of third party,
+// the task is retried after RetryIn without consuming a retry.
+type RateLimitError struct {
+	RetryIn time.Duration
+	Err     error
+}
+
+func (e *RateLimitError) Error() string {
+	if e.Err == nil {
+		return fmt.Sprintf("rate limited, retry in %v", e.RetryIn)
+	}
+	return fmt.Sprintf("rate limited, retry in %v: %v", e.RetryIn, e.Err)
+}
+
+func (e *RateLimitError) Unwrap() error {
+	return e.Err
+}
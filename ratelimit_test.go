@@ -0,0 +1,103 @@
+package acornq
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestRedisBroker_RateLimit(t *testing.T) {
+	redisCli := client(t)
+	for _, layout := range testLayouts(t, redisCli) {
+		t.Run(layout.String(), func(t *testing.T) {
+			ctx := context.Background()
+			broker := NewRedisBrokerWithLayout(redisCli, layout)
+			cli := NewClientWithBroker(broker)
+			llen := func(key string) int64 {
+				n, err := redisCli.Do(ctx, redisCli.B().Llen().Key(key).Build()).AsInt64()
+				require.Nil(t, err)
+				return n
+			}
+			pick := func(queue string) int {
+				ts, err := broker.PickTasks(ctx, []string{queue}, 4, nil)
+				require.Nil(t, err)
+				return len(ts)
+			}
+
+			// task type limit
+			queue := testQueue(t)
+			keyInfo := NewKeyInfo(queue)
+			for _, id := range []string{"a", "b", "c", "d"} {
+				require.Nil(t, cli.EnqueueContext(ctx, NewTask("limited", nil), Queue(queue), TaskID(id)))
+			}
+			require.Nil(t, broker.SetRateLimit(ctx, queue, "limited", RateLimit{Rate: 1, Burst: 2}))
+			assert.Equal(t, 2, pick(queue))
+			// tasks over the limit are scheduled until next token
+			n, err := redisCli.Do(ctx, redisCli.B().Zcard().Key(keyInfo.ScheduledKey()).Build()).AsInt64()
+			require.Nil(t, err)
+			assert.Equal(t, int64(2), n)
+			assert.Equal(t, Scheduled, getTask(t, redisCli, layout, keyInfo.TaskKey("c")).State)
+			assert.Equal(t, 0, pick(queue))
+			time.Sleep(1100 * time.Millisecond)
+			assert.Equal(t, 1, pick(queue))
+			assert.Equal(t, int64(3), llen(keyInfo.ActiveKey()))
+
+			// queue limit, tasks are left in pending list
+			queue = testQueue(t) + ":q"
+			keyInfo = NewKeyInfo(queue)
+			for _, id := range []string{"a", "b", "c"} {
+				require.Nil(t, cli.EnqueueContext(ctx, NewTask("task", nil), Queue(queue), TaskID(id)))
+			}
+			require.Nil(t, broker.SetRateLimit(ctx, queue, "", RateLimit{Rate: 1}))
+			assert.Equal(t, 1, pick(queue))
+			assert.Equal(t, int64(2), llen(keyInfo.PendingKey()))
+			// zero rate removes the limit
+			require.Nil(t, broker.SetRateLimit(ctx, queue, "", RateLimit{}))
+			assert.Equal(t, 2, pick(queue))
+		})
+	}
+}
+
+func TestServer_RateLimitError(t *testing.T) {
+	ctx := context.Background()
+	broker := NewMemoryBroker()
+	handled := make(chan struct{}, 2)
+	s, err := NewServer(&Config{
+		Handler: TaskHandlerFunc(func(task *TaskInfo) error {
+			handled <- struct{}{}
+			return &RateLimitError{RetryIn: time.Minute}
+		}),
+		Broker:           broker,
+		TaskPeekInterval: 10 * time.Millisecond,
+		ErrHandler:       func(err error) { t.Error(err) },
+	})
+	require.Nil(t, err)
+	go s.Start()
+	defer func() {
+		ctx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+		defer cancel()
+		s.ShutDown(ctx)
+	}()
+	// retried later even without retries left
+	require.Nil(t, NewClientWithBroker(broker).EnqueueContext(ctx, NewTask("task", nil), TaskID("a"), MaxRetry(0)))
+	select {
+	case <-handled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("task not handled")
+	}
+	var task TaskInfo
+	var retryAt int64
+	assert.Eventually(t, func() bool {
+		broker.mu.Lock()
+		defer broker.mu.Unlock()
+		q := broker.queue(defaultQueueName)
+		task, retryAt = *q.tasks["a"], q.retry["a"]
+		return task.State == Retried
+	}, time.Second, time.Millisecond)
+	assert.Equal(t, 0, task.Retried)
+	assert.InDelta(t, time.Now().Add(time.Minute).Unix(), retryAt, 2)
+	assert.Contains(t, string(task.ErrorMsg), "rate limited")
+	assert.Len(t, handled, 0)
+}
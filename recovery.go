@@ -4,19 +4,24 @@ import "time"
 
 type recovery struct {
 	queue         []string
-	broker        *Broker
+	broker        Broker
 	stopCh        chan struct{}
 	errHandler    ErrHandler
 	checkInterval time.Duration
+	// task in active list idle more than idleTimeout is treated as zombie.
+	idleTimeout time.Duration
+	// called with count of recovered tasks
+	recoveredHandler func(n int)
 }
 
-func newRecovery(stopCh chan struct{}, broker *Broker, queue []string, interval time.Duration, errHandler ErrHandler) *recovery {
+func newRecovery(stopCh chan struct{}, broker Broker, queue []string, interval time.Duration, idleTimeout time.Duration, errHandler ErrHandler) *recovery {
 	return &recovery{
 		queue:         queue,
 		broker:        broker,
 		stopCh:        stopCh,
 		errHandler:    errHandler,
 		checkInterval: interval,
+		idleTimeout:   idleTimeout,
 	}
 }
 
@@ -25,11 +30,14 @@ func (r *recovery) Start() {
 	for {
 		select {
 		case <-ticker.C:
-			err := r.broker.RecoveryTasks(r.queue, 55*time.Second)
+			n, err := r.broker.RecoveryTasks(r.queue, r.idleTimeout)
 			if err != nil {
 				r.errHandler(err)
 			}
-			// task in active set idle more than 30 seconds.
+			if r.recoveredHandler != nil {
+				r.recoveredHandler(n)
+			}
+			// task in active set idle more than idleTimeout.
 			// saddunion live and active set max score compare now.
 			// put these tasks back to pending set.
 		case <-r.stopCh:
@@ -0,0 +1,83 @@
+package acornq
+
+import (
+	"context"
+	"errors"
+	"github.com/redis/rueidis"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+var ErrEmptySemaphoreName = errors.New("semaphore name is empty")
+
+// Semaphore limits how many tasks hold it at once across all servers, such as
+// "only 5 tasks may call the partner API".
+//
+// A lease is held by a task and expires at the deadline of the task context, it is
+// released when the handler returns or recovery moves the task back to pending list,
+// expired leases are cleaned up by the next Acquire.
+type Semaphore struct {
+	redisCli rueidis.Client
+	name     string
+	key      string
+	limit    int
+	// name is added into semaphores set
+	registered atomic.Bool
+}
+
+func NewSemaphore(redisCli rueidis.Client, name string, limit int) (s *Semaphore, err error) {
+	if strings.TrimSpace(name) == "" {
+		err = ErrEmptySemaphoreName
+		return
+	}
+	s = &Semaphore{
+		redisCli: redisCli,
+		name:     name,
+		key:      SemaphoreKey(name),
+		limit:    max(limit, 1),
+	}
+	return
+}
+
+// Acquire tries to take a lease for t, ok is false if all leases are taken.
+// It must be called in handler, acquiring again by the same task refreshes its lease.
+func (s *Semaphore) Acquire(t *TaskInfo) (ok bool, err error) {
+	ctx := t.Context()
+	if !s.registered.Load() {
+		// recovery releases leases of semaphores in this set.
+		err = s.redisCli.Do(ctx, s.redisCli.B().Sadd().Key(semaphoresKey).Member(s.name).Build()).Error()
+		if err != nil {
+			return
+		}
+		s.registered.Store(true)
+	}
+	expireAt, has := ctx.Deadline()
+	if !has {
+		expireAt = t.deadline(time.Now())
+	}
+	v, err := acquireSemaphoreLs.Exec(ctx, s.redisCli, []string{s.key}, []string{
+		strconv.Itoa(s.limit), taskKey(b2s(t.Queue), b2s(t.ID)), strconv.FormatInt(expireAt.Unix(), 10),
+	}).AsInt64()
+	if err != nil {
+		return
+	}
+	ok = v == 1
+	if ok {
+		t.onDone(func() {
+			_ = s.Release(t)
+		})
+	}
+	return
+}
+
+// Release releases the lease held by t, it is called automatically after handling.
+func (s *Semaphore) Release(t *TaskInfo) error {
+	return s.redisCli.Do(context.Background(), s.redisCli.B().Zrem().Key(s.key).Member(taskKey(b2s(t.Queue), b2s(t.ID))).Build()).Error()
+}
+
+// Name returns the semaphore name.
+func (s *Semaphore) Name() string {
+	return s.name
+}
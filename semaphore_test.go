@@ -0,0 +1,159 @@
+package acornq
+
+import (
+	"context"
+	"github.com/redis/rueidis"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestSemaphore(t *testing.T) {
+	redisCli := client(t)
+	ctx := context.Background()
+	_, err := NewSemaphore(redisCli, " ", 1)
+	assert.ErrorIs(t, err, ErrEmptySemaphoreName)
+
+	queue := testQueue(t)
+	sema, err := NewSemaphore(redisCli, queue, 2)
+	require.Nil(t, err)
+	holders := func() []string {
+		members, err := redisCli.Do(ctx, redisCli.B().Zrange().Key(SemaphoreKey(queue)).Min("0").Max("-1").Build()).AsStrSlice()
+		require.Nil(t, err)
+		return members
+	}
+	acquire := func(task *TaskInfo) bool {
+		ok, err := sema.Acquire(task)
+		require.Nil(t, err)
+		return ok
+	}
+	newTask := func(id string) *TaskInfo {
+		return &TaskInfo{ID: StringBytes(id), Queue: StringBytes(queue)}
+	}
+	a, b, c := newTask("a"), newTask("b"), newTask("c")
+
+	// limit
+	assert.True(t, acquire(a))
+	assert.True(t, acquire(b))
+	assert.False(t, acquire(c))
+	// acquiring again refreshes the lease
+	assert.True(t, acquire(a))
+	assert.ElementsMatch(t, []string{taskKey(queue, "a"), taskKey(queue, "b")}, holders())
+
+	// release
+	require.Nil(t, sema.Release(a))
+	assert.True(t, acquire(c))
+	// released after handling
+	b.done()
+	c.done()
+	assert.Empty(t, holders())
+
+	// lease expires at the deadline of task context
+	sema1, err := NewSemaphore(redisCli, queue+":1", 1)
+	require.Nil(t, err)
+	deadline := time.Now().Add(time.Second)
+	d, cancel := context.WithDeadline(ctx, deadline)
+	defer cancel()
+	a.ctx = d
+	ok, err := sema1.Acquire(a)
+	require.Nil(t, err)
+	assert.True(t, ok)
+	score, err := redisCli.Do(ctx, redisCli.B().Zscore().Key(SemaphoreKey(queue+":1")).Member(taskKey(queue, "a")).Build()).AsInt64()
+	require.Nil(t, err)
+	assert.Equal(t, deadline.Unix(), score)
+	ok, err = sema1.Acquire(b)
+	require.Nil(t, err)
+	assert.False(t, ok)
+	assert.Eventually(t, func() bool {
+		ok, err := sema1.Acquire(b)
+		require.Nil(t, err)
+		return ok
+	}, 5*time.Second, 100*time.Millisecond)
+}
+
+func TestSemaphore_ReleasedByRecovery(t *testing.T) {
+	redisCli := client(t)
+	for _, layout := range testLayouts(t, redisCli) {
+		t.Run(layout.String(), func(t *testing.T) {
+			ctx := context.Background()
+			queue := testQueue(t)
+			broker := NewRedisBrokerWithLayout(redisCli, layout)
+			sema, err := NewSemaphore(redisCli, queue, 1)
+			require.Nil(t, err)
+			require.Nil(t, NewClientWithBroker(broker).EnqueueContext(ctx, NewTask("task", nil), Queue(queue), TaskID("a")))
+			ts, err := broker.PickTasks(ctx, []string{queue}, 1, nil)
+			require.Nil(t, err)
+			require.Len(t, ts, 1)
+			ok, err := sema.Acquire(ts[0])
+			require.Nil(t, err)
+			assert.True(t, ok)
+
+			// the task is left by a stopped server
+			time.Sleep(1100 * time.Millisecond)
+			n, err := broker.RecoveryTasks([]string{queue}, 0)
+			require.Nil(t, err)
+			assert.Equal(t, 1, n)
+			_, err = redisCli.Do(ctx, redisCli.B().Zscore().Key(SemaphoreKey(queue)).Member(taskKey(queue, "a")).Build()).AsInt64()
+			assert.True(t, rueidis.IsRedisNil(err))
+		})
+	}
+}
+
+func TestSemaphore_KeptByRunningTask(t *testing.T) {
+	redisCli := client(t)
+	for _, layout := range testLayouts(t, redisCli) {
+		t.Run(layout.String(), func(t *testing.T) {
+			testSemaphoreKeptByRunningTask(t, redisCli, NewRedisBrokerWithLayout(redisCli, layout))
+		})
+	}
+}
+
+// testSemaphoreKeptByRunningTask checks a task handled longer than RecoveryIdleTimeout keeps its lease,
+// recovery does not release it while the handler is running.
+func testSemaphoreKeptByRunningTask(t *testing.T, redisCli rueidis.Client, broker Broker) {
+	ctx := context.Background()
+	queue := testQueue(t)
+	sema, err := NewSemaphore(redisCli, queue, 1)
+	require.Nil(t, err)
+	acquired, done := make(chan bool, 1), make(chan struct{})
+	s, err := NewServer(&Config{
+		Handler: TaskHandlerFunc(func(task *TaskInfo) error {
+			ok, err := sema.Acquire(task)
+			acquired <- ok && err == nil
+			<-done
+			return nil
+		}),
+		Queues:              map[string]int{queue: 1},
+		Broker:              broker,
+		TaskPeekInterval:    10 * time.Millisecond,
+		HeartbeatInterval:   time.Second,
+		RecoveryInterval:    500 * time.Millisecond,
+		RecoveryIdleTimeout: 6 * time.Second,
+		ErrHandler:          func(err error) { t.Error(err) },
+	})
+	require.Nil(t, err)
+	go s.Start()
+	defer func() {
+		ctx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+		defer cancel()
+		s.ShutDown(ctx)
+	}()
+	require.Nil(t, NewClientWithBroker(broker).EnqueueContext(ctx, NewTask("task", nil), Queue(queue), TaskID("a")))
+	select {
+	case ok := <-acquired:
+		require.True(t, ok)
+	case <-time.After(5 * time.Second):
+		t.Fatal("task not handled")
+	}
+	time.Sleep(8 * time.Second)
+	ok, err := sema.Acquire(&TaskInfo{ID: StringBytes("b"), Queue: StringBytes(queue)})
+	require.Nil(t, err)
+	assert.False(t, ok)
+	close(done)
+	assert.Eventually(t, func() bool {
+		n, err := redisCli.Do(ctx, redisCli.B().Zcard().Key(SemaphoreKey(queue)).Build()).AsInt64()
+		require.Nil(t, err)
+		return n == 0
+	}, time.Second, 10*time.Millisecond)
+}
@@ -169,3 +169,11 @@ type HandlerFunc func(context.Context, *TaskInfo) error
 func (fn HandlerFunc) ProcessTask(ctx context.Context, task *TaskInfo) error {
 	return fn(ctx, task)
 }
+
+// ToTaskHandler adapts h, such as a ServeMux, to the TaskHandler called by Server,
+// h is called with the context of the task.
+func ToTaskHandler(h Handler) TaskHandler {
+	return TaskHandlerFunc(func(task *TaskInfo) error {
+		return h.ProcessTask(task.Context(), task)
+	})
+}
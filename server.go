@@ -9,27 +9,43 @@ import (
 	"math/rand"
 	"os"
 	"os/signal"
-	"sort"
 	"sync"
 	"sync/atomic"
 	"time"
 )
 
 var (
-	defaultCleanerInterval   = time.Minute
-	defaultRecoverInterval   = time.Minute
-	defaultTaskPeekInterval  = time.Second
-	defaultWorkerConcurrency = 10
-	defaultQueues            = map[string]int{"default": 0}
+	defaultCleanerInterval        = time.Minute
+	defaultRecoverInterval        = time.Minute
+	defaultTaskPeekInterval       = time.Second
+	defaultWorkerConcurrency      = 10
+	defaultQueues                 = map[string]int{"default": 0}
+	defaultHeartbeatInterval      = 25 * time.Second
+	defaultHeartbeatBatchInterval = 20 * time.Second
+	defaultRecoveryIdleTimeout    = 55 * time.Second
+	// RecoveryIdleTimeout must exceed HeartbeatInterval at least this long,
+	// otherwise a live task may be recovered between two heartbeats.
+	recoveryIdleSafetyMargin = 5 * time.Second
 )
 var ErrEmptyHandler = errors.New("task handler is empty")
 var ErrNilServerConfig = errors.New("server config is nil")
+
+// SkipRetry is returned(may be wrapped) by handler to archive the task as failed without retry.
 var SkipRetry = errors.New("skip retry for the task")
+
+// RevokeTask is returned(may be wrapped) by handler to delete the task outright,
+// it is neither retried nor archived.
+var RevokeTask = errors.New("revoke the task")
 var ErrNilBroker = errors.New("broker is nil")
+var ErrNegativeMaxInFlight = errors.New("queue max in-flight cannot be negative")
+var ErrHeartbeatBatchInterval = errors.New("heartbeat batch interval cannot exceed heartbeat interval")
+var ErrRecoveryIdleTimeout = errors.New("recovery idle timeout must exceed heartbeat interval by at least " + recoveryIdleSafetyMargin.String())
 
 type ErrHandler func(err error)
 type RetryDelayFunc func(n int, e error, t *TaskInfo) time.Duration
 type Server struct {
+	// host:pid:uuid
+	id string
 	// task handler
 	handler    TaskHandler
 	errHandler ErrHandler
@@ -37,10 +53,18 @@ type Server struct {
 	concurrency int
 	// queue name to priority
 	queues         map[string]int
+	queueConfigs   map[string]QueueConfig
 	retryDelayFunc RetryDelayFunc
 	// queue arrange fixed
 	queuesStrict bool
-	broker       *Broker
+	// queues in priority order
+	wq *weightedQueues
+	// decides queues order of every pick, shared by workers
+	selector QueueSelector
+	broker   Broker
+	// payloads offloaded by clients
+	blobStore BlobStore
+	encryptor Encryptor
 	// notify component exit
 	stop atomic.Int32
 	// notify component exit
@@ -49,32 +73,87 @@ type Server struct {
 	shutDown         chan struct{}
 	mu               sync.Mutex
 	wg               sync.WaitGroup
-	ws               []*Worker
+	pool             *WorkerPool
 	keysInfos        []*KeyInfo
 	isFailure        func(err error) bool
 	r                *recovery
 	h                *heartBeatWorker
 	c                *Cleaner
+	state            *serverState
+	n                *notifier
+	f                *fetcher
 	taskPeekInterval time.Duration
 	recoverInterval  time.Duration
 	cleanerInterval  time.Duration
+	// heartbeat and recovery thresholds
+	heartbeatInterval      time.Duration
+	heartbeatBatchInterval time.Duration
+	recoveryIdleTimeout    time.Duration
 }
 type Config struct {
 	// task handler
 	Handler TaskHandler
 	// max worker count
 	Concurrency int
-	// queue name to priority
+	// queue name to priority, priority less than 1 is treated as 1.
+	// Queues are tried in weighted random order, a queue with higher priority
+	// is more likely to be tried first.
 	Queues map[string]int
-	// queue arrange fixed
-	QueuesStrict     bool
-	RetryDelayFunc   RetryDelayFunc
-	IsFailure        func(err error) bool
+	// QueueConfigs configures queues beyond priority, its queues are merged into Queues
+	// and their Priority overrides the one in Queues.
+	QueueConfigs map[string]QueueConfig
+	// queue arrange fixed, queues are always tried by priority from high to low.
+	QueuesStrict bool
+	// QueueSelector decides queues order of every pick, it overrides QueuesStrict.
+	// Weighted or strict selector is used by QueuesStrict if it is nil.
+	QueueSelector  QueueSelector
+	RetryDelayFunc RetryDelayFunc
+	IsFailure      func(err error) bool
+	// TaskPeekInterval is how long an idle worker waits before polling again,
+	// idle workers are woken earlier by notification when tasks enter pending list.
 	TaskPeekInterval time.Duration
+	// Prefetch is the count of tasks picked ahead beyond idle workers, 0 by default.
+	// Prefetched tasks are in active list while waiting, keep it small for long tasks,
+	// otherwise they may be recovered before any worker takes them.
+	Prefetch         int
 	CleanerInterval  time.Duration
 	RecoveryInterval time.Duration
-	ErrHandler       ErrHandler
-	Broker           *Broker
+	// HeartbeatInterval is how often the live scores of active tasks are refreshed.
+	HeartbeatInterval time.Duration
+	// HeartbeatBatchInterval is the window active tasks are collected into one heartbeat batch,
+	// it cannot exceed HeartbeatInterval.
+	HeartbeatBatchInterval time.Duration
+	// RecoveryIdleTimeout is how long an active task may go without heartbeat before
+	// recovery moves it back to pending list, it must exceed HeartbeatInterval by a safety margin.
+	RecoveryIdleTimeout time.Duration
+	ErrHandler          ErrHandler
+	Broker              Broker
+	// BlobStore fetches payloads offloaded by Client.SetBlobStore, blobs are deleted
+	// when their tasks are deleted by workers or Cleaner.
+	BlobStore BlobStore
+	// Encryptor decrypts payloads encrypted by Client.SetEncryptor.
+	Encryptor Encryptor
+	// RecoveredHandler is called with the count of tasks moved back to pending by every recovery,
+	// non-zero counts are logged by default.
+	RecoveredHandler func(n int)
+}
+
+// QueueConfig configures a queue of the server.
+type QueueConfig struct {
+	// Priority of the queue, see Config.Queues.
+	Priority int
+	// MaxInFlight is max tasks of the queue this server handles at once, 0 means no limit.
+	// A saturated queue is skipped by picks until one of its tasks is done.
+	MaxInFlight int
+	// RateLimit limits how fast tasks of the queue are picked across all servers,
+	// it is written into redis when server starts.
+	RateLimit *RateLimit
+	// TypeRateLimits limits how fast tasks of a type in the queue are picked across all servers,
+	// it is written into redis when server starts.
+	TypeRateLimits map[string]RateLimit
+	// DeadLetter moves tasks exhausted their retries into the dead letter stream of the queue
+	// instead of failed list, see Inspector.ReplayDeadLetter.
+	DeadLetter bool
 }
 
 func NewServer(cfg *Config) (s *Server, err error) {
@@ -84,6 +163,8 @@ func NewServer(cfg *Config) (s *Server, err error) {
 	}
 	stopCh := make(chan struct{})
 	s = &Server{
+		id:               newServerID(),
+		queueConfigs:     cfg.QueueConfigs,
 		handler:          cfg.Handler,
 		concurrency:      cfg.Concurrency,
 		queues:           cfg.Queues,
@@ -94,18 +175,91 @@ func NewServer(cfg *Config) (s *Server, err error) {
 		shutDown:         make(chan struct{}),
 		errHandler:       cfg.ErrHandler,
 		broker:           cfg.Broker,
+		blobStore:        cfg.BlobStore,
+		encryptor:        cfg.Encryptor,
 		cleanerInterval:  cfg.CleanerInterval,
 		recoverInterval:  cfg.RecoveryInterval,
 		taskPeekInterval: cfg.TaskPeekInterval,
+
+		heartbeatInterval:      cfg.HeartbeatInterval,
+		heartbeatBatchInterval: cfg.HeartbeatBatchInterval,
+		recoveryIdleTimeout:    cfg.RecoveryIdleTimeout,
+	}
+	s.wq = newWeightedQueues(s.queues, s.queuesStrict)
+	s.selector = cfg.QueueSelector
+	if s.selector == nil {
+		s.selector = s.wq
 	}
 	s.createKeyInfos()
-	s.broker.keyInfos = s.keysInfos
-	s.r = newRecovery(stopCh, s.broker, s.queueNames(true), s.recoverInterval, s.errHandler)
-	s.h = newHeartBeatWorker(stopCh, nil, s.broker)
+	for _, queue := range s.queueNames() {
+		s.broker.AddQueue(queue)
+	}
+	s.r = newRecovery(stopCh, s.broker, s.queueNames(), s.recoverInterval, s.recoveryIdleTimeout, s.errHandler)
+	s.r.recoveredHandler = cfg.RecoveredHandler
+	s.h = newHeartBeatWorker(stopCh, nil, s.broker, s.heartbeatInterval, s.heartbeatBatchInterval)
 	s.c = NewCleaner(s.broker, s.cleanerInterval, s.errHandler)
+	s.c.blobStore = s.blobStore
+	s.c.stopCh = stopCh
+	s.n = newNotifier(stopCh, s.broker, s.queueNames(), s.concurrency, s.errHandler)
+	s.pool = newWorkerPool(s)
+	for queue, qc := range cfg.QueueConfigs {
+		s.pool.SetQueueLimit(queue, qc.MaxInFlight)
+	}
+	s.f = newFetcher(stopCh, s.n.wakeCh, s.broker, s.pool, s.selector, s.queueNames(), s.concurrency, cfg.Prefetch, s.taskPeekInterval, s.errHandler)
+	s.state = newServerState(stopCh, s.broker, ServerInfo{
+		ID:          s.id,
+		Host:        hostname(),
+		Queues:      s.queues,
+		Concurrency: s.concurrency,
+		PID:         os.Getpid(),
+	}, s.heartbeatInterval, s.errHandler)
 	return
 }
 
+// SetConcurrency changes count of workers at runtime, extra workers exit after their current task is done.
+func (s *Server) SetConcurrency(n int) {
+	if n <= 0 {
+		return
+	}
+	s.mu.Lock()
+	s.concurrency = n
+	s.mu.Unlock()
+	s.state.setConcurrency(n)
+	s.pool.Resize(n)
+}
+
+// SetQueueConcurrency limits in-flight tasks of queue in this server at runtime, 0 means no limit.
+func (s *Server) SetQueueConcurrency(queue string, n int) {
+	s.pool.SetQueueLimit(queue, n)
+}
+
+// applyRateLimits writes rate limits of QueueConfigs into redis.
+func (s *Server) applyRateLimits() {
+	ctx := context.Background()
+	for queue, qc := range s.queueConfigs {
+		if qc.RateLimit != nil {
+			if err := s.broker.SetRateLimit(ctx, queue, "", *qc.RateLimit); err != nil {
+				s.errHandler(err)
+			}
+		}
+		for taskType, limit := range qc.TypeRateLimits {
+			if err := s.broker.SetRateLimit(ctx, queue, taskType, limit); err != nil {
+				s.errHandler(err)
+			}
+		}
+	}
+}
+
+// Pool returns the worker pool of the server.
+func (s *Server) Pool() *WorkerPool {
+	return s.pool
+}
+
+// ID returns the server identity in host:pid:uuid form.
+func (s *Server) ID() string {
+	return s.id
+}
+
 func patchConfig(cfg *Config) (err error) {
 	if cfg == nil {
 		return ErrNilServerConfig
@@ -116,6 +270,23 @@ func patchConfig(cfg *Config) (err error) {
 	if cfg.Concurrency <= 0 {
 		cfg.Concurrency = defaultWorkerConcurrency
 	}
+	if len(cfg.QueueConfigs) > 0 {
+		// never modify Queues of caller or defaultQueues
+		queues := make(map[string]int, len(cfg.Queues)+len(cfg.QueueConfigs))
+		for queue, priority := range cfg.Queues {
+			queues[queue] = priority
+		}
+		for queue, qc := range cfg.QueueConfigs {
+			if err = validateQueueName(queue); err != nil {
+				return
+			}
+			if qc.MaxInFlight < 0 {
+				return ErrNegativeMaxInFlight
+			}
+			queues[queue] = qc.Priority
+		}
+		cfg.Queues = queues
+	}
 	if cfg.Queues == nil {
 		cfg.Queues = defaultQueues
 	}
@@ -125,6 +296,9 @@ func patchConfig(cfg *Config) (err error) {
 	if cfg.IsFailure == nil {
 		cfg.IsFailure = defaultIsFailureFunc
 	}
+	if cfg.Prefetch < 0 {
+		cfg.Prefetch = 0
+	}
 	if cfg.TaskPeekInterval == 0 {
 		cfg.TaskPeekInterval = defaultTaskPeekInterval
 	}
@@ -134,6 +308,29 @@ func patchConfig(cfg *Config) (err error) {
 	if cfg.RecoveryInterval == 0 {
 		cfg.RecoveryInterval = defaultRecoverInterval
 	}
+	if cfg.HeartbeatInterval <= 0 {
+		cfg.HeartbeatInterval = defaultHeartbeatInterval
+	}
+	if cfg.HeartbeatBatchInterval <= 0 {
+		cfg.HeartbeatBatchInterval = min(defaultHeartbeatBatchInterval, cfg.HeartbeatInterval)
+	}
+	if cfg.HeartbeatBatchInterval > cfg.HeartbeatInterval {
+		return ErrHeartbeatBatchInterval
+	}
+	if cfg.RecoveryIdleTimeout <= 0 {
+		cfg.RecoveryIdleTimeout = max(defaultRecoveryIdleTimeout, 2*cfg.HeartbeatInterval+recoveryIdleSafetyMargin)
+	}
+	if cfg.RecoveryIdleTimeout < cfg.HeartbeatInterval+recoveryIdleSafetyMargin {
+		return ErrRecoveryIdleTimeout
+	}
+	if cfg.RecoveredHandler == nil {
+		idleTimeout := cfg.RecoveryIdleTimeout
+		cfg.RecoveredHandler = func(n int) {
+			if n > 0 {
+				log.Printf("recovered %d tasks idle more than %s", n, idleTimeout)
+			}
+		}
+	}
 	if cfg.ErrHandler == nil {
 		cfg.ErrHandler = func(err error) {
 			log.Println(err)
@@ -146,26 +343,28 @@ func patchConfig(cfg *Config) (err error) {
 }
 
 func (s *Server) Start() {
-	s.wg.Add(s.concurrency)
-	s.ws = make([]*Worker, s.concurrency)
-	beatItemCh := make(chan *liveItem)
-	for i := 0; i < s.concurrency; i++ {
-		w := &Worker{
-			s:            s,
-			queues:       s.queueNames(false),
-			broker:       s.broker,
-			queuesStrict: s.queuesStrict,
-			beatItemCh:   beatItemCh,
-			pollInterval: s.taskPeekInterval,
-		}
-		s.ws[i] = w
-		go func() {
-			defer func() {
-				s.wg.Done()
-			}()
-			w.exec()
+	// live check worker
+	s.h.beatItemCh = make(chan *liveItem)
+	s.wg.Add(1)
+	go func() {
+		defer func() {
+			s.wg.Done()
 		}()
-	}
+		s.h.Start()
+	}()
+	s.applyRateLimits()
+	s.mu.Lock()
+	concurrency := s.concurrency
+	s.mu.Unlock()
+	s.pool.Resize(concurrency)
+	// fetch worker
+	s.wg.Add(1)
+	go func() {
+		defer func() {
+			s.wg.Done()
+		}()
+		s.f.Start()
+	}()
 	// recovery worker
 	s.wg.Add(1)
 	go func() {
@@ -182,13 +381,22 @@ func (s *Server) Start() {
 		}()
 		s.c.Start()
 	}()
-	// live check worker
-	s.h.beatItemCh = beatItemCh
+	// notify worker
+	s.wg.Add(1)
 	go func() {
 		defer func() {
 			s.wg.Done()
 		}()
-		s.h.Start()
+		s.n.Start()
+	}()
+	// server state worker
+	s.state.info.StartedAt = time.Now()
+	s.wg.Add(1)
+	go func() {
+		defer func() {
+			s.wg.Done()
+		}()
+		s.state.Start()
 	}()
 	outputInfo(s)
 	s.waitForSignals()
@@ -212,25 +420,9 @@ func (s *Server) ShutDown(ctx context.Context) {
 	return
 }
 
-func (s *Server) queueNames(customStrict bool) (queues []string) {
-	if s.queuesStrict || customStrict || len(s.queues) == 1 {
-		queues = make([]string, len(s.queues))
-		i := 0
-		for k := range s.queues {
-			queues[i] = k
-			i++
-		}
-		sort.Slice(queues, func(i, j int) bool {
-			return s.queues[queues[i]] > s.queues[queues[j]]
-		})
-		return
-	}
-	for k, v := range s.queues {
-		for i := 0; i < v; i++ {
-			queues = append(queues, k)
-		}
-	}
-	return
+// queueNames returns queue names ordered by priority from high to low.
+func (s *Server) queueNames() (queues []string) {
+	return s.wq.names
 }
 
 func (s *Server) createKeyInfos() {
@@ -0,0 +1,363 @@
+package acornq
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// errAny matches any non-nil error in table tests.
+var errAny = errors.New("any error")
+
+func TestPatchConfig(t *testing.T) {
+	handler := TaskHandlerFunc(func(*TaskInfo) error { return nil })
+	broker := NewMemoryBroker()
+	tests := []struct {
+		name  string
+		cfg   *Config
+		err   error
+		check func(t *testing.T, cfg *Config)
+	}{
+		{name: "nil config", cfg: nil, err: ErrNilServerConfig},
+		{name: "nil handler", cfg: &Config{Broker: broker}, err: ErrEmptyHandler},
+		{name: "nil broker", cfg: &Config{Handler: handler}, err: ErrNilBroker},
+		{
+			name: "defaults",
+			cfg:  &Config{Handler: handler, Broker: broker, Prefetch: -1},
+			check: func(t *testing.T, cfg *Config) {
+				assert.Equal(t, defaultWorkerConcurrency, cfg.Concurrency)
+				assert.Equal(t, defaultQueues, cfg.Queues)
+				assert.Equal(t, 0, cfg.Prefetch)
+				assert.Equal(t, defaultTaskPeekInterval, cfg.TaskPeekInterval)
+				assert.Equal(t, defaultCleanerInterval, cfg.CleanerInterval)
+				assert.Equal(t, defaultRecoverInterval, cfg.RecoveryInterval)
+				assert.Equal(t, defaultHeartbeatInterval, cfg.HeartbeatInterval)
+				assert.Equal(t, defaultHeartbeatBatchInterval, cfg.HeartbeatBatchInterval)
+				assert.Equal(t, defaultRecoveryIdleTimeout, cfg.RecoveryIdleTimeout)
+				assert.NotNil(t, cfg.RetryDelayFunc)
+				assert.NotNil(t, cfg.IsFailure)
+				assert.NotNil(t, cfg.ErrHandler)
+				assert.NotNil(t, cfg.RecoveredHandler)
+			},
+		},
+		{
+			name: "batch interval follows short heartbeat interval",
+			cfg:  &Config{Handler: handler, Broker: broker, HeartbeatInterval: 2 * time.Second},
+			check: func(t *testing.T, cfg *Config) {
+				assert.Equal(t, 2*time.Second, cfg.HeartbeatBatchInterval)
+				assert.Equal(t, defaultRecoveryIdleTimeout, cfg.RecoveryIdleTimeout)
+			},
+		},
+		{
+			name: "idle timeout follows long heartbeat interval",
+			cfg:  &Config{Handler: handler, Broker: broker, HeartbeatInterval: time.Minute},
+			check: func(t *testing.T, cfg *Config) {
+				assert.Equal(t, defaultHeartbeatBatchInterval, cfg.HeartbeatBatchInterval)
+				assert.Equal(t, 2*time.Minute+recoveryIdleSafetyMargin, cfg.RecoveryIdleTimeout)
+			},
+		},
+		{
+			name: "batch interval exceeds heartbeat interval",
+			cfg:  &Config{Handler: handler, Broker: broker, HeartbeatInterval: time.Second, HeartbeatBatchInterval: 2 * time.Second},
+			err:  ErrHeartbeatBatchInterval,
+		},
+		{
+			name: "idle timeout within safety margin",
+			cfg:  &Config{Handler: handler, Broker: broker, HeartbeatInterval: 10 * time.Second, RecoveryIdleTimeout: 14 * time.Second},
+			err:  ErrRecoveryIdleTimeout,
+		},
+		{
+			name: "idle timeout at safety margin",
+			cfg:  &Config{Handler: handler, Broker: broker, HeartbeatInterval: 10 * time.Second, RecoveryIdleTimeout: 15 * time.Second},
+			check: func(t *testing.T, cfg *Config) {
+				assert.Equal(t, 15*time.Second, cfg.RecoveryIdleTimeout)
+			},
+		},
+		{
+			name: "queue configs are merged into queues",
+			cfg: &Config{Handler: handler, Broker: broker, Queues: map[string]int{"a": 1, "b": 2},
+				QueueConfigs: map[string]QueueConfig{"b": {Priority: 3}, "c": {Priority: 4, MaxInFlight: 1}}},
+			check: func(t *testing.T, cfg *Config) {
+				assert.Equal(t, map[string]int{"a": 1, "b": 3, "c": 4}, cfg.Queues)
+			},
+		},
+		{
+			name: "negative max in-flight",
+			cfg:  &Config{Handler: handler, Broker: broker, QueueConfigs: map[string]QueueConfig{"a": {MaxInFlight: -1}}},
+			err:  ErrNegativeMaxInFlight,
+		},
+		{
+			name: "empty queue name",
+			cfg:  &Config{Handler: handler, Broker: broker, QueueConfigs: map[string]QueueConfig{" ": {}}},
+			err:  errAny,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := patchConfig(tt.cfg)
+			switch tt.err {
+			case nil:
+				require.Nil(t, err)
+				tt.check(t, tt.cfg)
+			case errAny:
+				assert.NotNil(t, err)
+			default:
+				assert.ErrorIs(t, err, tt.err)
+			}
+		})
+	}
+}
+
+func TestPatchConfig_KeepsCallerQueues(t *testing.T) {
+	queues := map[string]int{"a": 1}
+	cfg := &Config{Handler: TaskHandlerFunc(func(*TaskInfo) error { return nil }), Broker: NewMemoryBroker(),
+		Queues: queues, QueueConfigs: map[string]QueueConfig{"b": {Priority: 2}}}
+	require.Nil(t, patchConfig(cfg))
+	assert.Equal(t, map[string]int{"a": 1, "b": 2}, cfg.Queues)
+	assert.Equal(t, map[string]int{"a": 1}, queues)
+	cfg = &Config{Handler: cfg.Handler, Broker: cfg.Broker, QueueConfigs: map[string]QueueConfig{"b": {Priority: 2}}}
+	require.Nil(t, patchConfig(cfg))
+	assert.Equal(t, map[string]int{"b": 2}, cfg.Queues)
+	assert.Equal(t, map[string]int{"default": 0}, defaultQueues)
+}
+
+func TestServer_MaxInFlight(t *testing.T) {
+	ctx := context.Background()
+	broker := NewMemoryBroker()
+	var running, maxRunning atomic.Int32
+	done := make(chan struct{}, 10)
+	s, err := NewServer(&Config{
+		Handler: TaskHandlerFunc(func(task *TaskInfo) error {
+			n := running.Add(1)
+			for {
+				m := maxRunning.Load()
+				if n <= m || maxRunning.CompareAndSwap(m, n) {
+					break
+				}
+			}
+			time.Sleep(20 * time.Millisecond)
+			running.Add(-1)
+			done <- struct{}{}
+			return nil
+		}),
+		Concurrency:      4,
+		QueueConfigs:     map[string]QueueConfig{"limited": {Priority: 1, MaxInFlight: 1}},
+		Broker:           broker,
+		TaskPeekInterval: 10 * time.Millisecond,
+		ErrHandler:       func(err error) { t.Error(err) },
+	})
+	require.Nil(t, err)
+	go s.Start()
+	defer func() {
+		ctx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+		defer cancel()
+		s.ShutDown(ctx)
+	}()
+	cli := NewClientWithBroker(broker)
+	for i := 0; i < 5; i++ {
+		require.Nil(t, cli.EnqueueContext(ctx, NewTask("task", nil), Queue("limited")))
+	}
+	for i := 0; i < 5; i++ {
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("task not handled")
+		}
+	}
+	assert.Equal(t, int32(1), maxRunning.Load())
+}
+
+// TestServer_MaxActive checks the cluster-wide cap of active tasks is kept by the redis pick scripts
+// while two servers pick from the same queue.
+func TestServer_MaxActive(t *testing.T) {
+	redisCli := client(t)
+	for _, layout := range testLayouts(t, redisCli) {
+		t.Run(layout.String(), func(t *testing.T) {
+			ctx := context.Background()
+			queue := testQueue(t)
+			var running, maxRunning atomic.Int32
+			done := make(chan struct{}, 8)
+			for i := 0; i < 2; i++ {
+				s, err := NewServer(&Config{
+					Handler: TaskHandlerFunc(func(task *TaskInfo) error {
+						n := running.Add(1)
+						for {
+							m := maxRunning.Load()
+							if n <= m || maxRunning.CompareAndSwap(m, n) {
+								break
+							}
+						}
+						time.Sleep(50 * time.Millisecond)
+						running.Add(-1)
+						done <- struct{}{}
+						return nil
+					}),
+					Concurrency:      4,
+					Queues:           map[string]int{queue: 1},
+					Broker:           NewRedisBrokerWithLayout(redisCli, layout),
+					TaskPeekInterval: 10 * time.Millisecond,
+					ErrHandler:       func(err error) { t.Error(err) },
+				})
+				require.Nil(t, err)
+				go s.Start()
+				defer func() {
+					ctx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+					defer cancel()
+					s.ShutDown(ctx)
+				}()
+			}
+			broker := NewRedisBrokerWithLayout(redisCli, layout)
+			require.Nil(t, broker.SetMaxActive(ctx, queue, 2))
+			cli := NewClientWithBroker(broker)
+			for i := 0; i < 8; i++ {
+				require.Nil(t, cli.EnqueueContext(ctx, NewTask("task", nil), Queue(queue)))
+			}
+			activeKey := NewKeyInfo(queue).ActiveKey()
+			for i := 0; i < 8; {
+				select {
+				case <-done:
+					i++
+				case <-time.After(5 * time.Second):
+					t.Fatal("task not handled")
+				}
+				n, err := redisCli.Do(ctx, redisCli.B().Llen().Key(activeKey).Build()).AsInt64()
+				require.Nil(t, err)
+				assert.LessOrEqual(t, n, int64(2))
+			}
+			assert.Equal(t, int32(2), maxRunning.Load())
+		})
+	}
+}
+
+func TestServer_SetConcurrency(t *testing.T) {
+	ctx := context.Background()
+	broker := NewMemoryBroker()
+	done := make(chan struct{}, 10)
+	s, err := NewServer(&Config{
+		Handler: TaskHandlerFunc(func(task *TaskInfo) error {
+			done <- struct{}{}
+			return nil
+		}),
+		Concurrency:      1,
+		Prefetch:         2,
+		Broker:           broker,
+		TaskPeekInterval: 10 * time.Millisecond,
+		ErrHandler:       func(err error) { t.Error(err) },
+	})
+	require.Nil(t, err)
+	go s.Start()
+	defer func() {
+		ctx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+		defer cancel()
+		s.ShutDown(ctx)
+	}()
+	require.Eventually(t, func() bool { return s.pool.Size() == 1 }, time.Second, time.Millisecond)
+	assert.Equal(t, 3, cap(s.f.tasks()))
+	s.SetConcurrency(4)
+	assert.Eventually(t, func() bool { return cap(s.f.tasks()) == 6 }, time.Second, time.Millisecond)
+	cli := NewClientWithBroker(broker)
+	for i := 0; i < 5; i++ {
+		require.Nil(t, cli.EnqueueContext(ctx, NewTask("task", nil)))
+	}
+	for i := 0; i < 5; i++ {
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("task not handled")
+		}
+	}
+	s.SetConcurrency(2)
+	assert.Eventually(t, func() bool { return cap(s.f.tasks()) == 4 }, time.Second, time.Millisecond)
+}
+
+func TestServer_LongRunningTask(t *testing.T) {
+	t.Run("memory", func(t *testing.T) {
+		testLongRunningTask(t, NewMemoryBroker(), defaultQueueName)
+	})
+	t.Run("redis", func(t *testing.T) {
+		redisCli := client(t)
+		for _, layout := range testLayouts(t, redisCli) {
+			t.Run(layout.String(), func(t *testing.T) {
+				testLongRunningTask(t, NewRedisBrokerWithLayout(redisCli, layout), testQueue(t))
+			})
+		}
+	})
+}
+
+// testLongRunningTask checks tasks handled longer than RecoveryIdleTimeout are kept alive by heartbeat,
+// they are neither recovered nor handled twice.
+func testLongRunningTask(t *testing.T, broker Broker, queue string) {
+	ctx := context.Background()
+	var handled, recovered atomic.Int32
+	done := make(chan struct{}, 4)
+	s, err := NewServer(&Config{
+		Handler: TaskHandlerFunc(func(task *TaskInfo) error {
+			handled.Add(1)
+			time.Sleep(8 * time.Second)
+			done <- struct{}{}
+			return nil
+		}),
+		Queues:              map[string]int{queue: 1},
+		Broker:              broker,
+		TaskPeekInterval:    10 * time.Millisecond,
+		HeartbeatInterval:   time.Second,
+		RecoveryInterval:    500 * time.Millisecond,
+		RecoveryIdleTimeout: 6 * time.Second,
+		RecoveredHandler:    func(n int) { recovered.Add(int32(n)) },
+		ErrHandler:          func(err error) { t.Error(err) },
+	})
+	require.Nil(t, err)
+	go s.Start()
+	defer func() {
+		ctx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+		defer cancel()
+		s.ShutDown(ctx)
+	}()
+	// tasks picked together share a heartbeat batch
+	cli := NewClientWithBroker(broker)
+	for i := 0; i < 2; i++ {
+		require.Nil(t, cli.EnqueueContext(ctx, NewTask("task", nil), Queue(queue)))
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case <-done:
+		case <-time.After(15 * time.Second):
+			t.Fatal("task not handled")
+		}
+	}
+	// recovery runs at least once after tasks are done
+	time.Sleep(time.Second)
+	assert.Equal(t, int32(2), handled.Load())
+	assert.Equal(t, int32(0), recovered.Load())
+}
+
+func TestRecovery_RecoveredHandler(t *testing.T) {
+	ctx := context.Background()
+	b, now := newTestMemoryBroker()
+	b.AddQueue("q")
+	require.Nil(t, b.EnqueueTasks(ctx, []*TaskInfo{{ID: StringBytes("1"), Type: StringBytes("a"), Queue: StringBytes("q")}}))
+	_, err := b.PickTasks(ctx, []string{"q"}, 1, nil)
+	require.Nil(t, err)
+	*now = now.Add(time.Minute)
+	recovered := make(chan int, 1)
+	stopCh := make(chan struct{})
+	r := newRecovery(stopCh, b, []string{"q"}, 10*time.Millisecond, 30*time.Second, func(err error) { t.Error(err) })
+	r.recoveredHandler = func(n int) {
+		select {
+		case recovered <- n:
+		default:
+		}
+	}
+	go r.Start()
+	defer close(stopCh)
+	select {
+	case n := <-recovered:
+		assert.Equal(t, 1, n)
+	case <-time.After(5 * time.Second):
+		t.Fatal("recovery not run")
+	}
+}
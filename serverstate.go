@@ -0,0 +1,167 @@
+package acornq
+
+import (
+	"context"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ServerStatus denotes the status of a server.
+type ServerStatus string
+
+const (
+	ServerActive  ServerStatus = "active"
+	ServerClosing ServerStatus = "closing"
+)
+
+// ServerInfo describes a running server, written into redis by every server periodically.
+type ServerInfo struct {
+	ID          string
+	Host        string
+	PID         int
+	Queues      map[string]int
+	Concurrency int
+	StartedAt   time.Time
+	Status      ServerStatus
+	// tasks the server is handling now
+	ActiveWorkers []*WorkerInfo
+}
+
+// WorkerInfo describes a task in handling and the worker handling it.
+type WorkerInfo struct {
+	ServerID  string    `json:"server_id"`
+	WorkerID  int       `json:"worker_id"`
+	TaskID    string    `json:"task_id"`
+	TaskType  string    `json:"task_type"`
+	Queue     string    `json:"queue"`
+	StartedAt time.Time `json:"started_at"`
+}
+
+func hostname() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown-host"
+	}
+	return host
+}
+
+func newServerID() string {
+	u := uuidBytes()
+	return hostname() + ":" + strconv.Itoa(os.Getpid()) + ":" + string(u[:])
+}
+
+// stateFlushDelay is how long a change of workers waits before it is written,
+// changes in the meantime are written together.
+const stateFlushDelay = 100 * time.Millisecond
+
+// serverState writes ServerInfo and WorkerInfo of a server into redis every interval and
+// soon after workers change, keys expire after ttl, so dead servers disappear from Inspector.Servers automatically.
+type serverState struct {
+	info       ServerInfo
+	broker     Broker
+	stopCh     chan struct{}
+	errHandler ErrHandler
+	interval   time.Duration
+	ttl        time.Duration
+	mu         sync.Mutex
+	// taskID -> worker info
+	workers map[string]*WorkerInfo
+	changed chan struct{}
+}
+
+func newServerState(stopCh chan struct{}, broker Broker, info ServerInfo, interval time.Duration, errHandler ErrHandler) *serverState {
+	return &serverState{
+		info:       info,
+		broker:     broker,
+		stopCh:     stopCh,
+		errHandler: errHandler,
+		interval:   interval,
+		ttl:        interval * 2,
+		workers:    map[string]*WorkerInfo{},
+		changed:    make(chan struct{}, 1),
+	}
+}
+
+func (s *serverState) Start() {
+	s.write(ServerActive)
+	ticker := time.NewTicker(s.interval)
+	var flushC <-chan time.Time
+	for {
+		select {
+		case <-ticker.C:
+			s.write(ServerActive)
+		case <-s.changed:
+			if flushC == nil {
+				flushC = time.After(stateFlushDelay)
+			}
+		case <-flushC:
+			flushC = nil
+			s.write(ServerActive)
+		case <-s.stopCh:
+			ticker.Stop()
+			s.write(ServerClosing)
+			return
+		}
+	}
+}
+
+func (s *serverState) write(status ServerStatus) {
+	s.mu.Lock()
+	info := s.info
+	info.Status = status
+	workers := make([]*WorkerInfo, 0, len(s.workers))
+	for _, w := range s.workers {
+		workers = append(workers, w)
+	}
+	s.mu.Unlock()
+	err := s.broker.WriteServerState(context.Background(), &info, workers, s.ttl)
+	if err != nil {
+		s.errHandler(err)
+	}
+}
+
+func (s *serverState) setConcurrency(n int) {
+	s.mu.Lock()
+	s.info.Concurrency = n
+	s.mu.Unlock()
+}
+
+// taskStarted records t is handling by worker workerID.
+func (s *serverState) taskStarted(workerID int, t *TaskInfo) {
+	if s == nil {
+		return
+	}
+	w := &WorkerInfo{
+		ServerID:  s.info.ID,
+		WorkerID:  workerID,
+		TaskID:    string(t.ID),
+		TaskType:  string(t.Type),
+		Queue:     string(t.Queue),
+		StartedAt: time.Now(),
+	}
+	s.mu.Lock()
+	s.workers[w.TaskID] = w
+	s.mu.Unlock()
+	s.notifyChange()
+}
+
+// taskDone removes t from in-flight tasks.
+func (s *serverState) taskDone(t *TaskInfo) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	delete(s.workers, b2s(t.ID))
+	s.mu.Unlock()
+	s.notifyChange()
+}
+
+// notifyChange schedules a write of workers without blocking the worker.
+func (s *serverState) notifyChange() {
+	select {
+	case s.changed <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,73 @@
+package acornq
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestInspector_ServersActiveWorkers(t *testing.T) {
+	t.Run("memory", func(t *testing.T) {
+		testServersActiveWorkers(t, NewMemoryBroker(), defaultQueueName)
+	})
+	t.Run("redis", func(t *testing.T) {
+		redisCli := client(t)
+		for _, layout := range testLayouts(t, redisCli) {
+			t.Run(layout.String(), func(t *testing.T) {
+				testServersActiveWorkers(t, NewRedisBrokerWithLayout(redisCli, layout), testQueue(t))
+			})
+		}
+	})
+}
+
+// testServersActiveWorkers checks a running task is seen long before the next periodic write of server state.
+func testServersActiveWorkers(t *testing.T, broker Broker, queue string) {
+	ctx := context.Background()
+	started, release := make(chan struct{}), make(chan struct{})
+	s, err := NewServer(&Config{
+		Handler: TaskHandlerFunc(func(task *TaskInfo) error {
+			close(started)
+			<-release
+			return nil
+		}),
+		Queues:           map[string]int{queue: 1},
+		Broker:           broker,
+		TaskPeekInterval: 10 * time.Millisecond,
+		ErrHandler:       func(err error) { t.Error(err) },
+	})
+	require.Nil(t, err)
+	go s.Start()
+	defer func() {
+		ctx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+		defer cancel()
+		s.ShutDown(ctx)
+	}()
+	inspector := NewInspectorWithBroker(broker)
+	activeWorkers := func() []*WorkerInfo {
+		servers, err := inspector.Servers(ctx)
+		require.Nil(t, err)
+		for _, server := range servers {
+			if server.ID == s.id {
+				return server.ActiveWorkers
+			}
+		}
+		return nil
+	}
+
+	require.Nil(t, NewClientWithBroker(broker).EnqueueContext(ctx, NewTask("task", nil), Queue(queue), TaskID("running")))
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("task not handled")
+	}
+	assert.Eventually(t, func() bool {
+		workers := activeWorkers()
+		return len(workers) == 1 && workers[0].TaskID == "running" && workers[0].Queue == queue
+	}, time.Second, 10*time.Millisecond)
+	close(release)
+	assert.Eventually(t, func() bool {
+		return len(activeWorkers()) == 0
+	}, time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,372 @@
+package acornq
+
+import (
+	"context"
+	"github.com/redis/rueidis"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// streamGroup is the consumer group of task streams shared by all servers.
+	streamGroup = "acornq"
+	// streamRecoveryConsumer claims idle entries before they are added to stream again.
+	streamRecoveryConsumer = "acornq-recovery"
+	// streamNotifyBlock is how long SubscribeNotify blocks on a read before checking ctx.
+	streamNotifyBlock = time.Second
+)
+
+// StreamBroker is a RedisBroker delivering tasks by a redis stream per queue, read by a consumer group
+// with XREADGROUP, instead of pending and active lists. Delivered but not acknowledged entries are the
+// active tasks, they are recovered by XAUTOCLAIM when idle. Task keys, scheduled, retry and archive
+// sets, dead letter queue and rate limits are the same as RedisBroker.
+//
+// Tasks in pending list, such as replayed from dead letter queue, are moved into stream when picking,
+// so queues created by RedisBroker can be switched to StreamBroker after servers are stopped.
+type StreamBroker struct {
+	*RedisBroker
+	consumer string
+	// task key -> stream entry id of tasks picked by this broker
+	entries sync.Map
+}
+
+// NewStreamBroker returns a StreamBroker stores tasks in layout, every StreamBroker is a consumer
+// of the group, so each server should have its own.
+func NewStreamBroker(redisCli rueidis.Client, layout StorageLayout) *StreamBroker {
+	return &StreamBroker{RedisBroker: NewRedisBrokerWithLayout(redisCli, layout), consumer: newServerID()}
+}
+
+// EnqueueTasks adds tasks to stream or scheduled sorted set.
+func (b *StreamBroker) EnqueueTasks(ctx context.Context, ts []*TaskInfo) (err error) {
+	now := time.Now().Unix()
+	pending := map[string][]*TaskInfo{}
+	var scheduled []*TaskInfo
+	for _, t := range ts {
+		if t.Scheduled(now) {
+			scheduled = append(scheduled, t)
+			continue
+		}
+		pending[b2s(t.Queue)] = append(pending[b2s(t.Queue)], t)
+	}
+	for queue, tasks := range pending {
+		keyInfo := b.keyInfo(queue)
+		keys, argv := make([]string, len(tasks)+1), []string{b.layout.String()}
+		keys[0] = keyInfo.StreamKey()
+		for i, t := range tasks {
+			keys[i+1] = keyInfo.TaskKey(b2s(t.ID))
+			argv, err = b.layout.taskArgs(argv, t)
+			if err != nil {
+				return
+			}
+		}
+		err = streamEnqueueLs.Exec(ctx, b.redisCli, keys, argv).Error()
+		if err != nil {
+			return
+		}
+	}
+	if len(scheduled) > 0 {
+		err = b.RedisBroker.EnqueueTasks(ctx, scheduled)
+	}
+	return
+}
+
+// PickTasks reads at most count new entries of queues by the consumer group,
+// due scheduled and retry tasks are added to stream first.
+func (b *StreamBroker) PickTasks(ctx context.Context, queues []string, count int, limits map[string]int) (ts []*TaskInfo, err error) {
+	var ts1 []*TaskInfo
+	for _, queue := range queues {
+		n := count
+		if limit, ok := limits[queue]; ok {
+			if limit <= 0 {
+				continue
+			}
+			n = min(n, limit)
+		}
+		ts1, err = b.pickTasks(ctx, b.keyInfo(queue), n)
+		if err != nil {
+			return
+		}
+		ts = append(ts, ts1...)
+		count = count - len(ts1)
+		if count == 0 {
+			return
+		}
+	}
+	return
+}
+
+func (b *StreamBroker) pickTasks(ctx context.Context, keyInfo *KeyInfo, count int) (ts []*TaskInfo, err error) {
+	keys := []string{keyInfo.StreamKey(), keyInfo.PendingKey(), keyInfo.ScheduledKey(), keyInfo.RetryKey(), keyInfo.MaxActiveKey(), keyInfo.RateLimitKey()}
+	arr, err := streamPickLs.Exec(ctx, b.redisCli, keys, []string{b.layout.String(), streamGroup, b.consumer, strconv.Itoa(count),
+		strconv.Itoa(int(Pending)), strconv.Itoa(int(Active)), strconv.Itoa(int(Scheduled))}).ToArray()
+	if len(arr) == 0 {
+		return
+	}
+	err = nil
+	ts = make([]*TaskInfo, 0, len(arr))
+	for _, v := range arr {
+		pair, err1 := v.ToArray()
+		if err1 != nil || len(pair) != 2 {
+			continue
+		}
+		id, err1 := pair[0].ToString()
+		if err1 != nil {
+			continue
+		}
+		t, err1 := b.layout.decodeTask(pair[1])
+		if err1 != nil {
+			continue
+		}
+		t.streamID = id
+		b.entries.Store(keyInfo.TaskKey(b2s(t.ID)), id)
+		ts = append(ts, t)
+	}
+	return
+}
+
+// Backlog returns count of stream entries not delivered yet.
+func (b *StreamBroker) Backlog(ctx context.Context, queues []string) (m map[string]int64, err error) {
+	cmds := make(rueidis.Commands, 0, len(queues)*2)
+	names := make([]string, 0, len(queues))
+	for _, queue := range queues {
+		keyInfo := b.keyInfo(queue)
+		if keyInfo == nil {
+			continue
+		}
+		names = append(names, queue)
+		cmds = append(cmds, b.redisCli.B().Xlen().Key(keyInfo.StreamKey()).Build(),
+			b.redisCli.B().Xpending().Key(keyInfo.StreamKey()).Group(streamGroup).Build())
+	}
+	if len(cmds) == 0 {
+		return
+	}
+	m = make(map[string]int64, len(names))
+	resps := b.redisCli.DoMulti(ctx, cmds...)
+	for i, name := range names {
+		n, err1 := resps[i*2].AsInt64()
+		if err1 != nil {
+			return nil, err1
+		}
+		arr, err1 := resps[i*2+1].ToArray()
+		if err1 != nil {
+			// group is created by first pick
+			if !isNoGroup(err1) {
+				return nil, err1
+			}
+		} else if len(arr) > 0 {
+			delivered, err1 := arr[0].AsInt64()
+			if err1 != nil {
+				return nil, err1
+			}
+			n -= delivered
+		}
+		m[name] = n
+	}
+	return
+}
+
+func isNoGroup(err error) bool {
+	redisErr, ok := rueidis.IsRedisErr(err)
+	return ok && strings.HasPrefix(redisErr.Error(), "NOGROUP")
+}
+
+// SubscribeNotify blocks on reading new entries of queue streams until ctx is done,
+// fn is called with queue name and count of new entries.
+func (b *StreamBroker) SubscribeNotify(ctx context.Context, queues []string, fn func(queue string, n int)) (err error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var wg sync.WaitGroup
+	var once sync.Once
+	for _, queue := range queues {
+		keyInfo := b.keyInfo(queue)
+		if keyInfo == nil {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err1 := b.readStream(ctx, keyInfo, fn)
+			if err1 != nil {
+				once.Do(func() {
+					err = err1
+					cancel()
+				})
+			}
+		}()
+	}
+	wg.Wait()
+	<-ctx.Done()
+	return
+}
+
+// readStream reads stream keyInfo from its last entry, streams are read separately
+// because they are in different cluster slots.
+func (b *StreamBroker) readStream(ctx context.Context, keyInfo *KeyInfo, fn func(queue string, n int)) (err error) {
+	lastID := "$"
+	for ctx.Err() == nil {
+		var m map[string][]rueidis.XRangeEntry
+		m, err = b.redisCli.Do(ctx, b.redisCli.B().Xread().Count(100).Block(streamNotifyBlock.Milliseconds()).Streams().
+			Key(keyInfo.StreamKey()).Id(lastID).Build()).AsXRead()
+		//goland:noinspection GoDirectComparisonOfErrors
+		if err == rueidis.Nil {
+			continue
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return
+		}
+		entries := m[keyInfo.StreamKey()]
+		if len(entries) > 0 {
+			lastID = entries[len(entries)-1].ID
+			fn(keyInfo.queue, len(entries))
+		}
+	}
+	return
+}
+
+func (b *StreamBroker) RetryTasks(ctx context.Context, ts []*TaskInfo) (err error) {
+	err = b.RedisBroker.RetryTasks(ctx, ts)
+	if err != nil {
+		return
+	}
+	return b.ack(ctx, ts)
+}
+
+func (b *StreamBroker) Active2Archive(ctx context.Context, ts []*TaskInfo, successful bool) (err error) {
+	err = b.RedisBroker.Active2Archive(ctx, ts, successful)
+	if err != nil {
+		return
+	}
+	return b.ack(ctx, ts)
+}
+
+func (b *StreamBroker) Active2DeadLetter(ctx context.Context, ts []*TaskInfo) (trimmed []*DeadLetterTask, err error) {
+	trimmed, err = b.RedisBroker.Active2DeadLetter(ctx, ts)
+	if err != nil {
+		return
+	}
+	return trimmed, b.ack(ctx, ts)
+}
+
+func (b *StreamBroker) DeleteActiveTasks(ctx context.Context, ts []*TaskInfo) (err error) {
+	err = b.RedisBroker.DeleteActiveTasks(ctx, ts)
+	if err != nil {
+		return
+	}
+	return b.ack(ctx, ts)
+}
+
+// ack acknowledges and deletes stream entries of ts after their tasks left active state,
+// entries left by a failed ack are dropped by recovery.
+func (b *StreamBroker) ack(ctx context.Context, ts []*TaskInfo) (err error) {
+	m := map[string][]string{}
+	for _, t := range ts {
+		if t.streamID == "" {
+			continue
+		}
+		keyInfo := b.keyInfo(b2s(t.Queue))
+		m[keyInfo.StreamKey()] = append(m[keyInfo.StreamKey()], t.streamID)
+		b.entries.Delete(keyInfo.TaskKey(b2s(t.ID)))
+	}
+	for stream, ids := range m {
+		for _, resp := range b.redisCli.DoMulti(ctx,
+			b.redisCli.B().Xack().Key(stream).Group(streamGroup).Id(ids...).Build(),
+			b.redisCli.B().Xdel().Key(stream).Id(ids...).Build()) {
+			if err = resp.Error(); err != nil {
+				return
+			}
+		}
+	}
+	return
+}
+
+// Active2Pending acknowledges entries of ts and adds them to stream again.
+func (b *StreamBroker) Active2Pending(ctx context.Context, ts []*TaskInfo) (err error) {
+	m := map[string][]*TaskInfo{}
+	for _, t := range ts {
+		m[b2s(t.Queue)] = append(m[b2s(t.Queue)], t)
+	}
+	for queue, tasks := range m {
+		keyInfo := b.keyInfo(queue)
+		keys := []string{keyInfo.StreamKey()}
+		args := []string{b.layout.String(), streamGroup, strconv.Itoa(int(Pending))}
+		for _, t := range tasks {
+			if t.streamID == "" {
+				continue
+			}
+			taskKey := keyInfo.TaskKey(b2s(t.ID))
+			keys = append(keys, taskKey)
+			args = append(args, t.streamID)
+			b.entries.Delete(taskKey)
+		}
+		if len(keys) == 1 {
+			continue
+		}
+		err = streamRequeueLs.Exec(ctx, b.redisCli, keys, args).Error()
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// RecoveryTasks claims entries delivered but not acknowledged for idleTimeout and adds their tasks
+// to stream again, consumers without pending entries idle for idleTimeout are deleted.
+//
+// n is the count of tasks added to stream again, semaphore leases held by them are released.
+func (b *StreamBroker) RecoveryTasks(queues []string, idleTimeout time.Duration) (n int, err error) {
+	ctx := context.Background()
+	for _, queue := range queues {
+		keyInfo := b.keyInfo(queue)
+		var taskKeys []string
+		taskKeys, err = streamRecoveryLs.Exec(ctx, b.redisCli, []string{keyInfo.StreamKey()}, []string{b.layout.String(), streamGroup,
+			streamRecoveryConsumer, strconv.FormatInt(idleTimeout.Milliseconds(), 10), strconv.Itoa(int(Pending)), strconv.Itoa(int(Active))}).AsStrSlice()
+		//goland:noinspection GoDirectComparisonOfErrors
+		if err == rueidis.Nil {
+			err = nil
+		}
+		if err != nil {
+			return
+		}
+		n += len(taskKeys)
+		if len(taskKeys) > 0 {
+			err = b.ReleaseLeases(ctx, taskKeys)
+			if err != nil {
+				return
+			}
+		}
+	}
+	return
+}
+
+// LiveTasksChange resets idle time of stream entries of items picked by this broker,
+// so they are not recovered while being handled.
+func (b *StreamBroker) LiveTasksChange(ctx context.Context, items []*liveItem, _ bool) (err error) {
+	m := map[string][]string{}
+	for _, item := range items {
+		keyInfo := b.keyInfo(item.queue)
+		if keyInfo == nil {
+			continue
+		}
+		if id, ok := b.entries.Load(keyInfo.TaskKey(item.taskID)); ok {
+			m[keyInfo.StreamKey()] = append(m[keyInfo.StreamKey()], id.(string))
+		}
+	}
+	for stream, ids := range m {
+		err = b.redisCli.Do(ctx, b.redisCli.B().Xclaim().Key(stream).Group(streamGroup).Consumer(b.consumer).MinIdleTime("0").
+			Id(ids...).Justid().Build()).Error()
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// DeleteLiveTasks does nothing, entries are acknowledged when tasks leave active state.
+func (b *StreamBroker) DeleteLiveTasks(context.Context, []*liveItem) (err error) {
+	return
+}
@@ -0,0 +1,104 @@
+package acornq
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestStreamBroker(t *testing.T) {
+	redisCli := client(t)
+	for _, layout := range testLayouts(t, redisCli) {
+		t.Run(layout.String(), func(t *testing.T) {
+			ctx := context.Background()
+			queue := testQueue(t)
+			keyInfo := NewKeyInfo(queue)
+			broker := NewStreamBroker(redisCli, layout)
+			broker.AddQueue(queue)
+			backlog := func() int64 {
+				m, err := broker.Backlog(ctx, []string{queue})
+				require.Nil(t, err)
+				return m[queue]
+			}
+			xlen := func() int64 {
+				n, err := redisCli.Do(ctx, redisCli.B().Xlen().Key(keyInfo.StreamKey()).Build()).AsInt64()
+				require.Nil(t, err)
+				return n
+			}
+			cli := NewClientWithBroker(broker)
+			for _, id := range []string{"a", "b", "c", "d"} {
+				require.Nil(t, cli.EnqueueContext(ctx, NewTask("task", []byte(id)), Queue(queue), TaskID(id)))
+			}
+			assert.Equal(t, int64(4), backlog())
+
+			ts, err := broker.PickTasks(ctx, []string{queue}, 10, nil)
+			require.Nil(t, err)
+			require.Len(t, ts, 4)
+			picked := map[string]*TaskInfo{}
+			for _, task := range ts {
+				assert.Equal(t, Active, task.State)
+				assert.Equal(t, string(task.ID), string(task.Payload))
+				assert.NotEmpty(t, task.streamID)
+				picked[string(task.ID)] = task
+			}
+			assert.Equal(t, int64(0), backlog())
+
+			// entries of archived and retried tasks are acknowledged and deleted
+			require.Nil(t, broker.Active2Archive(ctx, []*TaskInfo{picked["a"]}, true))
+			picked["b"].PendingAt = time.Now().Unix() + 60
+			picked["b"].Retried = 1
+			require.Nil(t, broker.RetryTasks(ctx, []*TaskInfo{picked["b"]}))
+			assert.Equal(t, int64(2), xlen())
+			// a has no retention
+			n, err := redisCli.Do(ctx, redisCli.B().Exists().Key(keyInfo.TaskKey("a")).Build()).AsInt64()
+			require.Nil(t, err)
+			assert.Equal(t, int64(0), n)
+			assert.Equal(t, Retried, getTask(t, redisCli, layout, keyInfo.TaskKey("b")).State)
+
+			// c is added to stream again as a new entry
+			require.Nil(t, broker.Active2Pending(ctx, []*TaskInfo{picked["c"]}))
+			assert.Equal(t, int64(2), xlen())
+			assert.Equal(t, int64(1), backlog())
+			assert.Equal(t, Pending, getTask(t, redisCli, layout, keyInfo.TaskKey("c")).State)
+
+			// d is left by a stopped server, its entry is claimed when idle
+			time.Sleep(50 * time.Millisecond)
+			recovered, err := broker.RecoveryTasks([]string{queue}, 20*time.Millisecond)
+			require.Nil(t, err)
+			assert.Equal(t, 1, recovered)
+			assert.Equal(t, Pending, getTask(t, redisCli, layout, keyInfo.TaskKey("d")).State)
+			assert.Equal(t, int64(2), backlog())
+			// consumer of this broker has no pending entries left and is idle
+			consumers, err := redisCli.Do(ctx, redisCli.B().XinfoConsumers().Key(keyInfo.StreamKey()).Group(streamGroup).Build()).ToArray()
+			require.Nil(t, err)
+			for _, c := range consumers {
+				info, err := c.AsStrMap()
+				require.Nil(t, err)
+				assert.NotEqual(t, broker.consumer, info["name"])
+			}
+
+			// entry of a deleted task is dropped by recovery
+			ts, err = broker.PickTasks(ctx, []string{queue}, 10, nil)
+			require.Nil(t, err)
+			require.Len(t, ts, 2)
+			require.Nil(t, redisCli.Do(ctx, redisCli.B().Del().Key(keyInfo.TaskKey(string(ts[0].ID))).Build()).Error())
+			time.Sleep(50 * time.Millisecond)
+			recovered, err = broker.RecoveryTasks([]string{queue}, 20*time.Millisecond)
+			require.Nil(t, err)
+			assert.Equal(t, 1, recovered)
+			assert.Equal(t, int64(1), xlen())
+			assert.Equal(t, int64(1), backlog())
+		})
+	}
+}
+
+func TestStreamBroker_LongRunningTask(t *testing.T) {
+	redisCli := client(t)
+	for _, layout := range testLayouts(t, redisCli) {
+		t.Run(layout.String(), func(t *testing.T) {
+			testLongRunningTask(t, NewStreamBroker(redisCli, layout), testQueue(t))
+		})
+	}
+}
@@ -1,10 +1,15 @@
 package acornq
 
 import (
+	"bytes"
+	"context"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"strings"
 	"time"
+	"unicode/utf8"
 )
 
 // TaskState denotes the state of a task.
@@ -25,37 +30,102 @@ const (
 	Archived
 )
 
+// StringBytes is bytes encoded as a json string. Valid UTF-8 is escaped as usual, other bytes(binary
+// payloads) are encoded in base64 after base64Marker, so any bytes round-trip through MarshalTask.
 type StringBytes []byte
 
+// base64Marker prefixes base64 encoded StringBytes, a NUL rune is not expected at the start of text.
+const base64Marker = "\x00b64:"
+
 func (s *StringBytes) UnmarshalJSON(b []byte) error {
-	if len(b) > 2 {
-		*s = append(*s, b[1:len(b)-1]...)
+	if len(b) < 2 || b[0] != '"' || b[len(b)-1] != '"' {
+		if string(b) == "null" {
+			*s = nil
+			return nil
+		}
+		return fmt.Errorf("acornq: invalid json string %q", b)
+	}
+	raw := b[1 : len(b)-1]
+	if bytes.IndexByte(raw, '\\') == -1 {
+		*s = append((*s)[:0], raw...)
+		return nil
+	}
+	var str string
+	if err := json.Unmarshal(b, &str); err != nil {
+		return err
+	}
+	if strings.HasPrefix(str, base64Marker) {
+		v, err := base64.StdEncoding.DecodeString(str[len(base64Marker):])
+		if err != nil {
+			return err
+		}
+		*s = v
+		return nil
 	}
+	*s = append((*s)[:0], str...)
 	return nil
 }
 
 func (s *StringBytes) MarshalJSON() ([]byte, error) {
-	l := len(*s)
-	b := make([]byte, l+2)
-	b[0] = '"'
-	b[l+1] = '"'
-	copy(b[1:l+1], *s)
-	b[l+1] = '"'
-	return b, nil
+	return appendJSONString(make([]byte, 0, len(*s)+2), *s), nil
+}
+
+// appendJSONString appends v encoded as a json string to b.
+func appendJSONString(b, v []byte) []byte {
+	if !utf8.Valid(v) || bytes.HasPrefix(v, []byte(base64Marker)) {
+		b = append(b, `"\u0000b64:`...)
+		b = base64.StdEncoding.AppendEncode(b, v)
+		return append(b, '"')
+	}
+	const hex = "0123456789abcdef"
+	b = append(b, '"')
+	start := 0
+	for i, c := range v {
+		if c >= 0x20 && c != '"' && c != '\\' {
+			continue
+		}
+		b = append(b, v[start:i]...)
+		switch c {
+		case '"', '\\':
+			b = append(b, '\\', c)
+		case '\n':
+			b = append(b, '\\', 'n')
+		case '\r':
+			b = append(b, '\\', 'r')
+		case '\t':
+			b = append(b, '\\', 't')
+		default:
+			b = append(b, '\\', 'u', '0', '0', hex[c>>4], hex[c&0xf])
+		}
+		start = i + 1
+	}
+	b = append(b, v[start:]...)
+	return append(b, '"')
 }
 
 type Task struct {
 	typeName string
 	payload  []byte
 	opts     []Optioner
+	headers  map[string]string
 }
 
+// NewTask returns a task, Header options in opts become headers of the task.
 func NewTask(typeName string, payload []byte, opts ...Optioner) Task {
-	return Task{
+	t := Task{
 		typeName: typeName,
 		payload:  payload,
 		opts:     opts,
 	}
+	for _, opt := range opts {
+		if h, ok := opt.(headerOption); ok {
+			if t.headers == nil {
+				t.headers = map[string]string{}
+			}
+			t.headers[h.key] = h.value
+		}
+	}
+	return t
 }
 
 func (t Task) TypeIdentifier() string {
@@ -65,6 +135,11 @@ func (t Task) Payload() []byte {
 	return t.payload
 }
 
+// Headers returns headers of the task, Header options passed to Client.EnqueueContext override them.
+func (t Task) Headers() map[string]string {
+	return t.headers
+}
+
 type Tasker interface {
 	TypeIdentifier() string
 	Payload() []byte
@@ -77,6 +152,14 @@ type TaskInfo struct {
 	Type StringBytes `json:"type"`
 	// task payload
 	Payload StringBytes `json:"payload"`
+	// name of Compressor compressed payload, empty if not compressed
+	Compression StringBytes `json:"compression,omitempty"`
+	// BlobStore key of payload offloaded by client, Payload is empty then
+	PayloadRef StringBytes `json:"payload_ref,omitempty"`
+	// id of the Encryptor key encrypted payload, empty if not encrypted
+	EncryptionKey StringBytes `json:"encryption_key,omitempty"`
+	// metadata propagated alongside payload, such as tenant id, request id and trace context
+	Headers map[string]string `json:"headers,omitempty"`
 	// queue name such as : default
 	Queue StringBytes `json:"queue"`
 	// unique key
@@ -103,6 +186,98 @@ type TaskInfo struct {
 	PendingAt int64 `json:"pending_at,omitempty"`
 	// successful at or last failed at
 	CompletedAt int64 `json:"completed_at,omitempty"`
+	// latest handling attempts from old to new, at most maxTaskAttempts are kept
+	Attempts []*TaskAttempt `json:"attempts,omitempty"`
+
+	// context of current handling, set by worker
+	ctx context.Context
+	// called by worker after handling, such as releasing semaphore leases
+	cleanups []func()
+	// current handling attempt recorded by broker, set by worker
+	attempt *TaskAttempt
+	// stream entry id of task picked by StreamBroker
+	streamID string
+}
+
+// maxTaskAttempts is max attempts kept in TaskInfo.Attempts, older ones are dropped.
+const maxTaskAttempts = 16
+
+// TaskAttempt records one handling of a task.
+type TaskAttempt struct {
+	// unix timestamp seconds the handling started at
+	StartedAt int64 `json:"started_at"`
+	// how long the handler ran
+	Duration time.Duration `json:"duration"`
+	// handler error, empty if succeeded
+	Error string `json:"error,omitempty"`
+	// id of the server handled the task
+	ServerID string `json:"server_id"`
+}
+
+// attemptArg returns json of the current attempt as script argument, empty if not recorded.
+func (ti *TaskInfo) attemptArg() string {
+	if ti.attempt == nil {
+		return ""
+	}
+	b, err := json.Marshal(ti.attempt)
+	if err != nil {
+		return ""
+	}
+	return b2s(b)
+}
+
+// Context returns the context of current handling, it is done when the task reaches
+// its timeout or deadline. context.Background is returned outside handling.
+func (ti *TaskInfo) Context() context.Context {
+	if ti.ctx == nil {
+		return context.Background()
+	}
+	return ti.ctx
+}
+
+type headersCtxKey struct{}
+
+// HeadersFromContext returns headers of the task handled with ctx, nil if it has none.
+// ctx is TaskInfo.Context or derived from it.
+func HeadersFromContext(ctx context.Context) map[string]string {
+	h, _ := ctx.Value(headersCtxKey{}).(map[string]string)
+	return h
+}
+
+// HeaderFromContext returns header key of the task handled with ctx.
+func HeaderFromContext(ctx context.Context, key string) (value string, ok bool) {
+	value, ok = HeadersFromContext(ctx)[key]
+	return
+}
+
+// deadline returns the earliest of Deadline and Timeout from now,
+// defaultTimeout is used if both are not specified.
+func (ti *TaskInfo) deadline(now time.Time) time.Time {
+	var d time.Time
+	if ti.Timeout > 0 {
+		d = now.Add(time.Duration(ti.Timeout) * time.Second)
+	}
+	if ti.Deadline > 0 {
+		if d2 := time.Unix(ti.Deadline, 0); d.IsZero() || d2.Before(d) {
+			d = d2
+		}
+	}
+	if d.IsZero() {
+		d = now.Add(defaultTimeout)
+	}
+	return d
+}
+
+// onDone registers fn called by worker after handling.
+func (ti *TaskInfo) onDone(fn func()) {
+	ti.cleanups = append(ti.cleanups, fn)
+}
+
+func (ti *TaskInfo) done() {
+	for i := len(ti.cleanups) - 1; i >= 0; i-- {
+		ti.cleanups[i]()
+	}
+	ti.cleanups = nil
 }
 
 func MarshalTask(t *TaskInfo) ([]byte, error) {
@@ -133,6 +308,8 @@ const (
 	ProcessInOpt
 	TaskIDOpt
 	RetentionOpt
+	CompressOpt
+	HeaderOpt
 )
 
 // Optioner specifies the task processing behavior.
@@ -159,6 +336,13 @@ type (
 	processAtOption time.Time
 	processInOption time.Duration
 	retentionOption time.Duration
+	compressOption  struct {
+		c         Compressor
+		threshold int
+	}
+	headerOption struct {
+		key, value string
+	}
 )
 
 // MaxRetry returns an Option to specify the max number of times
@@ -323,6 +507,50 @@ func (ttl retentionOption) Set(o *option) (err error) {
 	return
 }
 
+// Compress returns an Option to compress payloads of at least threshold bytes by c,
+// workers decompress them before calling the handler. Compressors other than
+// the built-in ones must be registered by RegisterCompressor on servers.
+func Compress(c Compressor, threshold int) Optioner {
+	return compressOption{c: c, threshold: threshold}
+}
+
+func (c compressOption) String() string {
+	name := "<nil>"
+	if c.c != nil {
+		name = c.c.Name()
+	}
+	return fmt.Sprintf("Compress(%s, %d)", name, c.threshold)
+}
+func (c compressOption) Type() OptionType   { return CompressOpt }
+func (c compressOption) Value() interface{} { return c.c }
+
+func (c compressOption) Set(o *option) (err error) {
+	if c.c == nil {
+		return errors.New("compressor cannot be nil")
+	}
+	o.compressor = c.c
+	o.compressThreshold = c.threshold
+	return
+}
+
+// Header returns an Option to set header key of the task to value, see TaskInfo.Headers.
+// Handlers read headers by HeaderFromContext.
+func Header(key, value string) Optioner {
+	return headerOption{key: key, value: value}
+}
+
+func (h headerOption) String() string     { return fmt.Sprintf("Header(%q, %q)", h.key, h.value) }
+func (h headerOption) Type() OptionType   { return HeaderOpt }
+func (h headerOption) Value() interface{} { return [2]string{h.key, h.value} }
+
+func (h headerOption) Set(o *option) (err error) {
+	if o.headers == nil {
+		o.headers = map[string]string{}
+	}
+	o.headers[h.key] = h.value
+	return
+}
+
 // ErrDuplicateTask indicates that the given task could not be enqueued since it's a duplicate of another task.
 //
 // ErrDuplicateTask error only applies to tasks enqueued with a Unique Option.
@@ -2,12 +2,18 @@ package acornq
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"github.com/redis/rueidis"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"log"
+	"os"
+	"strings"
 	"testing"
 	"time"
+	"unicode/utf8"
 )
 
 func TestMarshalTask(t *testing.T) {
@@ -26,13 +32,150 @@ func TestMarshalTask(t *testing.T) {
 	_ = t1
 }
 
+func FuzzMarshalTask(f *testing.F) {
+	f.Add([]byte(`{"a": "b\\c"}`), "line1\nline2")
+	f.Add([]byte{0xff, 0x00, '"'}, "\x00b64:text")
+	f.Add([]byte("\x00b64:AAAA"), "\u2028</script>")
+	f.Fuzz(func(t *testing.T, payload []byte, msg string) {
+		t1 := &TaskInfo{ID: StringBytes("id"), Type: StringBytes("type"), Payload: payload, ErrorMsg: StringBytes(msg)}
+		b, err := MarshalTask(t1)
+		assert.Nil(t, err)
+		assert.True(t, json.Valid(b), string(b))
+		t2, err := unmarshalTask(b)
+		assert.Nil(t, err)
+		assert.Equal(t, string(payload), string(t2.Payload))
+		assert.Equal(t, msg, string(t2.ErrorMsg))
+		// ErrorMsg is set alone by SetErrorMsg
+		b, _ = t1.ErrorMsg.MarshalJSON()
+		var s string
+		if utf8.ValidString(msg) && !strings.HasPrefix(msg, base64Marker) {
+			assert.Nil(t, json.Unmarshal(b, &s))
+			assert.Equal(t, msg, s)
+		}
+	})
+}
+
 func TestTemp(t *testing.T) {
 	//log.Println(time.Time{}.Unix())
 	t.Log(noDeadline.Unix())
 }
 
 func TestClient_EnqueueContext(t *testing.T) {
-	redisCli := client()
+	redisCli := client(t)
+	for _, layout := range testLayouts(t, redisCli) {
+		t.Run(layout.String(), func(t *testing.T) {
+			ctx := context.Background()
+			queue := testQueue(t)
+			broker := NewRedisBrokerWithLayout(redisCli, layout)
+			cli := NewClientWithBroker(broker)
+			for i := 0; i < 10; i++ {
+				var o Optioner
+				var payload = []byte("payload")
+				if i%2 == 0 {
+					o = processInOption(time.Second * 60)
+					payload = []byte("scheduled payload")
+				}
+				err := cli.EnqueueContext(ctx, NewTask("task", payload), o, Queue(queue), Retention(time.Second*120))
+				assert.Nil(t, err)
+			}
+			m, err := broker.Backlog(ctx, []string{queue})
+			assert.Nil(t, err)
+			assert.Equal(t, int64(5), m[queue])
+			n, err := redisCli.Do(ctx, redisCli.B().Zcard().Key(NewKeyInfo(queue).ScheduledKey()).Build()).AsInt64()
+			assert.Nil(t, err)
+			assert.Equal(t, int64(5), n)
+		})
+	}
+}
+
+func TestServer(t *testing.T) {
+	redisCli := client(t)
+	for _, layout := range testLayouts(t, redisCli) {
+		t.Run(layout.String(), func(t *testing.T) {
+			queue := testQueue(t)
+			broker := NewRedisBrokerWithLayout(redisCli, layout)
+			handled := make(chan string, 3)
+			s, err := NewServer(&Config{
+				Handler: TaskHandlerFunc(func(task *TaskInfo) error {
+					handled <- string(task.Payload)
+					return nil
+				}),
+				Queues:           map[string]int{queue: 1},
+				Broker:           broker,
+				TaskPeekInterval: time.Second * 2,
+			})
+			assert.Nil(t, err)
+			go s.Start()
+			cli := NewClientWithBroker(broker)
+			for i := 0; i < 3; i++ {
+				err = cli.EnqueueContext(context.Background(), NewTask("task", []byte("payload")), Queue(queue))
+				assert.Nil(t, err)
+			}
+			for i := 0; i < 3; i++ {
+				select {
+				case payload := <-handled:
+					assert.Equal(t, "payload", payload)
+				case <-time.After(time.Second * 5):
+					t.Fatal("task not handled")
+				}
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+			defer cancel()
+			s.ShutDown(ctx)
+		})
+	}
+}
+
+func TestWorker(t *testing.T) {
+	redisCli := client(t)
+	for _, layout := range testLayouts(t, redisCli) {
+		t.Run(layout.String(), func(t *testing.T) {
+			queue := testQueue(t)
+			broker := NewRedisBrokerWithLayout(redisCli, layout)
+			broker.AddQueue(queue)
+			s := &Server{
+				errHandler: func(err error) {
+					t.Error(err)
+				},
+				handler: TaskHandlerFunc(func(t *TaskInfo) (err error) {
+					return errors.New("tmp error")
+				}),
+				stopCh:         make(chan struct{}),
+				isFailure:      defaultIsFailureFunc,
+				retryDelayFunc: defaultRetryDelayFunc,
+			}
+			wq := newWeightedQueues(map[string]int{queue: 1}, false)
+			pool := newWorkerPool(s)
+			f := newFetcher(s.stopCh, nil, broker, pool, wq, wq.names, 1, 0, time.Millisecond*10, s.errHandler)
+			go f.Start()
+			w := Worker{
+				pool:   pool,
+				f:      f,
+				broker: broker,
+				s:      s,
+			}
+			go w.exec()
+			ctx := context.Background()
+			err := NewClientWithBroker(broker).EnqueueContext(ctx, NewTask("task", []byte("payload")), Queue(queue), TaskID("id"))
+			assert.Nil(t, err)
+			keyInfo := NewKeyInfo(queue)
+			assert.Eventually(t, func() bool {
+				n, err := redisCli.Do(ctx, redisCli.B().Zcard().Key(keyInfo.RetryKey()).Build()).AsInt64()
+				return err == nil && n == 1
+			}, time.Second*5, time.Millisecond*10)
+			close(s.stopCh)
+			task := getTask(t, redisCli, layout, keyInfo.TaskKey("id"))
+			assert.Equal(t, Retried, task.State)
+			assert.Equal(t, 1, task.Retried)
+			assert.Equal(t, "tmp error", string(task.ErrorMsg))
+			assert.Len(t, task.Attempts, 1)
+		})
+	}
+}
+
+func TestClient_EnqueueContext_MemoryBroker(t *testing.T) {
+	broker := NewMemoryBroker()
+	cli := NewClientWithBroker(broker)
 	for i := 0; i < 10; i++ {
 		var o Optioner
 		var payload = []byte("payload")
@@ -40,22 +183,21 @@ func TestClient_EnqueueContext(t *testing.T) {
 			o = processInOption(time.Second * 60)
 			payload = []byte("scheduled payload")
 		}
-		cli := NewClient(redisCli)
 		err := cli.EnqueueContext(context.Background(), NewTask("task", payload), o, Retention(time.Second*120))
 		assert.Nil(t, err)
 	}
-
+	m, err := broker.Backlog(context.Background(), []string{defaultQueueName})
+	assert.Nil(t, err)
+	assert.Equal(t, int64(5), m[defaultQueueName])
+	assert.Len(t, broker.queues[defaultQueueName].scheduled, 5)
 }
 
-func TestServer(t *testing.T) {
-	rueidis.RedisResult{}.ToMap()
-	log.SetFlags(log.Lshortfile)
-	broker := &Broker{
-		redisCli: client(),
-	}
+func TestServer_MemoryBroker(t *testing.T) {
+	broker := NewMemoryBroker()
+	handled := make(chan string, 3)
 	s, err := NewServer(&Config{
 		Handler: TaskHandlerFunc(func(task *TaskInfo) error {
-			log.Println(string(task.Payload))
+			handled <- string(task.Payload)
 			return nil
 		}),
 		Queues:           map[string]int{"default": 1},
@@ -63,48 +205,214 @@ func TestServer(t *testing.T) {
 		TaskPeekInterval: time.Second * 2,
 	})
 	assert.Nil(t, err)
-	s.Start()
+	go s.Start()
+	cli := NewClientWithBroker(broker)
+	for i := 0; i < 3; i++ {
+		err = cli.EnqueueContext(context.Background(), NewTask("task", []byte("payload")))
+		assert.Nil(t, err)
+	}
+	for i := 0; i < 3; i++ {
+		select {
+		case payload := <-handled:
+			assert.Equal(t, "payload", payload)
+		case <-time.After(time.Second * 5):
+			t.Fatal("task not handled")
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+	defer cancel()
+	s.ShutDown(ctx)
 }
 
-func TestWorker(t *testing.T) {
-	log.SetFlags(log.Lshortfile)
-	redisCli := client()
-	broker := &Broker{
-		redisCli: redisCli,
-		keyInfos: []*KeyInfo{
-			NewKeyInfo("default")},
-	}
+func TestWorker_MemoryBroker(t *testing.T) {
+	broker := NewMemoryBroker()
+	broker.AddQueue("default")
 	s := &Server{
 		errHandler: func(err error) {
-			log.Println(err)
+			t.Error(err)
 		},
 		handler: TaskHandlerFunc(func(t *TaskInfo) (err error) {
-			log.Println(string(t.Payload))
 			return errors.New("tmp error")
 		}),
+		stopCh:         make(chan struct{}),
 		isFailure:      defaultIsFailureFunc,
 		retryDelayFunc: defaultRetryDelayFunc,
 	}
+	wq := newWeightedQueues(map[string]int{"default": 1}, false)
+	pool := newWorkerPool(s)
+	f := newFetcher(s.stopCh, nil, broker, pool, wq, wq.names, 1, 0, time.Millisecond*10, s.errHandler)
+	go f.Start()
 	w := Worker{
-		queues:       []string{"default"},
-		broker:       broker,
-		s:            s,
-		pollInterval: time.Second * 2,
+		pool:   pool,
+		f:      f,
+		broker: broker,
+		s:      s,
 	}
-	w.exec()
+	go w.exec()
+	err := NewClientWithBroker(broker).EnqueueContext(context.Background(), NewTask("task", []byte("payload")), TaskID("id"))
+	assert.Nil(t, err)
+	assert.Eventually(t, func() bool {
+		broker.mu.Lock()
+		defer broker.mu.Unlock()
+		return len(broker.queues["default"].retry) == 1
+	}, time.Second*5, time.Millisecond*10)
+	close(s.stopCh)
+	broker.mu.Lock()
+	defer broker.mu.Unlock()
+	task := broker.queues["default"].tasks["id"]
+	assert.Equal(t, Retried, task.State)
+	assert.Equal(t, 1, task.Retried)
+	assert.Equal(t, "tmp error", string(task.ErrorMsg))
+	assert.Len(t, task.Attempts, 1)
 }
 
-func client() (cli rueidis.Client) {
-	cli, err := rueidis.NewClient(rueidis.ClientOption{InitAddress: []string{"localhost:6380"}, DisableCache: true,
+// client connects to the redis at ACORNQ_REDIS_ADDR(localhost:6380 by default), the test is skipped
+// if redis is unreachable.
+func client(t *testing.T) (cli rueidis.Client) {
+	addr := os.Getenv("ACORNQ_REDIS_ADDR")
+	if addr == "" {
+		addr = "localhost:6380"
+	}
+	cli, err := rueidis.NewClient(rueidis.ClientOption{InitAddress: []string{addr}, DisableCache: true,
 		ForceSingleClient: true,
 		MaxFlushDelay:     20 * time.Microsecond,
 	})
 	if err != nil {
-		log.Fatal(err)
+		t.Skipf("redis %s unreachable: %v", addr, err)
 	}
+	t.Cleanup(cli.Close)
 	return
 }
 
+// testLayouts returns layouts supported by cli, LayoutJSON requires RedisJSON module.
+func testLayouts(t *testing.T, cli rueidis.Client) []StorageLayout {
+	key := "acornq:test:" + t.Name()
+	err := cli.Do(context.Background(), cli.B().JsonSet().Key(key).Path("$").Value("{}").Build()).Error()
+	if err != nil {
+		return []StorageLayout{LayoutHash}
+	}
+	cli.Do(context.Background(), cli.B().Del().Key(key).Build())
+	return []StorageLayout{LayoutJSON, LayoutHash}
+}
+
+// getTask reads the task stored at key in layout.
+func getTask(t *testing.T, cli rueidis.Client, layout StorageLayout, key string) *TaskInfo {
+	var v rueidis.RedisResult
+	if layout == LayoutHash {
+		v = cli.Do(context.Background(), cli.B().Hgetall().Key(key).Build())
+	} else {
+		v = cli.Do(context.Background(), cli.B().JsonGet().Key(key).Build())
+	}
+	msg, err := v.ToMessage()
+	require.Nil(t, err)
+	task, err := layout.decodeTask(msg)
+	require.Nil(t, err)
+	return task
+}
+
+// testQueue returns a queue name not used by other runs sharing the redis.
+func testQueue(t *testing.T) string {
+	return fmt.Sprintf("%s-%d", strings.ToLower(t.Name()), time.Now().UnixNano())
+}
+
 func TestLog(t *testing.T) {
 	defaultErrHandler(errors.New("tmp error"))
 }
+
+func TestWorker_ProcessPanic(t *testing.T) {
+	w := Worker{s: &Server{handler: TaskHandlerFunc(func(t *TaskInfo) error {
+		panic("boom")
+	})}}
+	err := w.process(&TaskInfo{})
+	assert.True(t, IsPanic(err))
+	assert.False(t, IsSkipRetry(err))
+	assert.Contains(t, err.Error(), "panic: boom")
+	assert.Contains(t, err.Error(), "TestWorker_ProcessPanic")
+	t.Log(err)
+}
+
+func TestServer_HandlerErrors(t *testing.T) {
+	ctx := context.Background()
+	broker := NewMemoryBroker()
+	s, err := NewServer(&Config{
+		Handler: TaskHandlerFunc(func(task *TaskInfo) error {
+			switch string(task.ID) {
+			case "skip":
+				return fmt.Errorf("bad payload: %w", SkipRetry)
+			case "revoke":
+				return fmt.Errorf("obsolete: %w", RevokeTask)
+			}
+			return nil
+		}),
+		Broker:           broker,
+		TaskPeekInterval: 10 * time.Millisecond,
+		ErrHandler:       func(err error) { t.Error(err) },
+	})
+	require.Nil(t, err)
+	go s.Start()
+	defer func() {
+		ctx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+		defer cancel()
+		s.ShutDown(ctx)
+	}()
+	cli := NewClientWithBroker(broker)
+	for _, id := range []string{"skip", "revoke"} {
+		require.Nil(t, cli.EnqueueContext(ctx, NewTask("task", nil), TaskID(id), MaxRetry(5), Retention(time.Hour)))
+	}
+	assert.Eventually(t, func() bool {
+		broker.mu.Lock()
+		defer broker.mu.Unlock()
+		q := broker.queues[defaultQueueName]
+		return len(q.pending) == 0 && len(q.active) == 0
+	}, 5*time.Second, 10*time.Millisecond)
+	broker.mu.Lock()
+	defer broker.mu.Unlock()
+	q := broker.queues[defaultQueueName]
+	// wrapped SkipRetry archives the task as failed without retry
+	skipped := q.tasks["skip"]
+	require.NotNil(t, skipped)
+	assert.Equal(t, Archived|Failed, skipped.State)
+	assert.Equal(t, 0, skipped.Retried)
+	assert.Equal(t, "bad payload: skip retry for the task", string(skipped.ErrorMsg))
+	assert.Equal(t, []string{"skip"}, q.failed)
+	assert.Empty(t, q.retry)
+	// wrapped RevokeTask deletes the task outright
+	assert.Nil(t, q.tasks["revoke"])
+	assert.NotContains(t, q.failed, "revoke")
+	assert.NotContains(t, q.successful, "revoke")
+}
+
+func TestHeaders(t *testing.T) {
+	ctx := context.Background()
+	broker := NewMemoryBroker()
+	got := make(chan map[string]string, 1)
+	s, err := NewServer(&Config{
+		Handler: TaskHandlerFunc(func(task *TaskInfo) error {
+			tenant, _ := HeaderFromContext(task.Context(), "tenant")
+			assert.Equal(t, "t2", tenant)
+			got <- HeadersFromContext(task.Context())
+			return nil
+		}),
+		Broker:           broker,
+		TaskPeekInterval: 10 * time.Millisecond,
+	})
+	assert.Nil(t, err)
+	go s.Start()
+	defer func() {
+		ctx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+		defer cancel()
+		s.ShutDown(ctx)
+	}()
+	task := NewTask("task", nil, Header("tenant", "t1"), Header("request_id", "r1"))
+	assert.Equal(t, map[string]string{"tenant": "t1", "request_id": "r1"}, task.Headers())
+	// enqueue options override headers of task
+	assert.Nil(t, NewClientWithBroker(broker).EnqueueContext(ctx, task, Header("tenant", "t2")))
+	select {
+	case h := <-got:
+		assert.Equal(t, map[string]string{"tenant": "t2", "request_id": "r1"}, h)
+	case <-time.After(5 * time.Second):
+		t.Fatal("task not handled")
+	}
+	_, ok := HeaderFromContext(ctx, "tenant")
+	assert.False(t, ok)
+}
@@ -2,17 +2,20 @@ package acornq
 
 import (
 	"context"
-	"math/rand"
+	"errors"
 	"time"
 )
 
 type Worker struct {
-	s            *Server
-	queues       []string
-	broker       *Broker
-	queuesStrict bool
-	beatItemCh   chan *liveItem
-	pollInterval time.Duration
+	id         int
+	s          *Server
+	pool       *WorkerPool
+	broker     Broker
+	beatItemCh chan *liveItem
+	// picked tasks from fetcher
+	f *fetcher
+	// closed when pool shrinks
+	quit chan struct{}
 }
 
 func (w *Worker) exec() {
@@ -20,66 +23,158 @@ func (w *Worker) exec() {
 		if w.s.stop.Load() == 1 {
 			return
 		}
-		ts, err := w.broker.PickTasks(context.Background(), w.queueNames(), 1)
-		if err != nil {
-			w.s.errHandler(err)
-		}
-		if w.s.stop.Load() == 1 || err != nil {
-			// move ts from active set to pending set.
-			if len(ts) > 0 {
-				err = w.broker.Active2Pending(context.Background(), ts)
-				if err != nil {
-					w.s.errHandler(err)
-				}
+		w.pool.workerIdle()
+		select {
+		case t, ok := <-w.f.tasks():
+			w.pool.workerBusy()
+			if !ok {
+				// taskCh rebuilt by fetcher
+				continue
 			}
+			w.handle(t)
+			w.pool.taskDone(t)
+		case <-w.s.stopCh:
+			w.pool.workerBusy()
+			return
+		case <-w.quit:
+			w.pool.workerBusy()
 			return
 		}
-		if len(ts) == 0 {
-			time.Sleep(w.pollInterval)
-		}
+	}
+}
 
-		for i, t := range ts {
-			err = w.s.handler.Handle(t)
-			if err != nil {
-				w.handleConsumerError(t, err)
-			} else {
-				err = w.broker.Active2Archive(context.Background(), []*TaskInfo{t}, true)
-				if err != nil {
-					w.s.errHandler(err)
-				}
-			}
-			if w.s.stop.Load() == 1 {
-				// move left ts from active set to pending set.
-				if len(ts[i+1:]) > 0 {
-					err = w.broker.Active2Pending(context.Background(), ts[i+1:])
-					if err != nil {
-						w.s.errHandler(err)
-					}
-				}
-				return
-			}
-		}
+func (w *Worker) handle(t *TaskInfo) {
+	w.s.state.taskStarted(w.id, t)
+	item := &liveItem{taskID: string(t.ID), queue: string(t.Queue)}
+	w.beat(item)
+	startedAt := time.Now()
+	ctx, cancel := context.WithDeadline(context.Background(), t.deadline(startedAt))
+	if len(t.Headers) > 0 {
+		ctx = context.WithValue(ctx, headersCtxKey{}, t.Headers)
+	}
+	t.ctx = ctx
+	err := fetchPayload(ctx, w.s.blobStore, t)
+	if err == nil {
+		err = decryptPayload(w.s.encryptor, t)
+	}
+	if err == nil {
+		err = decompressPayload(t)
+	}
+	if err == nil {
+		err = w.process(t)
+	}
+	cancel()
+	t.attempt = &TaskAttempt{
+		StartedAt: startedAt.Unix(),
+		Duration:  time.Since(startedAt),
+		ServerID:  w.s.id,
+	}
+	if err != nil {
+		t.attempt.Error = err.Error()
+	}
+	t.done()
+	t.ctx = nil
+	item.stop.Store(true)
+	w.beat(item)
+	w.s.state.taskDone(t)
+	if err != nil {
+		w.handleConsumerError(t, err)
+		return
+	}
+	err = w.broker.Active2Archive(context.Background(), []*TaskInfo{t}, true)
+	if err != nil {
+		w.s.errHandler(err)
+		return
+	}
+	w.taskDeleted(t)
+}
+
+// beat sends item to heartbeat worker, which refreshes live score of the task until item stops.
+func (w *Worker) beat(item *liveItem) {
+	if w.beatItemCh == nil {
+		// no heartbeat worker
+		return
+	}
+	select {
+	case w.beatItemCh <- item:
+	case <-w.s.stopCh:
+	}
+}
+
+// taskDeleted deletes the payload blob of t once t is deleted, tasks kept for Retention
+// have their blobs deleted by Cleaner, tasks in dead letter queue keep them for replay until trimmed.
+func (w *Worker) taskDeleted(t *TaskInfo) {
+	if len(t.PayloadRef) == 0 || w.s.blobStore == nil || t.Retention != 0 {
+		return
+	}
+	if err := w.s.blobStore.Delete(context.Background(), b2s(t.PayloadRef)); err != nil {
+		w.s.errHandler(err)
 	}
 }
 
+// process calls handler, a panic is recovered and returned as *PanicError.
+func (w *Worker) process(t *TaskInfo) (err error) {
+	defer func() {
+		if v := recover(); v != nil {
+			err = newPanicError(v)
+		}
+	}()
+	return w.s.handler.Handle(t)
+}
+
 func (w *Worker) handleConsumerError(t *TaskInfo, err error) {
+	if IsRevokeTask(err) {
+		err = w.broker.DeleteActiveTasks(context.Background(), []*TaskInfo{t})
+		if err != nil {
+			w.s.errHandler(err)
+			return
+		}
+		t.Retention = 0
+		w.taskDeleted(t)
+		return
+	}
 	t.ErrorMsg = s2b(err.Error())
 	er := w.broker.SetErrorMsg(context.Background(), t)
 	if er != nil {
 		w.s.errHandler(er)
 	}
-	if //goland:noinspection GoDirectComparisonOfErrors
-	err == SkipRetry || t.Retried >= t.Retry {
+	var rateLimitErr *RateLimitError
+	if errors.As(err, &rateLimitErr) {
+		// retry later without consuming a retry
+		t.PendingAt = time.Now().Add(rateLimitErr.RetryIn).Unix()
+		t.LastFailedAt = time.Now().Unix()
+		err = w.broker.RetryTasks(context.Background(), []*TaskInfo{t})
+		if err != nil {
+			w.s.errHandler(err)
+		}
+		return
+	}
+	if !IsSkipRetry(err) && t.Retried >= t.Retry && w.s.queueConfigs[b2s(t.Queue)].DeadLetter {
+		trimmed, err := w.broker.Active2DeadLetter(context.Background(), []*TaskInfo{t})
+		if err != nil {
+			w.s.errHandler(err)
+			return
+		}
+		for _, e := range trimmed {
+			e.Task.Retention = 0
+			w.taskDeleted(e.Task)
+		}
+		return
+	}
+	if IsSkipRetry(err) || t.Retried >= t.Retry {
 		err = w.broker.Active2Archive(context.Background(), []*TaskInfo{t}, false)
 		if err != nil {
 			w.s.errHandler(err)
+			return
 		}
+		w.taskDeleted(t)
 		return
 	}
 
 	if w.s.isFailure(err) {
 		t.Retried++
 	}
+	t.LastFailedAt = time.Now().Unix()
 	t.PendingAt = time.Now().Add(w.s.retryDelayFunc(t.Retried, err, t)).Unix()
 	err = w.broker.RetryTasks(context.Background(), []*TaskInfo{t})
 	if err != nil {
@@ -87,13 +182,3 @@ func (w *Worker) handleConsumerError(t *TaskInfo, err error) {
 	}
 	return
 }
-
-func (w *Worker) queueNames() []string {
-	if w.queuesStrict || len(w.queues) == 1 {
-		return w.queues
-	}
-	rand.Shuffle(len(w.queues), func(i, j int) {
-		w.queues[i], w.queues[j] = w.queues[j], w.queues[i]
-	})
-	return w.queues
-}
@@ -1,4 +1,138 @@
 package acornq
 
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// WorkerPool runs the workers of a server, its size can be changed at runtime.
+//
+// It also accounts idle workers and in-flight tasks(picked but not done) of every queue,
+// the fetcher sizes picks by idle workers and skips queues reach their concurrency cap.
 type WorkerPool struct {
+	s  *Server
+	mu sync.Mutex
+	// running workers
+	workers []*Worker
+	nextID  int
+	// count of workers waiting for a task
+	idle atomic.Int32
+	// signaled when a worker becomes idle
+	idleCh chan struct{}
+	// queue name -> max in-flight tasks of this server, 0 means no limit
+	queueLimits map[string]int
+	// queue name -> in-flight tasks
+	inflight map[string]int
+}
+
+func newWorkerPool(s *Server) *WorkerPool {
+	return &WorkerPool{
+		s:           s,
+		idleCh:      make(chan struct{}, 1),
+		queueLimits: map[string]int{},
+		inflight:    map[string]int{},
+	}
+}
+
+// Resize starts or stops workers until n workers are running.
+// Stopped workers exit after their current task is done.
+func (p *WorkerPool) Resize(n int) {
+	if n < 0 {
+		n = 0
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.s.stop.Load() == 1 {
+		return
+	}
+	for len(p.workers) < n {
+		w := &Worker{
+			id:         p.nextID,
+			s:          p.s,
+			pool:       p,
+			broker:     p.s.broker,
+			beatItemCh: p.s.h.beatItemCh,
+			f:          p.s.f,
+			quit:       make(chan struct{}),
+		}
+		p.nextID++
+		p.workers = append(p.workers, w)
+		p.s.wg.Add(1)
+		go func() {
+			defer func() {
+				p.s.wg.Done()
+			}()
+			w.exec()
+		}()
+	}
+	for len(p.workers) > n {
+		last := len(p.workers) - 1
+		close(p.workers[last].quit)
+		p.workers[last] = nil
+		p.workers = p.workers[:last]
+	}
+}
+
+// Size returns count of running workers.
+func (p *WorkerPool) Size() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.workers)
+}
+
+// Idle returns count of workers waiting for a task.
+func (p *WorkerPool) Idle() int {
+	return max(int(p.idle.Load()), 0)
+}
+
+// SetQueueLimit sets max in-flight tasks of queue in this server, 0 means no limit.
+func (p *WorkerPool) SetQueueLimit(queue string, n int) {
+	p.mu.Lock()
+	if n <= 0 {
+		delete(p.queueLimits, queue)
+	} else {
+		p.queueLimits[queue] = n
+	}
+	p.mu.Unlock()
+}
+
+// queueAvailable returns how many more tasks of queue can be picked, -1 means no limit.
+func (p *WorkerPool) queueAvailable(queue string) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	limit, ok := p.queueLimits[queue]
+	if !ok {
+		return -1
+	}
+	return max(limit-p.inflight[queue], 0)
+}
+
+func (p *WorkerPool) taskPicked(t *TaskInfo) {
+	p.mu.Lock()
+	p.inflight[string(t.Queue)]++
+	p.mu.Unlock()
+}
+
+func (p *WorkerPool) taskDone(t *TaskInfo) {
+	p.mu.Lock()
+	if n := p.inflight[b2s(t.Queue)]; n > 1 {
+		p.inflight[b2s(t.Queue)] = n - 1
+	} else {
+		delete(p.inflight, b2s(t.Queue))
+	}
+	p.mu.Unlock()
+}
+
+// workerIdle is called by a worker before it waits for a task.
+func (p *WorkerPool) workerIdle() {
+	p.idle.Add(1)
+	select {
+	case p.idleCh <- struct{}{}:
+	default:
+	}
+}
+
+// workerBusy is called by a worker after it stops waiting for a task.
+func (p *WorkerPool) workerBusy() {
+	p.idle.Add(-1)
 }
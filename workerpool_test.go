@@ -0,0 +1,36 @@
+package acornq
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestWorkerPool_Resize(t *testing.T) {
+	s := &Server{stopCh: make(chan struct{}), h: &heartBeatWorker{}, f: newFetcher(nil, nil, nil, nil, nil, nil, 0, 0, 0, nil)}
+	s.pool = newWorkerPool(s)
+	s.pool.Resize(3)
+	assert.Equal(t, 3, s.pool.Size())
+	assert.Eventually(t, func() bool { return s.pool.Idle() == 3 }, time.Second, time.Millisecond)
+	s.pool.Resize(1)
+	assert.Equal(t, 1, s.pool.Size())
+	assert.Eventually(t, func() bool { return s.pool.Idle() == 1 }, time.Second, time.Millisecond)
+	close(s.stopCh)
+	s.wg.Wait()
+	assert.Equal(t, 0, s.pool.Idle())
+}
+
+func TestWorkerPool_QueueLimit(t *testing.T) {
+	p := newWorkerPool(&Server{})
+	assert.Equal(t, -1, p.queueAvailable("email"))
+	p.SetQueueLimit("email", 2)
+	t1 := &TaskInfo{Queue: StringBytes("email")}
+	p.taskPicked(t1)
+	assert.Equal(t, 1, p.queueAvailable("email"))
+	p.taskPicked(t1)
+	assert.Equal(t, 0, p.queueAvailable("email"))
+	p.taskDone(t1)
+	assert.Equal(t, 1, p.queueAvailable("email"))
+	p.SetQueueLimit("email", 0)
+	assert.Equal(t, -1, p.queueAvailable("email"))
+}